@@ -7,29 +7,64 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/frantjc/port-forward/internal/controller"
 	"github.com/frantjc/port-forward/internal/logutil"
+	"github.com/frantjc/port-forward/internal/natpmp"
+	"github.com/frantjc/port-forward/internal/netutil"
+	"github.com/frantjc/port-forward/internal/opnsense"
+	"github.com/frantjc/port-forward/internal/pcp"
+	"github.com/frantjc/port-forward/internal/pfsense"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdiptables"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdnatpmp"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdnftables"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdopenwrt"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdopnsense"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdpcp"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdpfsense"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdrouteros"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdssh"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdtr064"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdunifi"
 	"github.com/frantjc/port-forward/internal/portfwd/portfwdupnp"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdvyos"
+	"github.com/frantjc/port-forward/internal/routeros"
+	"github.com/frantjc/port-forward/internal/secretref"
+	"github.com/frantjc/port-forward/internal/srcipmasq"
 	"github.com/frantjc/port-forward/internal/srcipmasq/srcipmasqiptables"
+	"github.com/frantjc/port-forward/internal/srcipmasq/srcipmasqnftables"
 	"github.com/frantjc/port-forward/internal/svcip"
 	"github.com/frantjc/port-forward/internal/svcip/svcipdef"
 	"github.com/frantjc/port-forward/internal/svcip/svcipraw"
+	"github.com/frantjc/port-forward/internal/tr064"
+	"github.com/frantjc/port-forward/internal/ubus"
+	"github.com/frantjc/port-forward/internal/unifi"
 	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/frantjc/port-forward/internal/vyos"
 	xerrors "github.com/frantjc/x/errors"
 	xos "github.com/frantjc/x/os"
 	"github.com/go-logr/logr"
+	"github.com/google/nftables"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
@@ -46,6 +81,28 @@ func main() {
 	xos.ExitFromError(err)
 }
 
+const (
+	backendUPnP     = "upnp"
+	backendNATPMP   = "natpmp"
+	backendPCP      = "pcp"
+	backendOPNsense = "opnsense"
+	backendPFSense  = "pfsense"
+	backendRouterOS = "routeros"
+	backendOpenWrt  = "openwrt"
+	backendUniFi    = "unifi"
+	backendTR064    = "tr064"
+	backendVyOS     = "vyos"
+	backendSSH      = "ssh"
+	backendNFTables = "nftables"
+	backendIPTables = "iptables"
+)
+
+const (
+	masqBackendIPTables = "iptables"
+	masqBackendNFTables = "nftables"
+	masqBackendAuto     = "auto"
+)
+
 // NewEntrypoint returns the command which acts as
 // the entrypoint for `portfwd`.
 func NewEntrypoint() *cobra.Command {
@@ -56,7 +113,75 @@ func NewEntrypoint() *cobra.Command {
 		enableLeaderElection bool
 		slogConfig           = new(logutil.SlogConfig)
 		overrideIPAddressS   string
-		cmd                  = &cobra.Command{
+		ipAddressPolicyS     string
+		owner                string
+		gcInterval           time.Duration
+		gcDryRun             bool
+		backend              string
+		masqBackend          string
+		natpmpGatewayS       string
+		natpmpTimeout        time.Duration
+		pcpServerS           string
+		pcpTimeout           time.Duration
+
+		upnpGatewayUDN          string
+		upnpGatewayFriendlyName string
+		upnpGatewayLocation     string
+		upnpGatewayIPS          string
+		upnpLocationS           string
+		upnpInterface           string
+
+		opnsenseURLS                  string
+		opnsenseCredentials           string
+		opnsenseInterface             string
+		opnsenseInsecureSkipTLSVerify bool
+
+		pfsenseURLS                  string
+		pfsenseCredentials           string
+		pfsenseInterface             string
+		pfsenseInsecureSkipTLSVerify bool
+
+		routerosURLS                  string
+		routerosCredentials           string
+		routerosInInterfaceList       string
+		routerosInsecureSkipTLSVerify bool
+
+		openwrtURLS                  string
+		openwrtCredentials           string
+		openwrtSourceZone            string
+		openwrtDestinationZone       string
+		openwrtInsecureSkipTLSVerify bool
+
+		unifiURLS                  string
+		unifiCredentials           string
+		unifiSite                  string
+		unifiInterface             string
+		unifiInsecureSkipTLSVerify bool
+
+		tr064LocationS             string
+		tr064Credentials           string
+		tr064InsecureSkipTLSVerify bool
+
+		vyosURLS                  string
+		vyosCredentials           string
+		vyosInboundInterface      string
+		vyosRuleRange             string
+		vyosSave                  bool
+		vyosInsecureSkipTLSVerify bool
+
+		sshAddress        string
+		sshUser           string
+		sshCredentials    string
+		sshAddTemplate    string
+		sshDeleteTemplate string
+		sshListTemplate   string
+		sshListRegexp     string
+
+		nftablesTable       string
+		nftablesInInterface string
+
+		iptablesInInterface string
+		cmd                 = &cobra.Command{
 			Use:           "portfwd",
 			Version:       SemVer(),
 			SilenceErrors: true,
@@ -133,21 +258,6 @@ func NewEntrypoint() *cobra.Command {
 					return err
 				}
 
-				upnpClient, err := upnp.NewClient(ctx, upnp.WithAnyConnection)
-				if err != nil {
-					return err
-				}
-
-				family := iptables.ProtocolIPv4
-				if upnpClient.GetSourceIPAddress(ctx).To4() == nil {
-					family = iptables.ProtocolIPv6
-				}
-
-				ipt, err := iptables.New(iptables.IPFamily(family))
-				if err != nil {
-					return err
-				}
-
 				var svcIPAddrGtr svcip.ServiceIPAddressGetter = new(svcipdef.ServiceIPAddressGetter)
 				if overrideIPAddressS != "" {
 					if overrideIPAddress := net.ParseIP(overrideIPAddressS); overrideIPAddress == nil {
@@ -157,18 +267,396 @@ func NewEntrypoint() *cobra.Command {
 					}
 				}
 
-				if err := (&controller.ServiceReconciler{
-					ServiceIPAddressGetter: svcIPAddrGtr,
-					PortForwarder: &portfwdupnp.PortForwarder{
+				ipAddressPolicy, err := controller.ParseIPAddressPolicy(ipAddressPolicyS)
+				if err != nil {
+					return err
+				}
+
+				var portForwarder portfwd.PortForwarder
+				switch backend {
+				case backendUPnP:
+					gatewayMatcher := &upnp.GatewayMatcher{
+						UDN:          upnpGatewayUDN,
+						FriendlyName: upnpGatewayFriendlyName,
+						Location:     upnpGatewayLocation,
+					}
+					if upnpGatewayIPS != "" {
+						if gatewayMatcher.IP = net.ParseIP(upnpGatewayIPS); gatewayMatcher.IP == nil {
+							return fmt.Errorf("parse UPnP gateway IP address: %s", upnpGatewayIPS)
+						}
+					}
+
+					upnpOpts := []upnp.NewClientOpt{upnp.WithAnyConnection, upnp.WithGatewayMatcher(gatewayMatcher), upnp.WithOwner(owner)}
+					if upnpLocationS != "" {
+						upnpLocation, err := url.Parse(upnpLocationS)
+						if err != nil {
+							return err
+						}
+
+						upnpOpts = append(upnpOpts, upnp.WithLocation(upnpLocation))
+					}
+					if upnpInterface != "" {
+						iface, err := net.InterfaceByName(upnpInterface)
+						if err != nil {
+							return err
+						}
+
+						upnpOpts = append(upnpOpts, upnp.WithInterface(iface))
+					}
+
+					// The gateway is discovered in the background so that portfwd can
+					// start before the router is reachable and find it again if it
+					// reboots. portfwd is not ready until it has.
+					upnpClient := upnp.NewLazyClient(upnpOpts...)
+
+					if err := mgr.Add(manager.RunnableFunc(upnpClient.RunDiscovery)); err != nil {
+						return err
+					}
+
+					if err := mgr.AddReadyzCheck("upnp", upnpClient.Ready); err != nil {
+						return err
+					}
+
+					sourceIPAddressMasqer, err := newSourceIPAddressMasqer(masqBackend)
+					if err != nil {
+						return err
+					}
+
+					portForwarder = &portfwdupnp.PortForwarder{
+						Client:                upnpClient,
+						SourceIPAddressMasqer: sourceIPAddressMasqer,
+					}
+				case backendNATPMP:
+					gateway := net.ParseIP(natpmpGatewayS)
+					if natpmpGatewayS == "" {
+						if gateway, err = netutil.GetDefaultGateway(); err != nil {
+							return err
+						}
+					} else if gateway == nil {
+						return fmt.Errorf("parse NAT-PMP gateway IP address: %s", natpmpGatewayS)
+					}
+
+					natpmpClient := &natpmp.Client{
+						Gateway: &net.UDPAddr{IP: gateway, Port: natpmp.Port},
+						Timeout: natpmpTimeout,
+					}
+
+					sourceIPAddressMasqer, err := newSourceIPAddressMasqer(masqBackend)
+					if err != nil {
+						return err
+					}
+
+					portForwarder = &portfwdnatpmp.PortForwarder{
+						Client:                natpmpClient,
+						SourceIPAddressMasqer: sourceIPAddressMasqer,
+					}
+				case backendPCP:
+					server := net.ParseIP(pcpServerS)
+					if pcpServerS == "" {
+						if server, err = netutil.GetDefaultGateway(); err != nil {
+							return err
+						}
+					} else if server == nil {
+						return fmt.Errorf("parse PCP server IP address: %s", pcpServerS)
+					}
+
+					portForwarder = &portfwdpcp.PortForwarder{
+						Client: &pcp.Client{
+							Server:  &net.UDPAddr{IP: server, Port: pcp.Port},
+							Timeout: pcpTimeout,
+						},
+					}
+				case backendOPNsense:
+					opnsenseURL, err := url.Parse(opnsenseURLS)
+					if err != nil {
+						return err
+					}
+
+					credentials, err := secretref.GetValues(ctx, mgr.GetAPIReader(), opnsenseCredentials, "key", "secret")
+					if err != nil {
+						return err
+					}
+
+					portForwarder = &portfwdopnsense.PortForwarder{
+						Client: &opnsense.Client{
+							URL:        opnsenseURL,
+							Key:        credentials[0],
+							Secret:     credentials[1],
+							HTTPClient: newHTTPClient(opnsenseInsecureSkipTLSVerify),
+						},
+						Interface: opnsenseInterface,
+						Owner:     owner,
+					}
+				case backendPFSense:
+					pfsenseURL, err := url.Parse(pfsenseURLS)
+					if err != nil {
+						return err
+					}
+
+					credentials, err := secretref.GetValues(ctx, mgr.GetAPIReader(), pfsenseCredentials, "key")
+					if err != nil {
+						return err
+					}
+
+					portForwarder = &portfwdpfsense.PortForwarder{
+						Client: &pfsense.Client{
+							URL:        pfsenseURL,
+							APIKey:     credentials[0],
+							HTTPClient: newHTTPClient(pfsenseInsecureSkipTLSVerify),
+						},
+						Interface: pfsenseInterface,
+						Owner:     owner,
+					}
+				case backendRouterOS:
+					routerosURL, err := url.Parse(routerosURLS)
+					if err != nil {
+						return err
+					}
+
+					credentials, err := secretref.GetValues(ctx, mgr.GetAPIReader(), routerosCredentials, "username", "password")
+					if err != nil {
+						return err
+					}
+
+					portForwarder = &portfwdrouteros.PortForwarder{
+						Client: &routeros.Client{
+							URL:        routerosURL,
+							Username:   credentials[0],
+							Password:   credentials[1],
+							HTTPClient: newHTTPClient(routerosInsecureSkipTLSVerify),
+						},
+						InInterfaceList: routerosInInterfaceList,
+						Owner:           owner,
+					}
+				case backendOpenWrt:
+					openwrtURL, err := url.Parse(openwrtURLS)
+					if err != nil {
+						return err
+					}
+
+					credentials, err := secretref.GetValues(ctx, mgr.GetAPIReader(), openwrtCredentials, "username", "password")
+					if err != nil {
+						return err
+					}
+
+					portForwarder = &portfwdopenwrt.PortForwarder{
+						Client: &ubus.Client{
+							URL:        openwrtURL,
+							Username:   credentials[0],
+							Password:   credentials[1],
+							HTTPClient: newHTTPClient(openwrtInsecureSkipTLSVerify),
+						},
+						SourceZone:      openwrtSourceZone,
+						DestinationZone: openwrtDestinationZone,
+						Owner:           owner,
+					}
+				case backendUniFi:
+					unifiURL, err := url.Parse(unifiURLS)
+					if err != nil {
+						return err
+					}
+
+					credentials, err := secretref.GetValues(ctx, mgr.GetAPIReader(), unifiCredentials, "username", "password")
+					if err != nil {
+						return err
+					}
+
+					unifiPortForwarder := &portfwdunifi.PortForwarder{
+						Client: &unifi.Client{
+							URL:        unifiURL,
+							Username:   credentials[0],
+							Password:   credentials[1],
+							Site:       unifiSite,
+							HTTPClient: newHTTPClient(unifiInsecureSkipTLSVerify),
+						},
+						Interface: unifiInterface,
+						Owner:     owner,
+					}
+
+					if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+						return portfwd.RunLeaseExpirer(ctx, unifiPortForwarder, time.Minute)
+					})); err != nil {
+						return err
+					}
+
+					portForwarder = unifiPortForwarder
+				case backendTR064:
+					tr064Location, err := url.Parse(tr064LocationS)
+					if err != nil {
+						return err
+					}
+
+					credentials, err := secretref.GetValues(ctx, mgr.GetAPIReader(), tr064Credentials, "username", "password")
+					if err != nil {
+						return err
+					}
+
+					tr064Client, err := tr064.NewClient(ctx, tr064Location, credentials[0], credentials[1], newHTTPClient(tr064InsecureSkipTLSVerify))
+					if err != nil {
+						return err
+					}
+
+					upnpClient, err := upnp.NewClient(ctx, upnp.WithGoUPnPClient(tr064Client), upnp.WithOwner(owner))
+					if err != nil {
+						return err
+					}
+
+					portForwarder = &portfwdtr064.PortForwarder{
 						Client: upnpClient,
-						SourceIPAddressMasqer: &srcipmasqiptables.SourceIPAddressMasqer{
-							IPTables: ipt,
+						TR064:  tr064Client,
+					}
+				case backendVyOS:
+					vyosURL, err := url.Parse(vyosURLS)
+					if err != nil {
+						return err
+					}
+
+					var firstRule, lastRule int
+					if _, err := fmt.Sscanf(vyosRuleRange, "%d-%d", &firstRule, &lastRule); err != nil || firstRule < 1 || firstRule > lastRule {
+						return fmt.Errorf("parse VyOS rule range: %s", vyosRuleRange)
+					}
+
+					credentials, err := secretref.GetValues(ctx, mgr.GetAPIReader(), vyosCredentials, "key")
+					if err != nil {
+						return err
+					}
+
+					portForwarder = &portfwdvyos.PortForwarder{
+						Client: &vyos.Client{
+							URL:        vyosURL,
+							Key:        credentials[0],
+							HTTPClient: newHTTPClient(vyosInsecureSkipTLSVerify),
+						},
+						InboundInterface: vyosInboundInterface,
+						FirstRule:        firstRule,
+						LastRule:         lastRule,
+						Save:             vyosSave,
+						Owner:            owner,
+					}
+				case backendSSH:
+					credentials, err := secretref.GetValues(ctx, mgr.GetAPIReader(), sshCredentials, "private-key", "known-hosts")
+					if err != nil {
+						return err
+					}
+
+					signer, err := ssh.ParsePrivateKey([]byte(credentials[0]))
+					if err != nil {
+						return fmt.Errorf("parse SSH private key: %w", err)
+					}
+
+					hostKeyCallback, err := portfwdssh.HostKeyCallback([]byte(credentials[1]))
+					if err != nil {
+						return fmt.Errorf("parse SSH known hosts: %w", err)
+					}
+
+					sshPortForwarder := &portfwdssh.PortForwarder{
+						Address: sshAddress,
+						Config: &ssh.ClientConfig{
+							User:            sshUser,
+							Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+							HostKeyCallback: hostKeyCallback,
+							Timeout:         time.Minute,
 						},
-					},
-				}).SetupWithManager(mgr); err != nil {
+						Owner: owner,
+					}
+
+					if sshPortForwarder.AddTemplate, err = template.New("add").Funcs(portfwdssh.Funcs).Parse(sshAddTemplate); err != nil {
+						return err
+					}
+
+					if sshPortForwarder.DeleteTemplate, err = template.New("delete").Funcs(portfwdssh.Funcs).Parse(sshDeleteTemplate); err != nil {
+						return err
+					}
+
+					if sshListTemplate != "" {
+						if sshPortForwarder.ListTemplate, err = template.New("list").Funcs(portfwdssh.Funcs).Parse(sshListTemplate); err != nil {
+							return err
+						}
+
+						if sshPortForwarder.ListRegexp, err = regexp.Compile(sshListRegexp); err != nil {
+							return err
+						} else if sshPortForwarder.ListRegexp.SubexpIndex(portfwdssh.SubexpComment) < 0 {
+							return fmt.Errorf("--ssh-list-regexp requires a %s group to tell which port mappings are owned", portfwdssh.SubexpComment)
+						}
+					} else if gcInterval > 0 {
+						return fmt.Errorf("backend %s requires --ssh-list-template for garbage collection", backend)
+					}
+
+					portForwarder = sshPortForwarder
+				case backendNFTables:
+					conn, err := nftables.New()
+					if err != nil {
+						return err
+					}
+
+					nftablesPortForwarder := &portfwdnftables.PortForwarder{
+						Conn:        conn,
+						Table:       nftablesTable,
+						InInterface: nftablesInInterface,
+						Owner:       owner,
+					}
+
+					if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+						return portfwd.RunLeaseExpirer(ctx, nftablesPortForwarder, time.Minute)
+					})); err != nil {
+						return err
+					}
+
+					portForwarder = nftablesPortForwarder
+				case backendIPTables:
+					ipv4, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv4))
+					if err != nil {
+						return err
+					}
+
+					iptablesPortForwarder := &portfwdiptables.PortForwarder{
+						IPv4:        ipv4,
+						InInterface: iptablesInInterface,
+						Owner:       owner,
+					}
+
+					if iptablesPortForwarder.IPv6, err = iptables.New(iptables.IPFamily(iptables.ProtocolIPv6)); err != nil {
+						log.Warn("ip6tables unavailable, only port forwarding to IPv4 addresses", "err", err)
+					}
+
+					if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+						return portfwd.RunLeaseExpirer(ctx, iptablesPortForwarder, time.Minute)
+					})); err != nil {
+						return err
+					}
+
+					portForwarder = iptablesPortForwarder
+				default:
+					return fmt.Errorf("unknown backend %s", backend)
+				}
+
+				reconciler := &controller.ServiceReconciler{
+					ServiceIPAddressGetter: svcIPAddrGtr,
+					PortForwarder:          portForwarder,
+					IPAddressPolicy:        ipAddressPolicy,
+				}
+
+				if err := reconciler.SetupWithManager(mgr); err != nil {
 					return err
 				}
 
+				if gcInterval > 0 {
+					listingPortForwarder, ok := portForwarder.(portfwd.ListingPortForwarder)
+					if !ok {
+						return fmt.Errorf("backend %s does not support garbage collection", backend)
+					}
+
+					if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+						return portfwd.RunGarbageCollector(ctx, listingPortForwarder, &portfwd.GarbageCollectorOpts{
+							IsWanted: reconciler.WantedPortMappings,
+							Interval: gcInterval,
+							DryRun:   gcDryRun,
+						})
+					})); err != nil {
+						return err
+					}
+				}
+
 				return mgr.Start(ctx)
 			},
 		}
@@ -189,6 +677,172 @@ func NewEntrypoint() *cobra.Command {
 
 	cmd.Flags().StringVar(&overrideIPAddressS, "override-ip-address", "",
 		"IP address to use instead of getting it from a Service")
+	cmd.Flags().StringVar(&ipAddressPolicyS, "ip-address-policy", string(controller.DefaultIPAddressPolicy),
+		fmt.Sprintf("Which of a Service's IP addresses to port forward to by default, one of: %s or %s<cidr>[,<cidr>...]", strings.Join([]string{string(controller.IPAddressPolicyFirst), string(controller.IPAddressPolicyIPv4), string(controller.IPAddressPolicyIPv6), string(controller.IPAddressPolicyDualStack), string(controller.IPAddressPolicyAll)}, ", "), controller.IPAddressPolicyCIDRPrefix))
+
+	cmd.Flags().StringVar(&backend, "backend", backendUPnP,
+		fmt.Sprintf("How to port forward, one of: %s", strings.Join([]string{backendUPnP, backendNATPMP, backendPCP, backendOPNsense, backendPFSense, backendRouterOS, backendOpenWrt, backendUniFi, backendTR064, backendVyOS, backendSSH, backendNFTables, backendIPTables}, ", ")))
+	cmd.Flags().StringVar(&masqBackend, "masq-backend", masqBackendAuto,
+		fmt.Sprintf("How to masquerade as Services' IP addresses for the upnp and natpmp backends, one of: %s, %s uses %s if it is installed, otherwise %s", strings.Join([]string{masqBackendIPTables, masqBackendNFTables, masqBackendAuto}, ", "), masqBackendAuto, masqBackendIPTables, masqBackendNFTables))
+	cmd.Flags().StringVar(&upnpLocationS, "upnp-location", "",
+		"URL of the UPnP gateway's device description, e.g. http://192.168.1.1:5000/rootDesc.xml, to load instead of discovering gateways via SSDP")
+	cmd.Flags().StringVar(&upnpInterface, "upnp-interface", "",
+		"Network interface to discover UPnP gateways on and talk to them from, defaults to all of them")
+	cmd.Flags().StringVar(&upnpGatewayUDN, "upnp-gateway-udn", "",
+		"UDN of the UPnP gateway to use, e.g. uuid:..., instead of the first one discovered")
+	cmd.Flags().StringVar(&upnpGatewayFriendlyName, "upnp-gateway-friendly-name", "",
+		"Friendly name of the UPnP gateway to use instead of the first one discovered")
+	cmd.Flags().StringVar(&upnpGatewayLocation, "upnp-gateway-location", "",
+		"URL of the device description of the UPnP gateway to use instead of the first one discovered")
+	cmd.Flags().StringVar(&upnpGatewayIPS, "upnp-gateway-ip", "",
+		"LAN IP address of the UPnP gateway to use instead of the first one discovered")
+	cmd.Flags().StringVar(&natpmpGatewayS, "natpmp-gateway", "",
+		"IP address of the NAT-PMP gateway, defaults to the default gateway")
+	cmd.Flags().DurationVar(&natpmpTimeout, "natpmp-timeout", natpmp.DefaultTimeout,
+		"How long to wait for the NAT-PMP gateway to respond to each request, including retransmissions")
+	cmd.Flags().StringVar(&pcpServerS, "pcp-server", "",
+		"IP address of the PCP server, defaults to the default gateway")
+	cmd.Flags().DurationVar(&pcpTimeout, "pcp-timeout", pcp.DefaultTimeout,
+		"How long to wait for the PCP server to respond to each request, including retransmissions")
+	cmd.Flags().StringVar(&opnsenseURLS, "opnsense-url", "",
+		"URL of the OPNsense web UI")
+	cmd.Flags().StringVar(&opnsenseCredentials, "opnsense-credentials", "",
+		"<namespace>/<name> of a Secret with the OPNsense API key and secret in its key and secret keys")
+	cmd.Flags().StringVar(&opnsenseInterface, "opnsense-interface", portfwdopnsense.DefaultInterface,
+		"OPNsense interface to port forward on")
+	cmd.Flags().BoolVar(&opnsenseInsecureSkipTLSVerify, "opnsense-insecure-skip-tls-verify", false,
+		"Skip verifying the OPNsense web UI's TLS certificate")
+	cmd.Flags().StringVar(&pfsenseURLS, "pfsense-url", "",
+		"URL of the pfSense web UI")
+	cmd.Flags().StringVar(&pfsenseCredentials, "pfsense-credentials", "",
+		"<namespace>/<name> of a Secret with the pfSense REST API key in its key key")
+	cmd.Flags().StringVar(&pfsenseInterface, "pfsense-interface", portfwdpfsense.DefaultInterface,
+		"pfSense interface to port forward on")
+	cmd.Flags().BoolVar(&pfsenseInsecureSkipTLSVerify, "pfsense-insecure-skip-tls-verify", false,
+		"Skip verifying the pfSense web UI's TLS certificate")
+	cmd.Flags().StringVar(&routerosURLS, "routeros-url", "",
+		"URL of the RouterOS web server")
+	cmd.Flags().StringVar(&routerosCredentials, "routeros-credentials", "",
+		"<namespace>/<name> of a Secret with the RouterOS username and password in its username and password keys")
+	cmd.Flags().StringVar(&routerosInInterfaceList, "routeros-in-interface-list", portfwdrouteros.DefaultInInterfaceList,
+		"RouterOS interface list to port forward on")
+	cmd.Flags().BoolVar(&routerosInsecureSkipTLSVerify, "routeros-insecure-skip-tls-verify", false,
+		"Skip verifying the RouterOS web server's TLS certificate")
+	cmd.Flags().StringVar(&openwrtURLS, "openwrt-url", "",
+		"URL of the OpenWrt web server")
+	cmd.Flags().StringVar(&openwrtCredentials, "openwrt-credentials", "",
+		"<namespace>/<name> of a Secret with the OpenWrt username and password in its username and password keys")
+	cmd.Flags().StringVar(&openwrtSourceZone, "openwrt-src-zone", portfwdopenwrt.DefaultSourceZone,
+		"OpenWrt firewall zone to port forward from")
+	cmd.Flags().StringVar(&openwrtDestinationZone, "openwrt-dest-zone", portfwdopenwrt.DefaultDestinationZone,
+		"OpenWrt firewall zone to port forward to")
+	cmd.Flags().BoolVar(&openwrtInsecureSkipTLSVerify, "openwrt-insecure-skip-tls-verify", false,
+		"Skip verifying the OpenWrt web server's TLS certificate")
+	cmd.Flags().StringVar(&unifiURLS, "unifi-url", "",
+		"URL of the UniFi controller")
+	cmd.Flags().StringVar(&unifiCredentials, "unifi-credentials", "",
+		"<namespace>/<name> of a Secret with the UniFi username and password in its username and password keys")
+	cmd.Flags().StringVar(&unifiSite, "unifi-site", unifi.DefaultSite,
+		"UniFi site to port forward on")
+	cmd.Flags().StringVar(&unifiInterface, "unifi-interface", "",
+		"UniFi WAN interface to port forward on, e.g. wan2, defaults to the controller's default")
+	cmd.Flags().BoolVar(&unifiInsecureSkipTLSVerify, "unifi-insecure-skip-tls-verify", false,
+		"Skip verifying the UniFi controller's TLS certificate")
+	cmd.Flags().StringVar(&tr064LocationS, "tr064-location", tr064.DefaultLocation,
+		"URL of the FRITZ!Box's TR-064 description")
+	cmd.Flags().StringVar(&tr064Credentials, "tr064-credentials", "",
+		"<namespace>/<name> of a Secret with the FRITZ!Box username and password in its username and password keys")
+	cmd.Flags().BoolVar(&tr064InsecureSkipTLSVerify, "tr064-insecure-skip-tls-verify", false,
+		"Skip verifying the FRITZ!Box's TLS certificate")
+	cmd.Flags().StringVar(&vyosURLS, "vyos-url", "",
+		"URL of the VyOS HTTPS API")
+	cmd.Flags().StringVar(&vyosCredentials, "vyos-credentials", "",
+		"<namespace>/<name> of a Secret with the VyOS HTTPS API key in its key key")
+	cmd.Flags().StringVar(&vyosInboundInterface, "vyos-inbound-interface", portfwdvyos.DefaultInboundInterface,
+		"VyOS interface to port forward on")
+	cmd.Flags().StringVar(&vyosRuleRange, "vyos-rule-range", fmt.Sprintf("%d-%d", portfwdvyos.DefaultFirstRule, portfwdvyos.DefaultLastRule),
+		"<first>-<last> range of VyOS nat destination rule numbers to use")
+	cmd.Flags().BoolVar(&vyosSave, "vyos-save", true,
+		"Save the VyOS config after each change so that rules persist across reboots")
+	cmd.Flags().BoolVar(&vyosInsecureSkipTLSVerify, "vyos-insecure-skip-tls-verify", false,
+		"Skip verifying the VyOS HTTPS API's TLS certificate")
+	cmd.Flags().StringVar(&sshAddress, "ssh-address", "",
+		"<host>:<port> of the router's SSH server")
+	cmd.Flags().StringVar(&sshUser, "ssh-user", "",
+		"User to SSH to the router as")
+	cmd.Flags().StringVar(&sshCredentials, "ssh-credentials", "",
+		"<namespace>/<name> of a Secret with an SSH private key and the router's known_hosts in its private-key and known-hosts keys")
+	cmd.Flags().StringVar(&sshAddTemplate, "ssh-add-template", "",
+		"Go template of the command to run on the router to add a port mapping, whose string fields are already shell-quoted")
+	cmd.Flags().StringVar(&sshDeleteTemplate, "ssh-delete-template", "",
+		"Go template of the command to run on the router to delete a port mapping, must succeed if it does not exist")
+	cmd.Flags().StringVar(&sshListTemplate, "ssh-list-template", "",
+		"Go template of the command to run on the router to list port mappings")
+	cmd.Flags().StringVar(&sshListRegexp, "ssh-list-regexp", "",
+		"Regular expression with named groups externalPort, protocol, comment and optionally remoteHost, internalClient and internalPort to parse each line listed by --ssh-list-template")
+	cmd.Flags().StringVar(&nftablesTable, "nftables-table", portfwdnftables.DefaultTable,
+		"Name of the nftables inet table to port forward in")
+	cmd.Flags().StringVar(&nftablesInInterface, "nftables-in-interface", "",
+		"Interface to port forward on, defaults to all of them")
+	cmd.Flags().StringVar(&iptablesInInterface, "iptables-in-interface", "",
+		"Interface to port forward on, defaults to all of them")
+
+	cmd.Flags().StringVar(&owner, "owner", upnp.DefaultOwner,
+		"Owner to mark port mappings with so that they can be garbage collected, must be unique per router")
+	cmd.Flags().DurationVar(&gcInterval, "gc-interval", 0,
+		"How often to garbage collect orphaned port mappings, 0 to disable")
+	cmd.Flags().BoolVar(&gcDryRun, "gc-dry-run", false,
+		"Log orphaned port mappings instead of deleting them")
 
 	return cmd
 }
+
+// newSourceIPAddressMasqer returns a srcipmasq.SourceIPAddressMasqer for
+// the given backend that can masquerade both IPv4 and IPv6 traffic, if
+// the latter is supported by the Node.
+func newSourceIPAddressMasqer(masqBackend string) (srcipmasq.SourceIPAddressMasqer, error) {
+	switch masqBackend {
+	case masqBackendIPTables:
+		ipv4, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv4))
+		if err != nil {
+			return nil, err
+		}
+
+		// ip6tables is not always installed alongside iptables, in
+		// which case IPv6 traffic cannot be masqueraded.
+		ipv6, _ := iptables.New(iptables.IPFamily(iptables.ProtocolIPv6))
+
+		return &srcipmasqiptables.SourceIPAddressMasqer{IPv4: ipv4, IPv6: ipv6}, nil
+	case masqBackendNFTables:
+		conn, err := nftables.New()
+		if err != nil {
+			return nil, err
+		}
+
+		return &srcipmasqnftables.SourceIPAddressMasqer{Conn: conn}, nil
+	case masqBackendAuto:
+		if sourceIPAddressMasqer, err := newSourceIPAddressMasqer(masqBackendIPTables); err == nil {
+			return sourceIPAddressMasqer, nil
+		}
+
+		return newSourceIPAddressMasqer(masqBackendNFTables)
+	}
+
+	return nil, fmt.Errorf("unknown masq backend %s", masqBackend)
+}
+
+// newHTTPClient returns an *http.Client, optionally
+// one that does not verify TLS certificates.
+func newHTTPClient(insecureSkipTLSVerify bool) *http.Client {
+	if !insecureSkipTLSVerify {
+		return http.DefaultClient
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		// Opted into by the user.
+		InsecureSkipVerify: true,
+	}
+
+	return &http.Client{Transport: transport}
+}
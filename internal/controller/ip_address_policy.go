@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPAddressPolicy chooses which of a Service's IP addresses to port forward to
+// when it has several, as a router keeps only one port mapping per external port.
+type IPAddressPolicy string
+
+const (
+	// IPAddressPolicyFirst chooses the first IP address.
+	IPAddressPolicyFirst = IPAddressPolicy("first")
+	// IPAddressPolicyIPv4 chooses the first IPv4 address.
+	IPAddressPolicyIPv4 = IPAddressPolicy("ipv4")
+	// IPAddressPolicyIPv6 chooses the first IPv6 address.
+	IPAddressPolicyIPv6 = IPAddressPolicy("ipv6")
+	// IPAddressPolicyDualStack chooses the first IP address of each family,
+	// as IPv4 port mappings and IPv6 pinholes do not conflict.
+	IPAddressPolicyDualStack = IPAddressPolicy("dual-stack")
+	// IPAddressPolicyAll chooses every IP address. Each IPv4 address after the
+	// first is port forwarded to from the next external port that none of the
+	// Service's other port mappings nor any other Service's use so that they do
+	// not conflict, e.g. 8080 for the first, 8081 for the second and so on. Each
+	// keeps the external port that it was given for as long as it can, even if
+	// the order of the IP addresses changes. IPv6 pinholes are not NATed, so they
+	// keep their external port and only the first IPv6 address gets them.
+	IPAddressPolicyAll = IPAddressPolicy("all")
+	// IPAddressPolicyCIDRPrefix is followed by a comma-separated list of CIDRs
+	// to make an IPAddressPolicy that chooses the first IP address in any of them.
+	IPAddressPolicyCIDRPrefix = "cidr:"
+	// DefaultIPAddressPolicy is the IPAddressPolicy used if none is given.
+	DefaultIPAddressPolicy = IPAddressPolicyDualStack
+)
+
+// ParseIPAddressPolicy parses the given string as an IPAddressPolicy.
+func ParseIPAddressPolicy(s string) (IPAddressPolicy, error) {
+	policy := IPAddressPolicy(s)
+
+	switch policy {
+	case IPAddressPolicyFirst, IPAddressPolicyIPv4, IPAddressPolicyIPv6, IPAddressPolicyDualStack, IPAddressPolicyAll:
+		return policy, nil
+	}
+
+	if cidrs, ok := strings.CutPrefix(s, IPAddressPolicyCIDRPrefix); ok {
+		if _, err := parseCIDRs(cidrs); err != nil {
+			return "", err
+		}
+
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("invalid IP address policy %s", s)
+}
+
+// selectIPAddresses returns the IP addresses that the IPAddressPolicy chooses
+// and the ones that it skips, each in the order given. The IPAddressPolicy is
+// expected to have been parsed by ParseIPAddressPolicy.
+func (p IPAddressPolicy) selectIPAddresses(ipAddresses []net.IP) ([]net.IP, []net.IP) {
+	var (
+		selected = []net.IP{}
+		skipped  = []net.IP{}
+		cidrs    = []*net.IPNet{}
+		choose   func(net.IP) bool
+	)
+
+	if cidrsS, ok := strings.CutPrefix(string(p), IPAddressPolicyCIDRPrefix); ok {
+		cidrs, _ = parseCIDRs(cidrsS)
+	}
+
+	switch {
+	case p == IPAddressPolicyAll:
+		choose = func(net.IP) bool {
+			return true
+		}
+	case p == IPAddressPolicyIPv4:
+		choose = func(ip net.IP) bool {
+			return len(selected) == 0 && ip.To4() != nil
+		}
+	case p == IPAddressPolicyIPv6:
+		choose = func(ip net.IP) bool {
+			return len(selected) == 0 && ip.To4() == nil
+		}
+	case p == IPAddressPolicyDualStack:
+		choose = func(ip net.IP) bool {
+			for _, s := range selected {
+				if (s.To4() == nil) == (ip.To4() == nil) {
+					return false
+				}
+			}
+
+			return true
+		}
+	case len(cidrs) > 0:
+		choose = func(ip net.IP) bool {
+			if len(selected) > 0 {
+				return false
+			}
+
+			for _, cidr := range cidrs {
+				if cidr.Contains(ip) {
+					return true
+				}
+			}
+
+			return false
+		}
+	default:
+		choose = func(net.IP) bool {
+			return len(selected) == 0
+		}
+	}
+
+	for _, ip := range ipAddresses {
+		if choose(ip) {
+			selected = append(selected, ip)
+		} else {
+			skipped = append(skipped, ip)
+		}
+	}
+
+	return selected, skipped
+}
+
+// parseCIDRs parses the given comma-separated list of CIDRs.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	cidrs := []*net.IPNet{}
+
+	for _, cidrS := range strings.Split(s, ",") {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(cidrS))
+		if err != nil {
+			return nil, err
+		}
+
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
@@ -3,7 +3,12 @@ package controller
 import (
 	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -14,12 +19,15 @@ import (
 	xslices "github.com/frantjc/x/slices"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
@@ -28,6 +36,10 @@ type ServiceReconciler struct {
 	portfwd.PortForwarder
 	client.Client
 	record.EventRecorder
+	// IPAddressPolicy chooses which of a Service's IP addresses to port forward
+	// to unless the Service's AnnotationIPAddressPolicy annotation says otherwise.
+	// Defaults to DefaultIPAddressPolicy.
+	IPAddressPolicy IPAddressPolicy
 }
 
 const (
@@ -36,35 +48,88 @@ const (
 	AnnotationPortMap           = "pf.frantj.cc/port-map"
 	AnnotationEnabled           = "pf.frantj.cc/enabled"
 	AnnotationDescription       = "pf.frantj.cc/description"
+	AnnotationIPAddressPolicy   = "pf.frantj.cc/ip-address-policy"
 	AnnotationUPnPRemoteHost    = "upnp.pf.frantj.cc/remote-host"
 	AnnotationUPnPLeaseDuration = "upnp.pf.frantj.cc/lease-duration"
+	// AnnotationAppliedPortMappings is set by Port Forward to record which port
+	// mappings it last applied so that it can remove them when they are no longer wanted.
+	AnnotationAppliedPortMappings = "pf.frantj.cc/applied-port-mappings"
 )
 
 const (
 	EventReasonAnnotation = "PortForwardAnnotation"
 	EventReasonForward    = "PortForward"
+	// EventReasonFamilyMismatch is the reason of events for port mappings to
+	// IP addresses of a family that the backend cannot port forward to.
+	EventReasonFamilyMismatch = "PortForwardFamilyMismatch"
+	// EventReasonNotAuthorized is the reason of events for port mappings
+	// that the router did not authorize Port Forward to add.
+	EventReasonNotAuthorized = "PortForwardNotAuthorized"
+	// EventReasonConflict is the reason of events for port mappings that
+	// conflict with one that the router has for another internal client.
+	EventReasonConflict = "PortForwardConflict"
+	// EventReasonSamePortValuesRequired is the reason of events for port mappings
+	// whose internal and external ports differ on routers that require them not to.
+	EventReasonSamePortValuesRequired = "PortForwardSamePortValuesRequired"
+	// EventReasonOnlyPermanentLeases is the reason of events for port mappings
+	// that were retried with a permanent lease on routers that only support those.
+	EventReasonOnlyPermanentLeases = "PortForwardOnlyPermanentLeases"
+	// EventReasonNoPortMapsAvailable is the reason of events for port
+	// mappings that the router has no room for.
+	EventReasonNoPortMapsAvailable = "PortForwardNoPortMapsAvailable"
 )
 
-// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;update
 // +kubebuilder:rbac:groups="",resources=services/finalizers,verbs=update
 // +kubebuilder:rbac:groups="",resources=events,verbs=create
 
 func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	var (
-		_              = logr.FromContextOrDiscard(ctx)
-		service        = &corev1.Service{}
-		requeueAfter   = time.Hour
-		portMap        = map[int32]int32{}
-		tmpPortNameMap = map[string]any{}
-		portNameMap    = map[string]int32{}
-		cleanup        = func() (ctrl.Result, error) {
-			// TODO: Delete any forwarded ports. Not of the utmost importance due to
-			// the forced lease duration automatically expiring it at some point in
-			// UPnP, but may become important in future implementations.
+		_       = logr.FromContextOrDiscard(ctx)
+		service = &corev1.Service{}
+		cleanup = func() (ctrl.Result, error) {
+			var (
+				applied, ok = r.getAppliedPortMappings(service, r)
+				deleted     = true
+			)
+
+			// If there is no record of which port mappings were applied, e.g. because
+			// they were applied by a version of Port Forward from before such records
+			// were kept, fall back to deleting what the Service currently wants, but
+			// only if the finalizer says that it was port forwarded to at all. Otherwise,
+			// the router's port mappings on the same ports belong to something else.
+			if !ok {
+				if !controllerutil.ContainsFinalizer(service, Finalizer) {
+					return ctrl.Result{}, nil
+				}
+
+				portMappings, _, _ := r.getPortMappings(service, applied, nil, discardEventRecorder{})
+				for _, pm := range portMappings {
+					applied[pm.key()] = pm
+				}
+			}
 
-			if controllerutil.RemoveFinalizer(service, Finalizer) {
+			for _, pm := range sortedPortMappings(applied) {
+				if err := r.DeletePortMapping(ctx, pm.PortMapping); err != nil {
+					deleted = false
+					r.Eventf(service, corev1.EventTypeWarning, EventReasonForward, "remove %d to %s:%d for port %s failed with: %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName, err.Error())
+				} else {
+					r.Eventf(service, corev1.EventTypeNormal, EventReasonForward, "removed %d to %s:%d for port %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName)
+				}
+			}
+
+			// Keep the finalizer until every port forward is confirmed to be
+			// deleted so that we get another chance to delete any that failed.
+			if !deleted {
+				return ctrl.Result{Requeue: true}, nil
+			}
+
+			_, hasAnnotation := service.Annotations[AnnotationAppliedPortMappings]
+			delete(service.Annotations, AnnotationAppliedPortMappings)
+
+			if controllerutil.RemoveFinalizer(service, Finalizer) || hasAnnotation {
 				if err := r.Update(ctx, service); err != nil {
-					return ctrl.Result{Requeue: !errors.IsNotFound(err)}, nil
+					return ctrl.Result{Requeue: !apierrors.IsNotFound(err)}, nil
 				}
 			}
 
@@ -73,18 +138,338 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	)
 
 	if err := r.Get(ctx, req.NamespacedName, service); err != nil {
-		return ctrl.Result{Requeue: !errors.IsNotFound(err)}, nil
+		return ctrl.Result{Requeue: !apierrors.IsNotFound(err)}, nil
 	}
 
 	if !service.GetDeletionTimestamp().IsZero() {
 		return cleanup()
 	}
 
+	// The Service may have been let through only because it has the finalizer,
+	// in which case it no longer wants to be port forwarded to.
+	if !isTruthy(service.Annotations[AnnotationForward]) {
+		return cleanup()
+	}
+
 	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
 		r.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "cannot port forward to Service of type %s", service.Spec.Type)
 		return cleanup()
 	}
 
+	otherExternalPorts, err := r.getOtherServicesExternalPorts(ctx, service)
+	if err != nil {
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	applied, _ := r.getAppliedPortMappings(service, r)
+
+	portMappings, requeueAfter, ok := r.getPortMappings(service, applied, otherExternalPorts, r)
+	if !ok {
+		return ctrl.Result{}, nil
+	}
+
+	var (
+		// wanted is keyed the same way as the router keys its port mappings, so
+		// if multiple port mappings share a key, the last one wins, same as it
+		// does on the router. IPv4 and IPv6 port mappings are kept apart, as the
+		// latter are pinholes rather than NAT.
+		wanted = map[portMappingKey]portMapping{}
+		// nowApplied is what will be recorded as applied after this reconcile.
+		nowApplied = map[portMappingKey]portMapping{}
+		// notAuthorized is the port mapping that the router did not authorize Port
+		// Forward to add, if any, after which it backs off from adding the rest.
+		notAuthorized *portMapping
+		skipped       = 0
+	)
+
+	for _, pm := range portMappings {
+		wanted[pm.key()] = pm
+	}
+
+	for _, pm := range sortedPortMappings(applied) {
+		key := pm.key()
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+
+		if err := r.DeletePortMapping(ctx, pm.PortMapping); err != nil {
+			nowApplied[key] = pm
+			r.Eventf(service, corev1.EventTypeWarning, EventReasonForward, "remove %d to %s:%d for port %s failed with: %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName, err.Error())
+		} else {
+			r.Eventf(service, corev1.EventTypeNormal, EventReasonForward, "removed %d to %s:%d for port %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName)
+		}
+	}
+
+	for _, pm := range sortedPortMappings(wanted) {
+		var (
+			key  = pm.key()
+			verb = "added"
+		)
+
+		if notAuthorized != nil {
+			// Still remember any that were applied before so
+			// that they are removed once they are not wanted.
+			if old, ok := applied[key]; ok {
+				nowApplied[key] = old
+			}
+			skipped++
+			continue
+		}
+		if old, ok := applied[key]; ok {
+			// The router may have come to support leases since, e.g. after an
+			// upgrade, so they are tried again whenever the Service's spec changes.
+			if old.PermanentLease && old.PermanentLeaseGeneration == service.Generation && pm.LeaseDuration > 0 {
+				pm.LeaseDuration = 0
+				pm.PermanentLease = true
+				pm.PermanentLeaseGeneration = old.PermanentLeaseGeneration
+			}
+
+			if isSamePortMapping(old, pm) {
+				verb = "renewed"
+				// Pinholes and PCP mappings are renewed by the ID
+				// and nonce that they were given when added.
+				pm.PinholeID = old.PinholeID
+				pm.Nonce = old.Nonce
+			} else {
+				// The router may refuse to overwrite a port mapping to a different
+				// internal client, so remove the old one first.
+				if err := r.DeletePortMapping(ctx, old.PortMapping); err != nil {
+					nowApplied[key] = old
+					r.Eventf(service, corev1.EventTypeWarning, EventReasonForward, "change %d to %s:%d for port %s to %s:%d for port %s failed with: %s", old.ExternalPort, old.InternalClient, old.InternalPort, old.PortName, pm.InternalClient, pm.InternalPort, pm.PortName, err.Error())
+					continue
+				}
+
+				verb = fmt.Sprintf("changed %d to %s:%d for port %s to", old.ExternalPort, old.InternalClient, old.InternalPort, old.PortName)
+			}
+		}
+
+		err := r.AddPortMapping(ctx, pm.PortMapping)
+		if errors.Is(err, upnp.ErrorCodeOnlyPermanentLeasesSupported) && pm.LeaseDuration > 0 {
+			r.Eventf(service, corev1.EventTypeWarning, EventReasonOnlyPermanentLeases, "router only supports permanent leases, so retrying %d to %s:%d for port %s with one", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName)
+			pm.LeaseDuration = 0
+			pm.PermanentLease = true
+			pm.PermanentLeaseGeneration = service.Generation
+			err = r.AddPortMapping(ctx, pm.PortMapping)
+		}
+
+		switch {
+		case errors.Is(err, portfwd.ErrFamilyMismatch):
+			r.Eventf(service, corev1.EventTypeWarning, EventReasonFamilyMismatch, "skip %d to %s:%d for port %s: %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName, err.Error())
+		case errors.Is(err, upnp.ErrorCodeActionNotAuthorized):
+			notAuthorized = &pm
+			r.Eventf(service, corev1.EventTypeWarning, EventReasonNotAuthorized, "router did not authorize %d to %s:%d for port %s: %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName, err.Error())
+		case errors.Is(err, upnp.ErrorCodeConflictInMappingEntry):
+			r.Eventf(service, corev1.EventTypeWarning, EventReasonConflict, "%d to %s:%d for port %s conflicts with a port mapping on the router to another internal client: %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName, err.Error())
+		case errors.Is(err, upnp.ErrorCodeSamePortValuesRequired):
+			r.Eventf(service, corev1.EventTypeWarning, EventReasonSamePortValuesRequired, "router requires external port %d to be the same as internal port %d for port %s, which can be done with the %s annotation: %s", pm.ExternalPort, pm.InternalPort, pm.PortName, AnnotationPortMap, err.Error())
+		case errors.Is(err, upnp.ErrorCodeNoPortMapsAvailable):
+			r.Eventf(service, corev1.EventTypeWarning, EventReasonNoPortMapsAvailable, "router has no room for %d to %s:%d for port %s: %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName, err.Error())
+		case err != nil:
+			r.Eventf(service, corev1.EventTypeWarning, EventReasonForward, "%d to %s:%d for port %s failed with: %s", pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName, err.Error())
+		default:
+			nowApplied[key] = pm
+			var (
+				eventType = corev1.EventTypeNormal
+				message   = fmt.Sprintf("%s %d to %s:%d for port %s", verb, pm.ExternalPort, pm.InternalClient, pm.InternalPort, pm.PortName)
+			)
+			if pm.AssignedExternalPort > 0 {
+				eventType = corev1.EventTypeWarning
+				message += fmt.Sprintf(", but router assigned external port %d instead", pm.AssignedExternalPort)
+			}
+			if pm.AssignedExternalIPAddress != nil {
+				message += fmt.Sprintf(" on external IP address %s", pm.AssignedExternalIPAddress)
+			}
+			r.Event(service, eventType, EventReasonForward, message)
+
+			// The router may have granted a shorter lease than requested,
+			// in which case it needs to be renewed sooner.
+			if pm.LeaseDuration > 0 && pm.LeaseDuration/2 < requeueAfter {
+				requeueAfter = pm.LeaseDuration / 2
+			}
+		}
+	}
+
+	// Each attempt that the router does not authorize is likely to be refused
+	// too, so rather than hammer it, the rest wait for the next reconcile.
+	if notAuthorized != nil && skipped > 0 {
+		r.Eventf(service, corev1.EventTypeWarning, EventReasonNotAuthorized, "backing off from %d other port mappings after router did not authorize %d to %s:%d for port %s", skipped, notAuthorized.ExternalPort, notAuthorized.InternalClient, notAuthorized.InternalPort, notAuthorized.PortName)
+	}
+
+	updated := controllerutil.AddFinalizer(service, Finalizer)
+
+	if r.setAppliedPortMappings(service, nowApplied) {
+		updated = true
+	}
+
+	if updated {
+		if err := r.Update(ctx, service); err != nil {
+			return ctrl.Result{Requeue: !apierrors.IsNotFound(err)}, nil
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// portMapping is a PortMapping along with the
+// name of the Service port that it is for.
+type portMapping struct {
+	*upnp.PortMapping
+	PortName string `json:"portName"`
+	// PermanentLease records that the router only supports permanent
+	// leases, so that renewals do not ask for a lease that it refuses
+	// until the Service's spec changes from PermanentLeaseGeneration.
+	// Such port mappings never expire on the router, so if they are not
+	// deleted by Port Forward, only garbage collection removes them.
+	PermanentLease           bool  `json:"permanentLease,omitempty"`
+	PermanentLeaseGeneration int64 `json:"permanentLeaseGeneration,omitempty"`
+	// WantedExternalPort records the external port that the port wanted if
+	// IPAddressPolicyAll gave the port mapping another one, so that it is
+	// given the same one again for as long as the port wants the same one.
+	WantedExternalPort int32 `json:"wantedExternalPort,omitempty"`
+}
+
+// portMappingKey tells apart the port mappings of a Service. It is a
+// upnp.PortMappingKey that also tells apart IPv4 and IPv6 port mappings.
+type portMappingKey struct {
+	upnp.PortMappingKey
+	IPv6 bool
+}
+
+// key returns the portMappingKey of the portMapping.
+func (pm portMapping) key() portMappingKey {
+	return portMappingKey{
+		PortMappingKey: pm.Key(),
+		IPv6:           pm.InternalClient != nil && pm.InternalClient.To4() == nil,
+	}
+}
+
+// isSamePortMapping reports whether two port mappings with the
+// same key forward to the same place in the same way.
+func isSamePortMapping(a, b portMapping) bool {
+	return a.InternalClient.Equal(b.InternalClient) &&
+		a.InternalPort == b.InternalPort &&
+		a.Enabled == b.Enabled &&
+		a.Description == b.Description &&
+		a.PortName == b.PortName
+}
+
+// sortedPortMappings returns the values of the given map in a stable order.
+func sortedPortMappings(portMappings map[portMappingKey]portMapping) []portMapping {
+	sorted := slices.AppendSeq(make([]portMapping, 0, len(portMappings)), maps.Values(portMappings))
+
+	slices.SortFunc(sorted, func(a, b portMapping) int {
+		return cmp.Or(
+			cmp.Compare(a.Protocol, b.Protocol),
+			cmp.Compare(a.ExternalPort, b.ExternalPort),
+			cmp.Compare(a.RemoteHost, b.RemoteHost),
+			compareBool(a.key().IPv6, b.key().IPv6),
+		)
+	})
+
+	return sorted
+}
+
+// compareBool compares booleans such that false comes before true.
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+
+	return -1
+}
+
+// getAppliedPortMappings returns the port mappings that were last applied for the
+// given Service as recorded on it by setAppliedPortMappings. It reports whether or
+// not there was such a record.
+func (r *ServiceReconciler) getAppliedPortMappings(service *corev1.Service, eventRecorder record.EventRecorder) (map[portMappingKey]portMapping, bool) {
+	var (
+		applied      = map[portMappingKey]portMapping{}
+		appliedS, ok = service.Annotations[AnnotationAppliedPortMappings]
+	)
+	if !ok {
+		return applied, false
+	}
+
+	portMappings := []portMapping{}
+
+	if err := json.Unmarshal([]byte(appliedS), &portMappings); err != nil {
+		eventRecorder.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "ignoring invalid %s annotation: %s", AnnotationAppliedPortMappings, err.Error())
+		return applied, false
+	}
+
+	for _, pm := range portMappings {
+		if pm.PortMapping != nil {
+			applied[pm.key()] = pm
+		}
+	}
+
+	return applied, true
+}
+
+// setAppliedPortMappings records the given port mappings as applied for the
+// given Service. It reports whether or not the Service was changed.
+func (r *ServiceReconciler) setAppliedPortMappings(service *corev1.Service, applied map[portMappingKey]portMapping) bool {
+	appliedB, err := json.Marshal(sortedPortMappings(applied))
+	if err != nil {
+		return false
+	}
+
+	if service.Annotations[AnnotationAppliedPortMappings] == string(appliedB) {
+		return false
+	}
+
+	if service.Annotations == nil {
+		service.Annotations = map[string]string{}
+	}
+	service.Annotations[AnnotationAppliedPortMappings] = string(appliedB)
+
+	return true
+}
+
+// getOtherServicesExternalPorts returns the keys of the IPv4 port mappings recorded
+// as applied for every Service but the given one, whose external ports IPAddressPolicyAll
+// must not give to the given Service's IP addresses.
+func (r *ServiceReconciler) getOtherServicesExternalPorts(ctx context.Context, service *corev1.Service) (map[upnp.PortMappingKey]bool, error) {
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services); err != nil {
+		return nil, err
+	}
+
+	externalPorts := map[upnp.PortMappingKey]bool{}
+	for _, other := range services.Items {
+		if other.Namespace == service.Namespace && other.Name == service.Name {
+			continue
+		}
+
+		applied, _ := r.getAppliedPortMappings(&other, discardEventRecorder{})
+		for key := range applied {
+			if !key.IPv6 {
+				externalPorts[key.PortMappingKey] = true
+			}
+		}
+	}
+
+	return externalPorts, nil
+}
+
+// getPortMappings returns the port mappings that the given Service wants as well as
+// how long to wait before renewing them. The given port mappings that were applied
+// for the Service and the keys of other Services' port mappings decide which external
+// ports IPAddressPolicyAll gives to each IP address. If the Service's annotations are
+// invalid such that it is unclear what it wants, it reports false. Problems with the
+// Service's annotations are recorded as events using the given EventRecorder.
+func (r *ServiceReconciler) getPortMappings(service *corev1.Service, applied map[portMappingKey]portMapping, otherExternalPorts map[upnp.PortMappingKey]bool, eventRecorder record.EventRecorder) ([]portMapping, time.Duration, bool) {
+	var (
+		requeueAfter   = time.Hour
+		portMap        = map[int32]int32{}
+		tmpPortNameMap = map[string]any{}
+		portNameMap    = map[string]int32{}
+		portMappings   = []portMapping{}
+	)
+
 	for _, port := range service.Spec.Ports {
 		tmpPortNameMap[port.Name] = struct{}{}
 	}
@@ -96,8 +481,8 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 				lenPortsSplit = len(portsSplit)
 			)
 			if lenPortsSplit != 2 {
-				r.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "invalid entry %s in %s annotation", ports, AnnotationPortMap)
-				return ctrl.Result{}, nil
+				eventRecorder.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "invalid entry %s in %s annotation", ports, AnnotationPortMap)
+				return nil, 0, false
 			}
 
 			external, _ := strconv.Atoi(portsSplit[0])
@@ -107,7 +492,7 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 				if _, ok := tmpPortNameMap[portsSplit[1]]; ok {
 					portNameMap[portsSplit[1]] = int32(external)
 				} else {
-					r.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "invalid entry %s in %s annotation", ports, AnnotationPortMap)
+					eventRecorder.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "invalid entry %s in %s annotation", ports, AnnotationPortMap)
 				}
 			} else {
 				portMap[int32(internal)] = int32(external)
@@ -124,27 +509,76 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		leaseDuration, err = time.ParseDuration(leaseDurationS)
 		if err != nil {
 			leaseDuration = defaultLeaseDuration
-			r.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "using default lease duration %s due to invalid duration %s in %s annotation", leaseDuration, leaseDurationS, AnnotationUPnPLeaseDuration)
+			eventRecorder.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "using default lease duration %s due to invalid duration %s in %s annotation", leaseDuration, leaseDurationS, AnnotationUPnPLeaseDuration)
 		} else {
 			requeueAfter = leaseDuration / 2
 		}
 	}
 
-	if ipAddresses := r.GetServiceIPAddresses(service); len(ipAddresses) > 0 {
+	ipAddressPolicy := cmp.Or(r.IPAddressPolicy, DefaultIPAddressPolicy)
+	if ipAddressPolicyS, ok := service.Annotations[AnnotationIPAddressPolicy]; ok {
+		if policy, err := ParseIPAddressPolicy(ipAddressPolicyS); err != nil {
+			eventRecorder.Eventf(service, corev1.EventTypeWarning, EventReasonAnnotation, "using default IP address policy %s due to invalid policy %s in %s annotation", ipAddressPolicy, ipAddressPolicyS, AnnotationIPAddressPolicy)
+		} else {
+			ipAddressPolicy = policy
+		}
+	}
+
+	ipAddresses, skippedIPAddresses := ipAddressPolicy.selectIPAddresses(r.GetServiceIPAddresses(service))
+	if len(ipAddresses) == 0 && len(skippedIPAddresses) > 0 {
+		eventRecorder.Eventf(service, corev1.EventTypeWarning, EventReasonForward, "skipped every IP address %v due to IP address policy %s", skippedIPAddresses, ipAddressPolicy)
+	} else if len(skippedIPAddresses) > 0 {
+		eventRecorder.Eventf(service, corev1.EventTypeNormal, EventReasonForward, "chose IP addresses %v and skipped %v due to IP address policy %s", ipAddresses, skippedIPAddresses, ipAddressPolicy)
+	}
+
+	if len(ipAddresses) > 0 {
+		var (
+			remoteHost     = service.Annotations[AnnotationUPnPRemoteHost]
+			externalPortOf = func(port corev1.ServicePort) int32 {
+				if externalPort, ok := portMap[port.Port]; ok {
+					return externalPort
+				} else if externalPort, ok := portNameMap[port.Name]; ok {
+					return externalPort
+				}
+
+				return port.Port
+			}
+			// reserved are the external ports that the Service's ports want for
+			// themselves, which IPAddressPolicyAll must not give to other IP addresses.
+			reserved = map[upnp.PortMappingKey]bool{}
+			taken    = map[portMappingKey]bool{}
+			// kept are the external ports that IPAddressPolicyAll gave to each
+			// port, IPv4 address and wanted external port before, and keptBy is
+			// the reverse, so that each keeps its external port regardless of the
+			// order of the IP addresses, unless something else has since taken it.
+			kept    = map[string]int32{}
+			keptBy  = map[upnp.PortMappingKey]string{}
+			ownerOf = func(portName string, ip net.IP, wantedExternalPort int32) string {
+				return fmt.Sprintf("%s %s %d", portName, ip, wantedExternalPort)
+			}
+		)
 		for _, port := range service.Spec.Ports {
-			portName := cmp.Or(port.Name, fmt.Sprint(port.Port))
+			reserved[upnp.PortMappingKey{RemoteHost: remoteHost, ExternalPort: externalPortOf(port), Protocol: upnp.Protocol(port.Protocol)}] = true
+		}
 
-			externalPort, ok := portMap[port.Port]
-			if !ok {
-				if anotherExternalPort, ok := portNameMap[port.Name]; ok {
-					externalPort = anotherExternalPort
-				} else {
-					externalPort = port.Port
+		if ipAddressPolicy == IPAddressPolicyAll {
+			for key, pm := range applied {
+				if !key.IPv6 {
+					owner := ownerOf(pm.PortName, pm.InternalClient, cmp.Or(pm.WantedExternalPort, pm.ExternalPort))
+					kept[owner] = pm.ExternalPort
+					keptBy[key.PortMappingKey] = owner
 				}
 			}
+		}
+
+		for _, port := range service.Spec.Ports {
+			var (
+				portName     = cmp.Or(port.Name, fmt.Sprint(port.Port))
+				externalPort = externalPortOf(port)
+			)
 
 			if externalPort <= 0 {
-				r.Eventf(service, corev1.EventTypeNormal, EventReasonForward, "skip port %s due to %s annotation mapping it to %d", portName, AnnotationPortMap, externalPort)
+				eventRecorder.Eventf(service, corev1.EventTypeNormal, EventReasonForward, "skip port %s due to %s annotation mapping it to %d", portName, AnnotationPortMap, externalPort)
 				continue
 			}
 
@@ -156,34 +590,118 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 				)
 			}
 
-			enabled, ok := service.Annotations[AnnotationEnabled]
-
+			var (
+				enabled, hasEnabled = service.Annotations[AnnotationEnabled]
+				firstIPv4           = true
+			)
 			for _, ip := range ipAddresses {
-				if err := r.AddPortMapping(ctx, &upnp.PortMapping{
-					RemoteHost:     service.Annotations[AnnotationUPnPRemoteHost],
-					ExternalPort:   externalPort,
-					Protocol:       upnp.Protocol(port.Protocol),
-					InternalPort:   port.Port,
-					InternalClient: ip,
-					Enabled:        !ok || isTruthy(enabled),
-					Description:    description,
-					LeaseDuration:  leaseDuration,
-				}); err != nil {
-					r.Eventf(service, corev1.EventTypeWarning, EventReasonForward, "%d to %s:%d for port %s failed with: %s", externalPort, ip, port.Port, portName, err.Error())
-				} else {
-					r.Eventf(service, corev1.EventTypeNormal, EventReasonForward, "%d to %s:%d for port %s", externalPort, ip, port.Port, portName)
+				pm := portMapping{
+					PortMapping: &upnp.PortMapping{
+						RemoteHost:     remoteHost,
+						ExternalPort:   externalPort,
+						Protocol:       upnp.Protocol(port.Protocol),
+						InternalPort:   port.Port,
+						InternalClient: ip,
+						Enabled:        !hasEnabled || isTruthy(enabled),
+						Description:    description,
+						Service:        fmt.Sprintf("%s/%s:%s", service.Namespace, service.Name, portName),
+						LeaseDuration:  leaseDuration,
+					},
+					PortName: portName,
 				}
+
+				// Each IPv4 address after the first needs its own external port. IPv6
+				// pinholes are not NATed, so they keep the port that they are opened on.
+				if ipAddressPolicy == IPAddressPolicyAll && ip.To4() != nil {
+					var (
+						owner = ownerOf(portName, ip, externalPort)
+						free  = func(key upnp.PortMappingKey) bool {
+							keptByOwner, isKept := keptBy[key]
+							return (key.ExternalPort == externalPort || !reserved[key]) &&
+								!taken[portMappingKey{PortMappingKey: key}] &&
+								!otherExternalPorts[key] &&
+								(!isKept || keptByOwner == owner)
+						}
+						keptKey = pm.Key()
+					)
+					keptKey.ExternalPort = kept[owner]
+
+					if _, ok := kept[owner]; ok && free(keptKey) {
+						pm.ExternalPort = keptKey.ExternalPort
+					} else if keptByOwner, isKept := keptBy[pm.Key()]; !firstIPv4 || (isKept && keptByOwner != owner) {
+						for !free(pm.Key()) {
+							pm.ExternalPort++
+						}
+					}
+
+					if pm.ExternalPort != externalPort {
+						pm.WantedExternalPort = externalPort
+					}
+
+					firstIPv4 = false
+				}
+
+				if pm.ExternalPort > 65535 {
+					eventRecorder.Eventf(service, corev1.EventTypeWarning, EventReasonForward, "skip port %s to IP address %s due to IP address policy %s running out of external ports", portName, ip, ipAddressPolicy)
+					continue
+				} else if taken[pm.key()] {
+					eventRecorder.Eventf(service, corev1.EventTypeWarning, EventReasonForward, "skip port %s to IP address %s as external port %s is already port forwarded to another of the Service's ports or IP addresses", portName, ip, pm.Key())
+					continue
+				}
+
+				taken[pm.key()] = true
+				portMappings = append(portMappings, pm)
 			}
 		}
 	}
 
-	if controllerutil.AddFinalizer(service, Finalizer) {
-		if err := r.Update(ctx, service); err != nil {
-			return ctrl.Result{Requeue: !errors.IsNotFound(err)}, nil
+	return portMappings, requeueAfter, true
+}
+
+// WantedPortMappings returns a function that reports whether or not any Service
+// wants the given port mapping, either because it is recorded as applied or because
+// it is yet to be. It is meant to be used to garbage collect orphaned port mappings.
+func (r *ServiceReconciler) WantedPortMappings(ctx context.Context) (func(*portfwd.PortMapping) bool, error) {
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services); err != nil {
+		return nil, err
+	}
+
+	wanted := map[upnp.PortMappingKey]bool{}
+	for _, service := range services.Items {
+		applied, _ := r.getAppliedPortMappings(&service, discardEventRecorder{})
+		for key := range applied {
+			wanted[key.PortMappingKey] = true
+		}
+
+		if service.GetDeletionTimestamp().IsZero() && service.Spec.Type == corev1.ServiceTypeLoadBalancer && isTruthy(service.Annotations[AnnotationForward]) {
+			if portMappings, _, ok := r.getPortMappings(&service, applied, nil, discardEventRecorder{}); ok {
+				for _, pm := range portMappings {
+					wanted[pm.Key()] = true
+				}
+			}
 		}
 	}
 
-	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	return func(pm *portfwd.PortMapping) bool {
+		return wanted[pm.Key()]
+	}, nil
+}
+
+// discardEventRecorder is a record.EventRecorder
+// that does not record anything.
+type discardEventRecorder struct{}
+
+var _ record.EventRecorder = discardEventRecorder{}
+
+// Event implements record.EventRecorder.
+func (discardEventRecorder) Event(runtime.Object, string, string, string) {}
+
+// Eventf implements record.EventRecorder.
+func (discardEventRecorder) Eventf(runtime.Object, string, string, string, ...any) {}
+
+// AnnotatedEventf implements record.EventRecorder.
+func (discardEventRecorder) AnnotatedEventf(runtime.Object, map[string]string, string, string, string, ...any) {
 }
 
 func isTruthy(s string) bool {
@@ -192,6 +710,40 @@ func isTruthy(s string) bool {
 	})
 }
 
+// isOwnUpdate reports whether the only changes from the old to the new Service
+// are what Reconcile records on it, i.e. its applied port mappings and finalizer.
+// Such updates are not reconciled, as that would renew every port mapping again
+// right after they were renewed.
+func isOwnUpdate(oldObj, newObj client.Object) bool {
+	oldService, ok := oldObj.(*corev1.Service)
+	if !ok {
+		return false
+	}
+
+	newService, ok := newObj.(*corev1.Service)
+	if !ok {
+		return false
+	}
+
+	oldService, newService = oldService.DeepCopy(), newService.DeepCopy()
+	for _, service := range []*corev1.Service{oldService, newService} {
+		delete(service.Annotations, AnnotationAppliedPortMappings)
+		if len(service.Annotations) == 0 {
+			service.Annotations = nil
+		}
+
+		controllerutil.RemoveFinalizer(service, Finalizer)
+		if len(service.Finalizers) == 0 {
+			service.Finalizers = nil
+		}
+
+		service.ResourceVersion = ""
+		service.ManagedFields = nil
+	}
+
+	return equality.Semantic.DeepEqual(oldService, newService)
+}
+
 func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.Client = mgr.GetClient()
 	r.EventRecorder = mgr.GetEventRecorderFor("portfwd")
@@ -199,13 +751,20 @@ func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(
 			&corev1.Service{},
-			builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
-				// Only reconcile if this Service has the port forward annotation or
-				// finalizer. If it has the annotation, we need to port forward to it.
-				// If it has the finalizer, then we may need to port forward to it
-				// again or we may need to remove the finalizer.
-				return isTruthy(obj.GetAnnotations()[AnnotationForward]) || controllerutil.ContainsFinalizer(obj, Finalizer)
-			})),
+			builder.WithPredicates(
+				predicate.NewPredicateFuncs(func(obj client.Object) bool {
+					// Only reconcile if this Service has the port forward annotation or
+					// finalizer. If it has the annotation, we need to port forward to it.
+					// If it has the finalizer, then we may need to port forward to it
+					// again or we may need to remove the finalizer.
+					return isTruthy(obj.GetAnnotations()[AnnotationForward]) || controllerutil.ContainsFinalizer(obj, Finalizer)
+				}),
+				predicate.Funcs{
+					UpdateFunc: func(e event.UpdateEvent) bool {
+						return !isOwnUpdate(e.ObjectOld, e.ObjectNew)
+					},
+				},
+			),
 		).
 		Complete(r)
 }
@@ -0,0 +1,888 @@
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/controller"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/srcipmasq"
+	"github.com/frantjc/port-forward/internal/svcip/svcipraw"
+	"github.com/frantjc/port-forward/internal/upnp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+type testPortForwarder struct {
+	mu           sync.Mutex
+	portMappings map[upnp.PortMappingKey]portfwd.PortMapping
+	// deleteErr is returned by DeletePortMapping, if set.
+	deleteErr error
+}
+
+func (p *testPortForwarder) AddPortMapping(_ context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.portMappings[pm.Key()] = *pm
+	return nil
+}
+
+func (p *testPortForwarder) DeletePortMapping(_ context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.deleteErr != nil {
+		return p.deleteErr
+	}
+	delete(p.portMappings, pm.Key())
+	return nil
+}
+
+func (p *testPortForwarder) externalPorts() map[int32]int32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	externalPorts := map[int32]int32{}
+	for key, pm := range p.portMappings {
+		externalPorts[key.ExternalPort] = pm.InternalPort
+	}
+	return externalPorts
+}
+
+func newTestServiceReconciler(t *testing.T, objs ...client.Object) (*controller.ServiceReconciler, *testPortForwarder) {
+	t.Helper()
+
+	portForwarder := &testPortForwarder{portMappings: map[upnp.PortMappingKey]portfwd.PortMapping{}}
+
+	return &controller.ServiceReconciler{
+		ServiceIPAddressGetter: svcipraw.ServiceIPAddressGetter{net.ParseIP("192.168.0.11")},
+		PortForwarder:          portForwarder,
+		Client:                 fake.NewClientBuilder().WithObjects(objs...).Build(),
+		EventRecorder:          record.NewFakeRecorder(100),
+	}, portForwarder
+}
+
+func reconcile(t *testing.T, r *controller.ServiceReconciler, key types.NamespacedName) *corev1.Service {
+	t.Helper()
+
+	if _, err := r.Reconcile(t.Context(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	service := &corev1.Service{}
+	if err := r.Get(t.Context(), key, service); err != nil {
+		t.Fatalf("get Service: %v", err)
+	}
+
+	return service
+}
+
+func expectExternalPorts(t *testing.T, portForwarder *testPortForwarder, expected map[int32]int32) {
+	t.Helper()
+
+	actual := portForwarder.externalPorts()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected port mappings %v, got %v", expected, actual)
+	}
+
+	for externalPort, internalPort := range expected {
+		if actual[externalPort] != internalPort {
+			t.Fatalf("expected port mappings %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestServiceReconcilerReconcile(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward: "yes",
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+					{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		r, portForwarder = newTestServiceReconciler(t, service)
+	)
+
+	service = reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{80: 80, 443: 443})
+
+	if !controllerutil.ContainsFinalizer(service, controller.Finalizer) {
+		t.Fatalf("expected finalizer %s", controller.Finalizer)
+	}
+
+	// Remapping a port and excluding another should remove their old port mappings.
+	service.Annotations[controller.AnnotationPortMap] = "8080:http,0:443"
+	if err := r.Update(t.Context(), service); err != nil {
+		t.Fatalf("update Service: %v", err)
+	}
+
+	service = reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{8080: 80})
+
+	// Opting out should remove every port mapping and the finalizer.
+	service.Annotations[controller.AnnotationForward] = "no"
+	if err := r.Update(t.Context(), service); err != nil {
+		t.Fatalf("update Service: %v", err)
+	}
+
+	service = reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{})
+
+	if controllerutil.ContainsFinalizer(service, controller.Finalizer) {
+		t.Fatalf("expected no finalizer %s", controller.Finalizer)
+	}
+
+	if _, ok := service.Annotations[controller.AnnotationAppliedPortMappings]; ok {
+		t.Fatalf("expected no annotation %s", controller.AnnotationAppliedPortMappings)
+	}
+}
+
+func TestServiceReconcilerReconcileDiff(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward: "yes",
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+					{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+					{Name: "metrics", Port: 9090, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		r, portForwarder = newTestServiceReconciler(t, service)
+		eventRecorder    = record.NewFakeRecorder(100)
+	)
+	r.EventRecorder = eventRecorder
+
+	service = reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{80: 80, 443: 443, 9090: 9090})
+
+	// Dropping a port, moving another to a different external port and
+	// pointing an external port at a different port should each be applied.
+	service.Spec.Ports = service.Spec.Ports[:2]
+	service.Annotations[controller.AnnotationPortMap] = "8080:http,80:https"
+	if err := r.Update(t.Context(), service); err != nil {
+		t.Fatalf("update Service: %v", err)
+	}
+
+	reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{80: 443, 8080: 80})
+
+	verbs := map[string]int{}
+	for len(eventRecorder.Events) > 0 {
+		event := <-eventRecorder.Events
+		for _, verb := range []string{"added", "changed", "removed"} {
+			if strings.Contains(event, " "+verb+" ") {
+				verbs[verb]++
+			}
+		}
+	}
+
+	for verb, expected := range map[string]int{"added": 4, "changed": 1, "removed": 2} {
+		if verbs[verb] != expected {
+			t.Fatalf("expected %d %s events, got %d", expected, verb, verbs[verb])
+		}
+	}
+}
+
+func TestServiceReconcilerReconcileDelete(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward: "yes",
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+					{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		r, portForwarder = newTestServiceReconciler(t, service)
+	)
+
+	service = reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{80: 80, 443: 443})
+
+	// The finalizer keeps the Service around until its port mappings are removed.
+	if err := r.Delete(t.Context(), service); err != nil {
+		t.Fatalf("delete Service: %v", err)
+	}
+
+	// The finalizer should stay while port mappings fail to be removed.
+	portForwarder.deleteErr = errors.New("router unreachable")
+
+	service = reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{80: 80, 443: 443})
+
+	if !controllerutil.ContainsFinalizer(service, controller.Finalizer) {
+		t.Fatalf("expected finalizer %s", controller.Finalizer)
+	}
+
+	// Once they are removed, so should the finalizer be, letting the Service go.
+	portForwarder.deleteErr = nil
+
+	if _, err := r.Reconcile(t.Context(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	expectExternalPorts(t, portForwarder, map[int32]int32{})
+
+	if err := r.Get(t.Context(), key, &corev1.Service{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected Service to be gone, got %v", err)
+	}
+}
+
+func TestServiceReconcilerReconcileNeverForwarded(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward: "yes",
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeClusterIP,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		// The override IP address makes the Service seem to want
+		// port 80 even though it was never port forwarded to.
+		r, portForwarder = newTestServiceReconciler(t, service)
+	)
+
+	// Someone else's port mapping on the same port.
+	portForwarder.portMappings[upnp.PortMappingKey{ExternalPort: 80, Protocol: upnp.ProtocolTCP}] = portfwd.PortMapping{
+		ExternalPort:   80,
+		Protocol:       upnp.ProtocolTCP,
+		InternalPort:   8080,
+		InternalClient: net.ParseIP("192.168.0.99"),
+		Enabled:        true,
+	}
+
+	res, err := r.Reconcile(t.Context(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	if res.Requeue {
+		t.Fatal("expected no requeue")
+	}
+
+	expectExternalPorts(t, portForwarder, map[int32]int32{80: 8080})
+}
+
+type testPinholePortForwarder struct {
+	nextPinholeID uint16
+	nextNonce     byte
+	added         []portfwd.PortMapping
+	deleted       []portfwd.PortMapping
+}
+
+func (p *testPinholePortForwarder) AddPortMapping(_ context.Context, pm *portfwd.PortMapping) error {
+	if pm.InternalClient.To4() == nil && pm.PinholeID == nil {
+		p.nextPinholeID++
+		pinholeID := p.nextPinholeID
+		pm.PinholeID = &pinholeID
+	}
+	if pm.Nonce == nil {
+		p.nextNonce++
+		pm.Nonce = []byte{p.nextNonce}
+	}
+	p.added = append(p.added, *pm)
+	return nil
+}
+
+func (p *testPinholePortForwarder) DeletePortMapping(_ context.Context, pm *portfwd.PortMapping) error {
+	p.deleted = append(p.deleted, *pm)
+	return nil
+}
+
+func TestServiceReconcilerReconcileDualStack(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward: "yes",
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		portForwarder = &testPinholePortForwarder{}
+		r             = &controller.ServiceReconciler{
+			ServiceIPAddressGetter: svcipraw.ServiceIPAddressGetter{net.ParseIP("192.168.0.11"), net.ParseIP("2001:db8::11")},
+			PortForwarder:          portForwarder,
+			Client:                 fake.NewClientBuilder().WithObjects(service).Build(),
+			EventRecorder:          record.NewFakeRecorder(100),
+		}
+	)
+
+	// IPv4 and IPv6 port mappings with the same key should both be added.
+	reconcile(t, r, key)
+
+	if len(portForwarder.added) != 2 {
+		t.Fatalf("expected 2 port mappings to be added, got %d", len(portForwarder.added))
+	}
+
+	// The pinhole should be renewed by the ID that it was given.
+	reconcile(t, r, key)
+
+	if len(portForwarder.added) != 4 {
+		t.Fatalf("expected 2 port mappings to be renewed, got %d", len(portForwarder.added)-2)
+	}
+
+	for i, pm := range portForwarder.added[2:] {
+		if pm.InternalClient.To4() == nil && (pm.PinholeID == nil || *pm.PinholeID != 1) {
+			t.Fatalf("expected pinhole to be renewed by ID 1, got %v", pm.PinholeID)
+		}
+
+		if nonce := portForwarder.added[i].Nonce; !bytes.Equal(pm.Nonce, nonce) {
+			t.Fatalf("expected port mapping to be renewed by nonce %v, got %v", nonce, pm.Nonce)
+		}
+	}
+
+	// Opting out should delete the pinhole by its ID.
+	if err := r.Get(t.Context(), key, service); err != nil {
+		t.Fatalf("get Service: %v", err)
+	}
+
+	service.Annotations[controller.AnnotationForward] = "no"
+	if err := r.Update(t.Context(), service); err != nil {
+		t.Fatalf("update Service: %v", err)
+	}
+
+	reconcile(t, r, key)
+
+	if len(portForwarder.deleted) != 2 {
+		t.Fatalf("expected 2 port mappings to be deleted, got %d", len(portForwarder.deleted))
+	}
+
+	for _, pm := range portForwarder.deleted {
+		if pm.InternalClient.To4() == nil && (pm.PinholeID == nil || *pm.PinholeID != 1) {
+			t.Fatalf("expected pinhole to be deleted by ID 1, got %v", pm.PinholeID)
+		}
+	}
+}
+
+type testIPv4OnlyPortForwarder struct {
+	testPortForwarder
+}
+
+func (p *testIPv4OnlyPortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if _, err := (&srcipmasq.Masq{
+		OriginalSource: net.ParseIP("192.168.0.2"),
+		Destination:    net.ParseIP("192.168.0.1"),
+		NewSource:      pm.InternalClient,
+	}).IPv6(); err != nil {
+		return err
+	}
+
+	return p.testPortForwarder.AddPortMapping(ctx, pm)
+}
+
+func TestServiceReconcilerReconcileFamilyMismatch(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward: "yes",
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		portForwarder = &testIPv4OnlyPortForwarder{testPortForwarder{portMappings: map[upnp.PortMappingKey]portfwd.PortMapping{}}}
+		eventRecorder = record.NewFakeRecorder(100)
+		r             = &controller.ServiceReconciler{
+			ServiceIPAddressGetter: svcipraw.ServiceIPAddressGetter{net.ParseIP("192.168.0.11"), net.ParseIP("2001:db8::11")},
+			PortForwarder:          portForwarder,
+			Client:                 fake.NewClientBuilder().WithObjects(service).Build(),
+			EventRecorder:          eventRecorder,
+		}
+	)
+
+	reconcile(t, r, key)
+	expectExternalPorts(t, &portForwarder.testPortForwarder, map[int32]int32{80: 80})
+
+	mismatches := 0
+	for len(eventRecorder.Events) > 0 {
+		if event := <-eventRecorder.Events; strings.Contains(event, controller.EventReasonFamilyMismatch) {
+			mismatches++
+		}
+	}
+
+	if mismatches != 1 {
+		t.Fatalf("expected 1 %s event, got %d", controller.EventReasonFamilyMismatch, mismatches)
+	}
+}
+
+func TestServiceReconcilerReconcileIPAddressPolicy(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward:         "yes",
+					controller.AnnotationIPAddressPolicy: string(controller.IPAddressPolicyAll),
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		r, portForwarder = newTestServiceReconciler(t, service)
+	)
+	r.ServiceIPAddressGetter = svcipraw.ServiceIPAddressGetter{net.ParseIP("192.168.0.11"), net.ParseIP("192.168.0.12"), net.ParseIP("2001:db8::11")}
+
+	// Every IPv4 address should get its own external port, while the IPv6
+	// pinhole keeps the Service's, which the fake keys the same as IPv4's.
+	service = reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{80: 80, 81: 80})
+
+	// Only the IP address in the CIDR should be port forwarded to.
+	service.Annotations[controller.AnnotationIPAddressPolicy] = controller.IPAddressPolicyCIDRPrefix + "10.0.0.0/8,192.168.0.12/32"
+	if err := r.Update(t.Context(), service); err != nil {
+		t.Fatalf("update Service: %v", err)
+	}
+
+	reconcile(t, r, key)
+	expectExternalPorts(t, portForwarder, map[int32]int32{80: 80})
+
+	if internalClient := portForwarder.portMappings[upnp.PortMappingKey{ExternalPort: 80, Protocol: upnp.ProtocolTCP}].InternalClient; !internalClient.Equal(net.ParseIP("192.168.0.12")) {
+		t.Fatalf("expected port mapping to 192.168.0.12, got %s", internalClient)
+	}
+}
+
+// testDualStackPortForwarder is a testPortForwarder
+// that keeps IPv4 and IPv6 port mappings apart.
+type testDualStackPortForwarder struct {
+	testPortForwarder
+	ipv6 testPortForwarder
+}
+
+func (p *testDualStackPortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if pm.InternalClient.To4() == nil {
+		return p.ipv6.AddPortMapping(ctx, pm)
+	}
+
+	return p.testPortForwarder.AddPortMapping(ctx, pm)
+}
+
+func (p *testDualStackPortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if pm.InternalClient.To4() == nil {
+		return p.ipv6.DeletePortMapping(ctx, pm)
+	}
+
+	return p.testPortForwarder.DeletePortMapping(ctx, pm)
+}
+
+func TestServiceReconcilerReconcileIPAddressPolicyAll(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward:         "yes",
+					controller.AnnotationIPAddressPolicy: string(controller.IPAddressPolicyAll),
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+					{Name: "http-alt", Port: 81, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		portForwarder = &testDualStackPortForwarder{
+			testPortForwarder: testPortForwarder{portMappings: map[upnp.PortMappingKey]portfwd.PortMapping{}},
+			ipv6:              testPortForwarder{portMappings: map[upnp.PortMappingKey]portfwd.PortMapping{}},
+		}
+		eventRecorder = record.NewFakeRecorder(100)
+		r             = &controller.ServiceReconciler{
+			ServiceIPAddressGetter: svcipraw.ServiceIPAddressGetter{
+				net.ParseIP("192.168.0.11"), net.ParseIP("2001:db8::11"),
+				net.ParseIP("192.168.0.12"), net.ParseIP("2001:db8::12"),
+			},
+			PortForwarder: portForwarder,
+			Client:        fake.NewClientBuilder().WithObjects(service).Build(),
+			EventRecorder: eventRecorder,
+		}
+	)
+
+	reconcile(t, r, key)
+
+	// The second IPv4 address must not take the external port of the Service's other port.
+	expectExternalPorts(t, &portForwarder.testPortForwarder, map[int32]int32{80: 80, 81: 81, 82: 80, 83: 81})
+
+	for externalPort, internalClient := range map[int32]string{80: "192.168.0.11", 81: "192.168.0.11", 82: "192.168.0.12", 83: "192.168.0.12"} {
+		if actual := portForwarder.portMappings[upnp.PortMappingKey{ExternalPort: externalPort, Protocol: upnp.ProtocolTCP}].InternalClient; !actual.Equal(net.ParseIP(internalClient)) {
+			t.Fatalf("expected external port %d to be port forwarded to %s, got %s", externalPort, internalClient, actual)
+		}
+	}
+
+	// IPv6 pinholes are not NATed, so they keep the Service's ports.
+	expectExternalPorts(t, &portForwarder.ipv6, map[int32]int32{80: 80, 81: 81})
+
+	for _, externalPort := range []int32{80, 81} {
+		if actual := portForwarder.ipv6.portMappings[upnp.PortMappingKey{ExternalPort: externalPort, Protocol: upnp.ProtocolTCP}].InternalClient; !actual.Equal(net.ParseIP("2001:db8::11")) {
+			t.Fatalf("expected pinhole on port %d to 2001:db8::11, got %s", externalPort, actual)
+		}
+	}
+
+	skipped := 0
+	for len(eventRecorder.Events) > 0 {
+		if event := <-eventRecorder.Events; strings.HasPrefix(event, corev1.EventTypeWarning) && strings.Contains(event, "2001:db8::12") {
+			skipped++
+		}
+	}
+
+	if skipped != 2 {
+		t.Fatalf("expected a warning for each port skipped for the second IPv6 address, got %d", skipped)
+	}
+}
+
+func TestServiceReconcilerReconcileIPAddressPolicyAllKeepsExternalPorts(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward:         "yes",
+					controller.AnnotationIPAddressPolicy: string(controller.IPAddressPolicyAll),
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		// Another Service's port mapping has external port 81.
+		other = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      "other",
+				Annotations: map[string]string{
+					controller.AnnotationAppliedPortMappings: `[{"externalPort":81,"protocol":"TCP","internalPort":81,"internalClient":"192.168.0.99","enabled":true,"portName":"http"}]`,
+				},
+			},
+		}
+		r, portForwarder = newTestServiceReconciler(t, service, other)
+	)
+
+	for _, tc := range []struct {
+		name        string
+		ipAddresses []string
+		expected    map[int32]string
+	}{
+		{
+			name:        "skips the other Service's external port",
+			ipAddresses: []string{"192.168.0.11", "192.168.0.12"},
+			expected:    map[int32]string{80: "192.168.0.11", 82: "192.168.0.12"},
+		},
+		{
+			name:        "keeps external ports when the IP addresses are reordered",
+			ipAddresses: []string{"192.168.0.12", "192.168.0.11"},
+			expected:    map[int32]string{80: "192.168.0.11", 82: "192.168.0.12"},
+		},
+		{
+			name:        "gives a new first IP address an external port that is not kept",
+			ipAddresses: []string{"192.168.0.13", "192.168.0.12", "192.168.0.11"},
+			expected:    map[int32]string{80: "192.168.0.11", 82: "192.168.0.12", 83: "192.168.0.13"},
+		},
+	} {
+		ipAddresses := svcipraw.ServiceIPAddressGetter{}
+		for _, ipAddress := range tc.ipAddresses {
+			ipAddresses = append(ipAddresses, net.ParseIP(ipAddress))
+		}
+		r.ServiceIPAddressGetter = ipAddresses
+
+		reconcile(t, r, key)
+
+		portForwarder.mu.Lock()
+		actual := map[int32]string{}
+		for key, pm := range portForwarder.portMappings {
+			actual[key.ExternalPort] = pm.InternalClient.String()
+		}
+		portForwarder.mu.Unlock()
+
+		if !maps.Equal(actual, tc.expected) {
+			t.Fatalf("%s: expected external ports to be port forwarded to %v, got %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestIsOwnUpdate(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "sample",
+			ResourceVersion: "1",
+			Annotations: map[string]string{
+				controller.AnnotationForward: "yes",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	for name, tc := range map[string]struct {
+		update func(*corev1.Service)
+		own    bool
+	}{
+		"recording applied port mappings": {
+			update: func(service *corev1.Service) {
+				service.Annotations[controller.AnnotationAppliedPortMappings] = "[]"
+				service.Finalizers = append(service.Finalizers, controller.Finalizer)
+			},
+			own: true,
+		},
+		"opting out": {
+			update: func(service *corev1.Service) {
+				service.Annotations[controller.AnnotationForward] = "no"
+			},
+		},
+		"changing ports": {
+			update: func(service *corev1.Service) {
+				service.Spec.Ports[0].Port = 8080
+			},
+		},
+		"assigning an IP address": {
+			update: func(service *corev1.Service) {
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.0.11"}}
+			},
+		},
+		"deleting": {
+			update: func(service *corev1.Service) {
+				service.DeletionTimestamp = &metav1.Time{}
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			updated := service.DeepCopy()
+			tc.update(updated)
+			updated.ResourceVersion = "2"
+
+			if own := controller.IsOwnUpdate(service, updated); own != tc.own {
+				t.Fatalf("expected own update to be %t, got %t", tc.own, own)
+			}
+		})
+	}
+}
+
+func TestParseIPAddressPolicy(t *testing.T) {
+	for s, valid := range map[string]bool{
+		"first":                    true,
+		"ipv4":                     true,
+		"ipv6":                     true,
+		"dual-stack":               true,
+		"all":                      true,
+		"cidr:10.0.0.0/8":          true,
+		"cidr:10.0.0.0/8,fd00::/8": true,
+		"cidr:":                    false,
+		"cidr:10.0.0.1":            false,
+		"last":                     false,
+	} {
+		if _, err := controller.ParseIPAddressPolicy(s); (err == nil) != valid {
+			t.Fatalf("expected %q to be valid: %t, got error %v", s, valid, err)
+		}
+	}
+}
+
+type testUPnPErrorPortForwarder struct {
+	testPortForwarder
+	errs     map[int32]error
+	attempts map[int32]int
+}
+
+func (p *testUPnPErrorPortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.attempts[pm.ExternalPort]++
+
+	if err, ok := p.errs[pm.ExternalPort]; ok {
+		// Routers that only support permanent leases accept them.
+		if !errors.Is(err, upnp.ErrorCodeOnlyPermanentLeasesSupported) || pm.LeaseDuration > 0 {
+			return err
+		}
+	}
+
+	return p.testPortForwarder.AddPortMapping(ctx, pm)
+}
+
+func TestServiceReconcilerReconcileUPnPErrors(t *testing.T) {
+	var (
+		key     = types.NamespacedName{Namespace: "default", Name: "sample"}
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Annotations: map[string]string{
+					controller.AnnotationForward: "yes",
+				},
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+					{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+					{Name: "admin", Port: 8080, Protocol: corev1.ProtocolTCP},
+					{Name: "metrics", Port: 9090, Protocol: corev1.ProtocolTCP},
+				},
+			},
+		}
+		portForwarder = &testUPnPErrorPortForwarder{
+			testPortForwarder: testPortForwarder{portMappings: map[upnp.PortMappingKey]portfwd.PortMapping{}},
+			errs: map[int32]error{
+				80:   fmt.Errorf("%w: SOAP fault", upnp.ErrorCodeOnlyPermanentLeasesSupported),
+				443:  fmt.Errorf("%w: SOAP fault", upnp.ErrorCodeConflictInMappingEntry),
+				8080: fmt.Errorf("%w: SOAP fault", upnp.ErrorCodeActionNotAuthorized),
+			},
+			attempts: map[int32]int{},
+		}
+		eventRecorder = record.NewFakeRecorder(100)
+		r             = &controller.ServiceReconciler{
+			ServiceIPAddressGetter: svcipraw.ServiceIPAddressGetter{net.ParseIP("192.168.0.11")},
+			PortForwarder:          portForwarder,
+			Client:                 fake.NewClientBuilder().WithObjects(service).Build(),
+			EventRecorder:          eventRecorder,
+		}
+	)
+
+	reconcile(t, r, key)
+
+	// The port mapping refused for its lease should be retried with a permanent one.
+	expectExternalPorts(t, &portForwarder.testPortForwarder, map[int32]int32{80: 80})
+
+	if attempts := portForwarder.attempts[80]; attempts != 2 {
+		t.Fatalf("expected 2 attempts at 80, got %d", attempts)
+	}
+
+	// The rest should not be attempted after the router does not authorize one.
+	if attempts := portForwarder.attempts[9090]; attempts != 0 {
+		t.Fatalf("expected no attempts at 9090, got %d", attempts)
+	}
+
+	reasons := map[string]int{}
+	for len(eventRecorder.Events) > 0 {
+		event := <-eventRecorder.Events
+		for _, reason := range []string{
+			controller.EventReasonOnlyPermanentLeases,
+			controller.EventReasonConflict,
+			controller.EventReasonNotAuthorized,
+		} {
+			if strings.Contains(event, " "+reason+" ") {
+				reasons[reason]++
+			}
+		}
+	}
+
+	for reason, expected := range map[string]int{
+		controller.EventReasonOnlyPermanentLeases: 1,
+		controller.EventReasonConflict:            1,
+		controller.EventReasonNotAuthorized:       2,
+	} {
+		if reasons[reason] != expected {
+			t.Fatalf("expected %d %s events, got %d", expected, reason, reasons[reason])
+		}
+	}
+
+	reconcile(t, r, key)
+
+	// The renewal should go straight to a permanent lease, as the router only supports those.
+	if attempts := portForwarder.attempts[80]; attempts != 3 {
+		t.Fatalf("expected 1 more attempt at 80, got %d", attempts-2)
+	}
+
+	for len(eventRecorder.Events) > 0 {
+		if event := <-eventRecorder.Events; strings.Contains(event, " "+controller.EventReasonOnlyPermanentLeases+" ") {
+			t.Fatalf("expected no more %s events, got %q", controller.EventReasonOnlyPermanentLeases, event)
+		}
+	}
+
+	// Once the Service's spec changes, the router gets another chance to grant a lease.
+	if err := r.Get(t.Context(), key, service); err != nil {
+		t.Fatalf("get Service: %v", err)
+	}
+
+	service.Generation++
+	if err := r.Update(t.Context(), service); err != nil {
+		t.Fatalf("update Service: %v", err)
+	}
+
+	delete(portForwarder.errs, 80)
+	reconcile(t, r, key)
+
+	if pm := portForwarder.portMappings[upnp.PortMappingKey{ExternalPort: 80, Protocol: upnp.ProtocolTCP}]; pm.LeaseDuration <= 0 {
+		t.Fatal("expected a lease to be tried again after the Service's spec changed")
+	}
+}
@@ -0,0 +1,3 @@
+// package extipnatpmp provides an implementation of extip.ExternalIPAddressGetter
+// that gets the external IP address from NAT-PMP.
+package extipnatpmp
@@ -0,0 +1,8 @@
+package extipnatpmp
+
+import (
+	"github.com/frantjc/port-forward/internal/extip"
+	"github.com/frantjc/port-forward/internal/natpmp"
+)
+
+var _ extip.ExternalIPAddressGetter = &natpmp.Client{}
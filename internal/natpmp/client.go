@@ -0,0 +1,216 @@
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+const (
+	// Port is the port that NAT-PMP servers listen on.
+	Port = 5351
+
+	version = 0
+
+	opcodeExternalAddress = 0
+	opcodeMapUDP          = 1
+	opcodeMapTCP          = 2
+	opcodeResponse        = 128
+
+	// initialRetransmitInterval and maxRetransmits are as recommended by RFC 6886 3.1.
+	initialRetransmitInterval = 250 * time.Millisecond
+	maxRetransmits            = 9
+)
+
+// ResultCode is the result code of a NAT-PMP response.
+type ResultCode uint16
+
+const (
+	ResultCodeSuccess ResultCode = iota
+	ResultCodeUnsupportedVersion
+	ResultCodeNotAuthorized
+	ResultCodeNetworkFailure
+	ResultCodeOutOfResources
+	ResultCodeUnsupportedOpcode
+)
+
+// Error implements error.
+func (c ResultCode) Error() string {
+	switch c {
+	case ResultCodeSuccess:
+		return "success"
+	case ResultCodeUnsupportedVersion:
+		return "unsupported version"
+	case ResultCodeNotAuthorized:
+		return "not authorized/refused"
+	case ResultCodeNetworkFailure:
+		return "network failure"
+	case ResultCodeOutOfResources:
+		return "out of resources"
+	case ResultCodeUnsupportedOpcode:
+		return "unsupported opcode"
+	}
+
+	return fmt.Sprintf("result code %d", uint16(c))
+}
+
+// DefaultTimeout is how long a Client waits for a response to each
+// request, including retransmissions, if it is not given a Timeout.
+const DefaultTimeout = 10 * time.Second
+
+// Client is a NAT-PMP client.
+type Client struct {
+	// Gateway is the address of the NAT-PMP server,
+	// typically the default gateway on Port.
+	Gateway *net.UDPAddr
+	// Timeout is how long to wait for a response to each request,
+	// including retransmissions. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Mapping is a port mapping as reported by the NAT-PMP server.
+type Mapping struct {
+	Protocol     upnp.Protocol
+	InternalPort uint16
+	ExternalPort uint16
+	Lifetime     time.Duration
+}
+
+// GetExternalIPAddress gets the external IP address via NAT-PMP.
+func (c *Client) GetExternalIPAddress(ctx context.Context) (net.IP, error) {
+	res, err := c.do(ctx, []byte{version, opcodeExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.IP(res[8:12]), nil
+}
+
+// Map asks the NAT-PMP server to map the given internal port of the requesting
+// host to the suggested external port for the given lifetime. A lifetime of 0
+// deletes the mapping. The NAT-PMP server may assign a different external port
+// and lifetime than requested.
+func (c *Client) Map(ctx context.Context, protocol upnp.Protocol, internalPort, suggestedExternalPort uint16, lifetime time.Duration) (*Mapping, error) {
+	var opcode byte
+	switch protocol {
+	case upnp.ProtocolUDP:
+		opcode = opcodeMapUDP
+	case upnp.ProtocolTCP:
+		opcode = opcodeMapTCP
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", protocol)
+	}
+
+	req := make([]byte, 12)
+	req[0] = version
+	req[1] = opcode
+	binary.BigEndian.PutUint16(req[4:6], internalPort)
+	binary.BigEndian.PutUint16(req[6:8], suggestedExternalPort)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime.Seconds()))
+
+	res, err := c.do(ctx, req, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: binary.BigEndian.Uint16(res[8:10]),
+		ExternalPort: binary.BigEndian.Uint16(res[10:12]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(res[12:16])) * time.Second,
+	}, nil
+}
+
+// GetServiceIPAddress gets the IP address of the NAT-PMP server.
+func (c *Client) GetServiceIPAddress(context.Context) (net.IP, error) {
+	return c.Gateway.IP, nil
+}
+
+// GetSourceIPAddress gets the IP address that the
+// client uses to communicate with the NAT-PMP server.
+func (c *Client) GetSourceIPAddress(context.Context) net.IP {
+	conn, err := net.DialUDP("udp", nil, c.Gateway)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// do sends the request to the NAT-PMP server, retransmitting it as recommended by
+// RFC 6886 until it gets a response to it of at least the given size or times out.
+func (c *Client) do(ctx context.Context, req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, c.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("no response from NAT-PMP server %s within %s", c.Gateway, timeout))
+	defer cancel()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var (
+		res      = make([]byte, 16)
+		interval = initialRetransmitInterval
+	)
+	for range maxRetransmits {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(interval)); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := conn.Read(res)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, context.Cause(ctx)
+				}
+
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+
+				return nil, err
+			}
+
+			// Ignore anything that is not a response to our request.
+			if n < 4 || res[0] != version || res[1] != req[1]+opcodeResponse {
+				continue
+			}
+
+			if resultCode := ResultCode(binary.BigEndian.Uint16(res[2:4])); resultCode != ResultCodeSuccess {
+				return nil, resultCode
+			}
+
+			if n < size {
+				return nil, fmt.Errorf("short response of %d bytes", n)
+			}
+
+			return res[:n], nil
+		}
+
+		interval *= 2
+	}
+
+	return nil, fmt.Errorf("no response from NAT-PMP server %s", c.Gateway)
+}
@@ -0,0 +1,113 @@
+package natpmp_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/natpmp"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// serveNATPMP runs a stub NAT-PMP server which maps every internal port to the
+// external port after it, grants at most an hour, and refuses to map port 22.
+func serveNATPMP(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		req := make([]byte, 12)
+		for {
+			n, addr, err := conn.ReadFromUDP(req)
+			if err != nil {
+				return
+			}
+
+			res := make([]byte, 16)
+			res[1] = req[1] + 128
+			binary.BigEndian.PutUint32(res[4:8], 1)
+
+			switch {
+			case n == 2 && req[1] == 0:
+				copy(res[8:12], net.IPv4(203, 0, 113, 1).To4())
+				res = res[:12]
+			case n == 12 && binary.BigEndian.Uint16(req[4:6]) == 22:
+				binary.BigEndian.PutUint16(res[2:4], uint16(natpmp.ResultCodeNotAuthorized))
+			case n == 12:
+				internalPort := binary.BigEndian.Uint16(req[4:6])
+				lifetime := min(binary.BigEndian.Uint32(req[8:12]), 3600)
+				copy(res[8:10], req[4:6])
+				binary.BigEndian.PutUint16(res[10:12], internalPort+1)
+				binary.BigEndian.PutUint32(res[12:16], lifetime)
+			default:
+				binary.BigEndian.PutUint16(res[2:4], uint16(natpmp.ResultCodeUnsupportedOpcode))
+			}
+
+			if _, err := conn.WriteToUDP(res, addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestClient(t *testing.T) {
+	client := &natpmp.Client{Gateway: serveNATPMP(t)}
+
+	externalIPAddress, err := client.GetExternalIPAddress(t.Context())
+	if err != nil {
+		t.Fatalf("get external IP address: %v", err)
+	}
+
+	if !externalIPAddress.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Fatalf("expected external IP address 203.0.113.1, got %s", externalIPAddress)
+	}
+
+	mapping, err := client.Map(t.Context(), upnp.ProtocolTCP, 80, 80, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("map: %v", err)
+	}
+
+	if mapping.InternalPort != 80 || mapping.ExternalPort != 81 || mapping.Lifetime != time.Hour {
+		t.Fatalf("unexpected mapping %+v", mapping)
+	}
+
+	if _, err := client.Map(t.Context(), upnp.ProtocolTCP, 22, 22, time.Hour); !errors.Is(err, natpmp.ResultCodeNotAuthorized) {
+		t.Fatalf("expected error %v, got %v", natpmp.ResultCodeNotAuthorized, err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	// A server that never responds.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	var (
+		client = &natpmp.Client{Gateway: conn.LocalAddr().(*net.UDPAddr), Timeout: 100 * time.Millisecond}
+		start  = time.Now()
+	)
+
+	if _, err := client.Map(t.Context(), upnp.ProtocolTCP, 80, 80, time.Hour); err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Fatalf("expected no response, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected to give up after the timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,3 @@
+// package natpmp provides a client for the NAT Port Mapping Protocol
+// as specified by RFC 6886.
+package natpmp
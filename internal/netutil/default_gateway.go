@@ -0,0 +1,45 @@
+package netutil
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// GetDefaultGateway gets the IPv4 default gateway from /proc/net/route.
+func GetDefaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip the header.
+	scanner.Scan()
+
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != net.IPv4len {
+			continue
+		}
+
+		// The gateway is in host byte order, which is little endian on any architecture we run on.
+		return net.IPv4(gateway[3], gateway[2], gateway[1], gateway[0]), nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("no default gateway found")
+}
@@ -0,0 +1,3 @@
+// package netutil provides networking utilities
+// that the standard library does not.
+package netutil
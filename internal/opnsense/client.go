@@ -0,0 +1,232 @@
+package opnsense
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	// ControllerDestinationNAT is the API controller for
+	// destination NAT, also known as port forward, rules.
+	ControllerDestinationNAT = "firewall/d_nat"
+	// ControllerFilter is the API controller for filter rules.
+	ControllerFilter = "firewall/filter"
+)
+
+// Rule is a destination NAT or filter rule. Fields that only apply
+// to one kind of rule are omitted when empty.
+type Rule struct {
+	UUID            string `json:"uuid,omitempty"`
+	Enabled         string `json:"enabled"`
+	Action          string `json:"action,omitempty"`
+	Direction       string `json:"direction,omitempty"`
+	Interface       string `json:"interface"`
+	IPProtocol      string `json:"ipprotocol"`
+	Protocol        string `json:"protocol"`
+	SourceNet       string `json:"source_net"`
+	DestinationNet  string `json:"destination_net"`
+	DestinationPort string `json:"destination_port"`
+	Target          string `json:"target,omitempty"`
+	LocalPort       string `json:"local_port,omitempty"`
+	Description     string `json:"description"`
+}
+
+// Client is an OPNsense REST API client.
+type Client struct {
+	// URL is the base URL of the OPNsense web UI, e.g. https://192.168.1.1.
+	URL *url.URL
+	// Key and Secret are the credentials of an OPNsense API key.
+	Key, Secret string
+	// HTTPClient is used to make requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// SearchRules searches the rules of the given controller
+// for ones that contain the given phrase.
+func (c *Client) SearchRules(ctx context.Context, controller, phrase string) ([]Rule, error) {
+	res := &struct {
+		Rows []Rule `json:"rows"`
+	}{}
+
+	if err := c.do(ctx, http.MethodPost, path.Join(controller, "search_rule"), map[string]any{
+		"current":      1,
+		"rowCount":     -1,
+		"searchPhrase": phrase,
+	}, res); err != nil {
+		return nil, err
+	}
+
+	return res.Rows, nil
+}
+
+// GetRule gets the rule with the given UUID from the given controller. Unlike
+// SearchRules, which returns rules' fields as they are displayed, e.g. "WAN" for
+// the interface "wan", it returns them as they are set, so that they can be
+// compared to a wanted rule. Options are returned as their selected keys,
+// joined by commas.
+func (c *Client) GetRule(ctx context.Context, controller, uuid string) (*Rule, error) {
+	res := &struct {
+		Rule map[string]json.RawMessage `json:"rule"`
+	}{}
+
+	if err := c.do(ctx, http.MethodGet, path.Join(controller, "get_rule", uuid), nil, res); err != nil {
+		return nil, err
+	}
+
+	if res.Rule == nil {
+		return nil, fmt.Errorf("rule %s not found", uuid)
+	}
+
+	fields := map[string]string{"uuid": uuid}
+	for name, raw := range res.Rule {
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			fields[name] = value
+			continue
+		}
+
+		options := map[string]struct {
+			Selected any `json:"selected"`
+		}{}
+		if err := json.Unmarshal(raw, &options); err != nil {
+			// Neither a value nor options, so not a field of Rule.
+			continue
+		}
+
+		selected := []string{}
+		for key, option := range options {
+			if option.Selected == true || option.Selected == float64(1) || option.Selected == "1" {
+				selected = append(selected, key)
+			}
+		}
+		slices.Sort(selected)
+		fields[name] = strings.Join(selected, ",")
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &Rule{}
+	return rule, json.Unmarshal(b, rule)
+}
+
+// AddRule adds the given rule to the given controller, returning its UUID.
+func (c *Client) AddRule(ctx context.Context, controller string, rule *Rule) (string, error) {
+	res := &result{}
+
+	if err := c.do(ctx, http.MethodPost, path.Join(controller, "add_rule"), map[string]any{"rule": rule}, res); err != nil {
+		return "", err
+	}
+
+	return res.UUID, res.err("saved")
+}
+
+// SetRule updates the rule with the given UUID in the given controller.
+func (c *Client) SetRule(ctx context.Context, controller, uuid string, rule *Rule) error {
+	res := &result{}
+
+	if err := c.do(ctx, http.MethodPost, path.Join(controller, "set_rule", uuid), map[string]any{"rule": rule}, res); err != nil {
+		return err
+	}
+
+	return res.err("saved")
+}
+
+// DelRule deletes the rule with the given UUID from the given controller.
+func (c *Client) DelRule(ctx context.Context, controller, uuid string) error {
+	res := &result{}
+
+	if err := c.do(ctx, http.MethodPost, path.Join(controller, "del_rule", uuid), nil, res); err != nil {
+		return err
+	}
+
+	// Deleting a rule that does not exist results in "not found".
+	if res.Result == "not found" {
+		return nil
+	}
+
+	return res.err("deleted")
+}
+
+// Reconfigure applies the saved changes to the given controller's rules.
+func (c *Client) Reconfigure(ctx context.Context, controller string) error {
+	res := &struct {
+		Status string `json:"status"`
+	}{}
+
+	if err := c.do(ctx, http.MethodPost, path.Join(controller, "apply"), nil, res); err != nil {
+		return err
+	}
+
+	if res.Status != "ok" {
+		return fmt.Errorf("reconfigure %s: status %s", controller, res.Status)
+	}
+
+	return nil
+}
+
+type result struct {
+	Result      string         `json:"result"`
+	UUID        string         `json:"uuid"`
+	Validations map[string]any `json:"validations"`
+}
+
+func (r *result) err(expected string) error {
+	if r.Result != expected {
+		if len(r.Validations) > 0 {
+			return fmt.Errorf("result %s: %v", r.Result, r.Validations)
+		}
+
+		return fmt.Errorf("result %s", r.Result)
+	}
+
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, endpoint string, in, out any) error {
+	body := &bytes.Buffer{}
+	if in != nil {
+		if err := json.NewEncoder(body).Encode(in); err != nil {
+			return err
+		}
+	} else {
+		// OPNsense requires POST requests to have a JSON body.
+		body.WriteString("{}")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.URL.JoinPath("api", endpoint).String(), body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.Key, c.Secret)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, endpoint, res.Status, bytes.TrimSpace(b))
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,3 @@
+// package opnsense provides a client for the parts of the OPNsense
+// REST API that manage destination NAT (port forward) and filter rules.
+package opnsense
@@ -0,0 +1,348 @@
+package pcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+const (
+	// Port is the port that PCP servers listen on.
+	Port = 5351
+
+	version = 2
+
+	opcodeMap      = 1
+	opcodePeer     = 2
+	opcodeResponse = 0x80
+
+	optionThirdParty = 1
+	optionFilter     = 3
+
+	headerLen      = 24
+	mapPayloadLen  = 36
+	peerPayloadLen = 56
+	maxMessageLen  = 1100
+
+	// initialRetransmitInterval and maxRetransmitInterval are IRT and MRT from RFC 6887
+	// 8.1.1. RFC 6887 leaves the retransmission count unbounded by default, but that
+	// would block forever on an unreachable server, so it is bounded by maxRetransmits
+	// and, usually much sooner, by the Client's Timeout.
+	initialRetransmitInterval = 3 * time.Second
+	maxRetransmitInterval     = 1024 * time.Second
+	maxRetransmits            = 5
+)
+
+// ResultCode is the result code of a PCP response.
+type ResultCode uint8
+
+const (
+	ResultCodeSuccess ResultCode = iota
+	ResultCodeUnsupportedVersion
+	ResultCodeNotAuthorized
+	ResultCodeMalformedRequest
+	ResultCodeUnsupportedOpcode
+	ResultCodeUnsupportedOption
+	ResultCodeMalformedOption
+	ResultCodeNetworkFailure
+	ResultCodeNoResources
+	ResultCodeUnsupportedProtocol
+	ResultCodeUserExceededQuota
+	ResultCodeCannotProvideExternal
+	ResultCodeAddressMismatch
+	ResultCodeExcessiveRemotePeers
+)
+
+// Error implements error.
+func (c ResultCode) Error() string {
+	switch c {
+	case ResultCodeSuccess:
+		return "SUCCESS"
+	case ResultCodeUnsupportedVersion:
+		return "UNSUPP_VERSION"
+	case ResultCodeNotAuthorized:
+		return "NOT_AUTHORIZED"
+	case ResultCodeMalformedRequest:
+		return "MALFORMED_REQUEST"
+	case ResultCodeUnsupportedOpcode:
+		return "UNSUPP_OPCODE"
+	case ResultCodeUnsupportedOption:
+		return "UNSUPP_OPTION"
+	case ResultCodeMalformedOption:
+		return "MALFORMED_OPTION"
+	case ResultCodeNetworkFailure:
+		return "NETWORK_FAILURE"
+	case ResultCodeNoResources:
+		return "NO_RESOURCES"
+	case ResultCodeUnsupportedProtocol:
+		return "UNSUPP_PROTOCOL"
+	case ResultCodeUserExceededQuota:
+		return "USER_EX_QUOTA"
+	case ResultCodeCannotProvideExternal:
+		return "CANNOT_PROVIDE_EXTERNAL"
+	case ResultCodeAddressMismatch:
+		return "ADDRESS_MISMATCH"
+	case ResultCodeExcessiveRemotePeers:
+		return "EXCESSIVE_REMOTE_PEERS"
+	}
+
+	return fmt.Sprintf("result code %d", uint8(c))
+}
+
+// Nonce is a mapping nonce. Refreshing or deleting
+// a mapping requires the nonce that created it.
+type Nonce [12]byte
+
+// MapRequest is a request for a MAP or PEER mapping.
+type MapRequest struct {
+	Nonce                      Nonce
+	Protocol                   upnp.Protocol
+	InternalPort               uint16
+	SuggestedExternalPort      uint16
+	SuggestedExternalIPAddress net.IP
+	// Lifetime is the requested lifetime of the mapping. 0 deletes it.
+	Lifetime time.Duration
+	// ThirdParty, if set, is the internal IP address to request
+	// the mapping for instead of the address of the client.
+	ThirdParty net.IP
+	// RemotePeer, if set, restricts a MAP mapping to the given remote peer
+	// via the FILTER option. For a PEER mapping, it is required.
+	RemotePeer net.IP
+	// RemotePeerPort is the port of RemotePeer. 0 means any.
+	RemotePeerPort uint16
+}
+
+// Mapping is a mapping as reported by the PCP server.
+type Mapping struct {
+	Protocol          upnp.Protocol
+	InternalPort      uint16
+	ExternalPort      uint16
+	ExternalIPAddress net.IP
+	Lifetime          time.Duration
+}
+
+// DefaultTimeout is how long a Client waits for a response to each
+// request, including retransmissions, if it is not given a Timeout.
+const DefaultTimeout = 10 * time.Second
+
+// Client is a PCP client.
+type Client struct {
+	// Server is the address of the PCP server,
+	// typically the default gateway on Port.
+	Server *net.UDPAddr
+	// Timeout is how long to wait for a response to each request,
+	// including retransmissions. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Map sends a MAP request for an inbound mapping.
+func (c *Client) Map(ctx context.Context, req *MapRequest) (*Mapping, error) {
+	return c.mapOrPeer(ctx, opcodeMap, req)
+}
+
+// Peer sends a PEER request to create or refresh
+// the mapping for a connection to a remote peer.
+func (c *Client) Peer(ctx context.Context, req *MapRequest) (*Mapping, error) {
+	if req.RemotePeer == nil {
+		return nil, fmt.Errorf("remote peer is required")
+	}
+
+	return c.mapOrPeer(ctx, opcodePeer, req)
+}
+
+// GetServiceIPAddress gets the IP address of the PCP server.
+func (c *Client) GetServiceIPAddress(context.Context) (net.IP, error) {
+	return c.Server.IP, nil
+}
+
+func (c *Client) mapOrPeer(ctx context.Context, opcode byte, req *MapRequest) (*Mapping, error) {
+	protocol, err := protocolNumber(req.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, c.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	msg := &bytes.Buffer{}
+
+	// Common request header, RFC 6887 7.1.
+	msg.Write([]byte{version, opcode, 0, 0})
+	_ = binary.Write(msg, binary.BigEndian, uint32(req.Lifetime.Seconds()))
+	msg.Write(ipAddress16(conn.LocalAddr().(*net.UDPAddr).IP))
+
+	// MAP and PEER opcode payloads, RFC 6887 11.1 and 12.1.
+	msg.Write(req.Nonce[:])
+	msg.Write([]byte{protocol, 0, 0, 0})
+	_ = binary.Write(msg, binary.BigEndian, req.InternalPort)
+	_ = binary.Write(msg, binary.BigEndian, req.SuggestedExternalPort)
+	msg.Write(suggestedIPAddress16(req.SuggestedExternalIPAddress, c.Server.IP))
+
+	if opcode == opcodePeer {
+		_ = binary.Write(msg, binary.BigEndian, req.RemotePeerPort)
+		msg.Write([]byte{0, 0})
+		msg.Write(ipAddress16(req.RemotePeer))
+	}
+
+	// Options, RFC 6887 7.3.
+	if req.ThirdParty != nil {
+		msg.Write([]byte{optionThirdParty, 0, 0, 16})
+		msg.Write(ipAddress16(req.ThirdParty))
+	}
+
+	if opcode == opcodeMap && req.RemotePeer != nil {
+		// A prefix length of 128 matches exactly the remote peer,
+		// including IPv4 remote peers as IPv4-mapped IPv6 addresses.
+		msg.Write([]byte{optionFilter, 0, 0, 20})
+		msg.Write([]byte{0, 128})
+		_ = binary.Write(msg, binary.BigEndian, req.RemotePeerPort)
+		msg.Write(ipAddress16(req.RemotePeer))
+	}
+
+	res, err := c.do(ctx, conn, msg.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	payloadLen := mapPayloadLen
+	if opcode == opcodePeer {
+		payloadLen = peerPayloadLen
+	}
+
+	if len(res) < headerLen+payloadLen {
+		return nil, fmt.Errorf("short response of %d bytes", len(res))
+	}
+
+	payload := res[headerLen:]
+	if !bytes.Equal(payload[:12], req.Nonce[:]) {
+		return nil, fmt.Errorf("response nonce does not match request")
+	}
+
+	if payload[12] != protocol || binary.BigEndian.Uint16(payload[16:18]) != req.InternalPort {
+		return nil, fmt.Errorf("response does not match request")
+	}
+
+	return &Mapping{
+		Protocol:          req.Protocol,
+		InternalPort:      req.InternalPort,
+		ExternalPort:      binary.BigEndian.Uint16(payload[18:20]),
+		ExternalIPAddress: ipAddress(payload[20:36]),
+		Lifetime:          time.Duration(binary.BigEndian.Uint32(res[4:8])) * time.Second,
+	}, nil
+}
+
+// do sends the request to the PCP server, retransmitting it as recommended
+// by RFC 6887 until it gets a successful response to it, times out or the context is done.
+func (c *Client) do(ctx context.Context, conn *net.UDPConn, req []byte) ([]byte, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("no response from PCP server %s within %s", c.Server, timeout))
+	defer cancel()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var (
+		res      = make([]byte, maxMessageLen)
+		interval = initialRetransmitInterval
+	)
+	for range maxRetransmits {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(interval)); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := conn.Read(res)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, context.Cause(ctx)
+				}
+
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+
+				return nil, err
+			}
+
+			// Ignore anything that is not a response to our request.
+			if n < headerLen || res[0] != version || res[1] != req[1]|opcodeResponse {
+				continue
+			}
+
+			if resultCode := ResultCode(res[3]); resultCode != ResultCodeSuccess {
+				return nil, resultCode
+			}
+
+			return res[:n], nil
+		}
+
+		interval = min(interval*2, maxRetransmitInterval)
+	}
+
+	return nil, fmt.Errorf("no response from PCP server %s", c.Server)
+}
+
+func protocolNumber(protocol upnp.Protocol) (byte, error) {
+	switch protocol {
+	case upnp.ProtocolTCP:
+		return 6, nil
+	case upnp.ProtocolUDP:
+		return 17, nil
+	}
+
+	return 0, fmt.Errorf("unsupported protocol %s", protocol)
+}
+
+// ipAddress16 returns the 16 byte representation of the given IP address
+// which PCP uses for both IPv4, as IPv4-mapped IPv6 addresses, and IPv6.
+func ipAddress16(ip net.IP) []byte {
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16
+	}
+
+	return make([]byte, net.IPv6len)
+}
+
+// suggestedIPAddress16 returns the 16 byte representation of the given
+// suggested IP address or, if it is nil, the all-zeros address of the same
+// family as the server to signify no preference.
+func suggestedIPAddress16(ip, server net.IP) []byte {
+	if ip != nil {
+		return ipAddress16(ip)
+	}
+
+	if server.To4() != nil {
+		return ipAddress16(net.IPv4zero)
+	}
+
+	return ipAddress16(net.IPv6zero)
+}
+
+func ipAddress(b []byte) net.IP {
+	ip := net.IP(bytes.Clone(b))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
@@ -0,0 +1,115 @@
+package pcp_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/pcp"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// servePCP runs a stub PCP server which maps every MAP request with a THIRD_PARTY
+// option to the external port after the suggested one on 203.0.113.1, grants at
+// most an hour, and refuses requests without a THIRD_PARTY option.
+func servePCP(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		req := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFromUDP(req)
+			if err != nil {
+				return
+			}
+
+			res := make([]byte, 60)
+			res[0] = 2
+			res[1] = req[1] | 0x80
+			copy(res[24:], req[24:60])
+
+			switch {
+			case n < 60 || req[1] != 1:
+				res[3] = byte(pcp.ResultCodeUnsupportedOpcode)
+			case n < 80 || req[60] != 1 || !bytes.Equal(req[64:80], net.IPv4(192, 168, 0, 11).To16()):
+				res[3] = byte(pcp.ResultCodeNotAuthorized)
+			default:
+				lifetime := min(binary.BigEndian.Uint32(req[4:8]), 3600)
+				binary.BigEndian.PutUint32(res[4:8], lifetime)
+				binary.BigEndian.PutUint16(res[42:44], binary.BigEndian.Uint16(req[42:44])+1)
+				copy(res[44:60], net.IPv4(203, 0, 113, 1).To16())
+			}
+
+			if _, err := conn.WriteToUDP(res, addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestClientMap(t *testing.T) {
+	var (
+		client = &pcp.Client{Server: servePCP(t)}
+		req    = &pcp.MapRequest{
+			Nonce:                 pcp.Nonce{1, 2, 3},
+			Protocol:              upnp.ProtocolTCP,
+			InternalPort:          80,
+			SuggestedExternalPort: 80,
+			Lifetime:              2 * time.Hour,
+			ThirdParty:            net.IPv4(192, 168, 0, 11),
+		}
+	)
+
+	mapping, err := client.Map(t.Context(), req)
+	if err != nil {
+		t.Fatalf("map: %v", err)
+	}
+
+	if mapping.ExternalPort != 81 || mapping.Lifetime != time.Hour || !mapping.ExternalIPAddress.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Fatalf("unexpected mapping %+v", mapping)
+	}
+
+	req.ThirdParty = nil
+
+	if _, err := client.Map(t.Context(), req); !errors.Is(err, pcp.ResultCodeNotAuthorized) {
+		t.Fatalf("expected error %v, got %v", pcp.ResultCodeNotAuthorized, err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	// A server that never responds.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	var (
+		client = &pcp.Client{Server: conn.LocalAddr().(*net.UDPAddr), Timeout: 100 * time.Millisecond}
+		start  = time.Now()
+	)
+
+	if _, err := client.Map(t.Context(), &pcp.MapRequest{Protocol: upnp.ProtocolTCP, InternalPort: 80, Lifetime: time.Hour}); err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Fatalf("expected no response, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected to give up after the timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,3 @@
+// package pcp provides a client for the Port Control Protocol
+// as specified by RFC 6887.
+package pcp
@@ -0,0 +1,145 @@
+package pfsense
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// AssociatedRuleIDNew is the AssociatedRuleID to create a PortForward with
+// to have pfSense create a firewall rule that passes its traffic.
+const AssociatedRuleIDNew = "new"
+
+// PortForward is a NAT port forward entry. Its ID is its
+// position in the list of port forwards, so it is not stable.
+type PortForward struct {
+	ID               *int   `json:"id,omitempty"`
+	Interface        string `json:"interface"`
+	IPProtocol       string `json:"ipprotocol"`
+	Protocol         string `json:"protocol"`
+	Source           string `json:"source"`
+	Destination      string `json:"destination"`
+	DestinationPort  string `json:"destination_port"`
+	Target           string `json:"target"`
+	LocalPort        string `json:"local_port"`
+	Disabled         bool   `json:"disabled"`
+	Descr            string `json:"descr"`
+	AssociatedRuleID string `json:"associated_rule_id,omitempty"`
+}
+
+// FirewallRule is a firewall rule. Only the fields needed
+// to find the rule associated with a PortForward are included.
+type FirewallRule struct {
+	ID               *int   `json:"id,omitempty"`
+	AssociatedRuleID string `json:"associated_rule_id,omitempty"`
+	Descr            string `json:"descr"`
+}
+
+// Client is a pfSense REST API client.
+type Client struct {
+	// URL is the base URL of the pfSense web UI, e.g. https://192.168.1.1.
+	URL *url.URL
+	// APIKey is a key for the pfSense REST API.
+	APIKey string
+	// HTTPClient is used to make requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// ListPortForwards lists every NAT port forward.
+func (c *Client) ListPortForwards(ctx context.Context) ([]PortForward, error) {
+	portForwards := []PortForward{}
+	return portForwards, c.do(ctx, http.MethodGet, "firewall/nat/port_forwards", nil, nil, &portForwards)
+}
+
+// CreatePortForward creates the given NAT port forward.
+func (c *Client) CreatePortForward(ctx context.Context, portForward *PortForward) error {
+	return c.do(ctx, http.MethodPost, "firewall/nat/port_forward", nil, portForward, nil)
+}
+
+// UpdatePortForward updates the NAT port forward with the given PortForward's ID.
+func (c *Client) UpdatePortForward(ctx context.Context, portForward *PortForward) error {
+	return c.do(ctx, http.MethodPatch, "firewall/nat/port_forward", nil, portForward, nil)
+}
+
+// DeletePortForward deletes the NAT port forward with the given ID.
+func (c *Client) DeletePortForward(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "firewall/nat/port_forward", url.Values{"id": {strconv.Itoa(id)}}, nil, nil)
+}
+
+// ListFirewallRules lists every firewall rule.
+func (c *Client) ListFirewallRules(ctx context.Context) ([]FirewallRule, error) {
+	firewallRules := []FirewallRule{}
+	return firewallRules, c.do(ctx, http.MethodGet, "firewall/rules", nil, nil, &firewallRules)
+}
+
+// DeleteFirewallRule deletes the firewall rule with the given ID.
+func (c *Client) DeleteFirewallRule(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "firewall/rule", url.Values{"id": {strconv.Itoa(id)}}, nil, nil)
+}
+
+// Apply applies pending firewall changes.
+func (c *Client) Apply(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "firewall/apply", nil, nil, nil)
+}
+
+type response struct {
+	Code    int             `json:"code"`
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func (c *Client) do(ctx context.Context, method, endpoint string, query url.Values, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	u := c.URL.JoinPath("api/v2", endpoint)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", c.APIKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resp := &response{}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return fmt.Errorf("%s %s: %s", method, endpoint, res.Status)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, endpoint, res.Status, resp.Message)
+	}
+
+	if out != nil {
+		return json.Unmarshal(resp.Data, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,3 @@
+// package pfsense provides a client for the parts of the pfSense REST API
+// package's v2 API that manage NAT port forwards and their firewall rules.
+package pfsense
@@ -0,0 +1,105 @@
+package portfwd
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/logutil"
+)
+
+// ListingPortForwarder is a PortForwarder that can list the port mappings
+// that it owns, so that the ones which are no longer wanted can be
+// garbage collected.
+type ListingPortForwarder interface {
+	PortForwarder
+	// ListPortMappings lists the port mappings owned by the PortForwarder.
+	// They must have at least the fields of their PortMappingKey set.
+	ListPortMappings(context.Context) ([]*PortMapping, error)
+}
+
+// GarbageCollectorOpts configures RunGarbageCollector.
+type GarbageCollectorOpts struct {
+	// IsWanted returns a function which reports whether or not
+	// a port mapping is still wanted. It is called once per collection.
+	IsWanted func(context.Context) (func(*PortMapping) bool, error)
+	// Interval is how long to wait between collections.
+	Interval time.Duration
+	// DryRun causes port mappings that would be deleted to only be logged.
+	DryRun bool
+}
+
+// RunGarbageCollector deletes port mappings owned by the ListingPortForwarder that are
+// no longer wanted immediately and then every interval until the given context is done.
+func RunGarbageCollector(ctx context.Context, portForwarder ListingPortForwarder, opts *GarbageCollectorOpts) error {
+	log := logutil.SloggerFrom(ctx)
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if collected, err := CollectGarbage(ctx, portForwarder, opts); err != nil {
+			log.Error("garbage collection failed", "err", err, "collected", len(collected))
+		} else {
+			log.Debug("garbage collection completed", "collected", len(collected))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// CollectGarbage deletes port mappings owned by the ListingPortForwarder that are
+// no longer wanted. It returns the port mappings that it deleted, or would have
+// deleted in the case of a dry run.
+func CollectGarbage(ctx context.Context, portForwarder ListingPortForwarder, opts *GarbageCollectorOpts) ([]*PortMapping, error) {
+	log := logutil.SloggerFrom(ctx)
+
+	isWanted, err := opts.IsWanted(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	portMappings, err := portForwarder.ListPortMappings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		collected = []*PortMapping{}
+		errs      = []error{}
+	)
+	for _, pm := range portMappings {
+		if isWanted(pm) {
+			continue
+		}
+
+		log := log.With(
+			"remoteHost", pm.RemoteHost,
+			"externalPort", pm.ExternalPort,
+			"protocol", pm.Protocol,
+			"internalClient", pm.InternalClient,
+			"internalPort", pm.InternalPort,
+			"description", pm.Description,
+		)
+
+		if opts.DryRun {
+			log.Info("would delete unwanted port mapping")
+			collected = append(collected, pm)
+			continue
+		}
+
+		if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		log.Info("deleted unwanted port mapping")
+		collected = append(collected, pm)
+	}
+
+	return collected, errors.Join(errs...)
+}
@@ -0,0 +1,82 @@
+package portfwd_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+type testListingPortForwarder struct {
+	portMappings []*portfwd.PortMapping
+}
+
+func (p *testListingPortForwarder) AddPortMapping(_ context.Context, pm *portfwd.PortMapping) error {
+	p.portMappings = append(p.portMappings, pm)
+	return nil
+}
+
+func (p *testListingPortForwarder) DeletePortMapping(_ context.Context, pm *portfwd.PortMapping) error {
+	for i, existing := range p.portMappings {
+		if existing.Key() == pm.Key() {
+			p.portMappings = append(p.portMappings[:i], p.portMappings[i+1:]...)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (p *testListingPortForwarder) ListPortMappings(context.Context) ([]*portfwd.PortMapping, error) {
+	return append([]*portfwd.PortMapping{}, p.portMappings...), nil
+}
+
+func TestCollectGarbage(t *testing.T) {
+	portForwarder := &testListingPortForwarder{}
+
+	for _, externalPort := range []int32{80, 443} {
+		if err := portForwarder.AddPortMapping(t.Context(), &portfwd.PortMapping{
+			ExternalPort:   externalPort,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   externalPort,
+			InternalClient: net.ParseIP("192.168.0.11"),
+			Enabled:        true,
+		}); err != nil {
+			t.Fatalf("add port mapping: %v", err)
+		}
+	}
+
+	opts := &portfwd.GarbageCollectorOpts{
+		IsWanted: func(context.Context) (func(*portfwd.PortMapping) bool, error) {
+			return func(pm *portfwd.PortMapping) bool {
+				return pm.ExternalPort == 80
+			}, nil
+		},
+		DryRun: true,
+	}
+
+	collected, err := portfwd.CollectGarbage(t.Context(), portForwarder, opts)
+	if err != nil {
+		t.Fatalf("collect garbage: %v", err)
+	}
+
+	if len(collected) != 1 || collected[0].ExternalPort != 443 {
+		t.Fatalf("expected to collect port 443, got %v", collected)
+	}
+
+	if len(portForwarder.portMappings) != 2 {
+		t.Fatalf("expected dry run to not delete any port mappings, got %d", len(portForwarder.portMappings))
+	}
+
+	opts.DryRun = false
+
+	if _, err := portfwd.CollectGarbage(t.Context(), portForwarder, opts); err != nil {
+		t.Fatalf("collect garbage: %v", err)
+	}
+
+	if len(portForwarder.portMappings) != 1 || portForwarder.portMappings[0].ExternalPort != 80 {
+		t.Fatalf("expected only port 80 to remain, got %v", portForwarder.portMappings)
+	}
+}
@@ -0,0 +1,50 @@
+package portfwd
+
+import (
+	"context"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/logutil"
+)
+
+// LeaseExpirer is implemented by PortForwarders whose port mappings are
+// permanent on the router, so they must delete port mappings whose leases
+// were not renewed in time themselves, as a router would for a UPnP
+// port mapping.
+type LeaseExpirer interface {
+	// ExpireLeases deletes port mappings whose leases have expired
+	// and returns the port mappings that it deleted.
+	ExpireLeases(context.Context) ([]*PortMapping, error)
+}
+
+// RunLeaseExpirer calls the given LeaseExpirer's ExpireLeases immediately
+// and then every interval until the given context is done.
+func RunLeaseExpirer(ctx context.Context, leaseExpirer LeaseExpirer, interval time.Duration) error {
+	log := logutil.SloggerFrom(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := leaseExpirer.ExpireLeases(ctx)
+		if err != nil {
+			log.Error("expiring leases failed", "err", err, "expired", len(expired))
+		}
+
+		for _, pm := range expired {
+			log.Info("deleted port mapping with expired lease",
+				"remoteHost", pm.RemoteHost,
+				"externalPort", pm.ExternalPort,
+				"protocol", pm.Protocol,
+				"internalClient", pm.InternalClient,
+				"internalPort", pm.InternalPort,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
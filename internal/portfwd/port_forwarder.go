@@ -2,6 +2,8 @@ package portfwd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/frantjc/port-forward/internal/upnp"
 )
@@ -13,4 +15,24 @@ type (
 // PortForwarder forwards the given port.
 type PortForwarder interface {
 	AddPortMapping(context.Context, *PortMapping) error
+	// DeletePortMapping stops forwarding the given port. It must not
+	// return an error if the given port is already not being forwarded.
+	DeletePortMapping(context.Context, *PortMapping) error
+}
+
+// ErrFamilyMismatch is returned when asked to forward to an InternalClient
+// of an IP address family that the PortForwarder cannot forward to, e.g.
+// an IPv6 address when the router only port forwards to IPv4 addresses.
+var ErrFamilyMismatch = errors.New("IP address families do not match")
+
+// RequireIPv4 returns an error wrapping ErrFamilyMismatch if the given
+// PortMapping's InternalClient is not an IPv4 address, for the given
+// backend's PortForwarder to refuse it because its router cannot port
+// forward to IPv6 addresses.
+func RequireIPv4(backend string, pm *PortMapping) error {
+	if pm.InternalClient.To4() == nil {
+		return fmt.Errorf("%w: %s backend only supports IPv4 internal clients, got %s", ErrFamilyMismatch, backend, pm.InternalClient)
+	}
+
+	return nil
 }
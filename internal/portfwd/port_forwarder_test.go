@@ -0,0 +1,36 @@
+package portfwd_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdrouteros"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdtr064"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdunifi"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdvyos"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+func TestIPv4OnlyPortForwarders(t *testing.T) {
+	for name, portForwarder := range map[string]portfwd.PortForwarder{
+		"RouterOS": &portfwdrouteros.PortForwarder{},
+		"UniFi":    &portfwdunifi.PortForwarder{},
+		"TR-064":   &portfwdtr064.PortForwarder{},
+		"VyOS":     &portfwdvyos.PortForwarder{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := portForwarder.AddPortMapping(t.Context(), &portfwd.PortMapping{
+				ExternalPort:   8080,
+				Protocol:       upnp.ProtocolTCP,
+				InternalPort:   80,
+				InternalClient: net.ParseIP("2001:db8::2"),
+				Enabled:        true,
+			})
+			if !errors.Is(err, portfwd.ErrFamilyMismatch) {
+				t.Fatalf("expected IPv6 internal client to be refused with a family mismatch, got %v", err)
+			}
+		})
+	}
+}
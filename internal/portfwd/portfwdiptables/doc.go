@@ -0,0 +1,4 @@
+// package portfwdiptables provides an implementation of portfwd.PortForwarder
+// that installs DNAT and forward-accept rules with `iptables` for when the Node
+// that it runs on is itself the gateway.
+package portfwdiptables
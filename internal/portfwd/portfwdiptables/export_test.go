@@ -0,0 +1,23 @@
+package portfwdiptables
+
+import (
+	"time"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+)
+
+var (
+	SplitRule     = splitRule
+	FlagValue     = flagValue
+	WithoutExpiry = withoutExpiry
+)
+
+// ParseLease exposes parseLease to tests.
+func (p *PortForwarder) ParseLease(rule string) (*portfwd.PortMapping, time.Time, bool) {
+	lease, ok := p.parseLease(rule)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	return lease.portMapping, lease.expires, true
+}
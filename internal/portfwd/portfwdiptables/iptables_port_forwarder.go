@@ -0,0 +1,560 @@
+package portfwdiptables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+const (
+	// ChainDNAT is the chain in the nat table that DNAT rules are installed in.
+	// It is jumped to from PREROUTING for traffic to the Node's own addresses.
+	ChainDNAT = "PORTFWD-DNAT"
+	// ChainForward is the chain in the filter table that rules accepting
+	// the DNATed traffic are installed in. It is jumped to from FORWARD.
+	ChainForward = "PORTFWD-FWD"
+)
+
+const (
+	tableNAT    = "nat"
+	tableFilter = "filter"
+	// expiresNever is recorded in the comment of
+	// rules for port mappings without a lease.
+	expiresNever = "never"
+	// maxCommentLen is the longest comment
+	// that the iptables comment match allows.
+	maxCommentLen = 256
+)
+
+// PortForwarder implements portfwd.PortForwarder by installing a DNAT rule in
+// ChainDNAT and a rule accepting the DNATed traffic in ChainForward for each
+// PortMapping. Each rule's comment records its owner, PortMappingKey, when its
+// lease expires and the Service that it is for. iptables rules are permanent,
+// so ExpireLeases deletes rules whose leases were not renewed in time.
+type PortForwarder struct {
+	// IPv4 is used for port mappings to IPv4 internal clients.
+	IPv4 *iptables.IPTables
+	// IPv6, if set, is used for port mappings to IPv6 internal clients.
+	IPv6 *iptables.IPTables
+	// InInterface, if set, restricts port forwards to
+	// traffic that arrives on the given interface.
+	InInterface string
+	// Owner marks rules as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+}
+
+var (
+	_ portfwd.ListingPortForwarder = &PortForwarder{}
+	_ portfwd.LeaseExpirer         = &PortForwarder{}
+)
+
+// AddPortMapping implements portfwd.PortForwarder. iptables rules
+// cannot be disabled, so disabled port mappings are deleted instead.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if !pm.Enabled {
+		return p.DeletePortMapping(ctx, pm)
+	}
+
+	ipt, err := p.iptablesFor(pm.InternalClient)
+	if err != nil {
+		return err
+	}
+
+	if pm.RemoteHost != "" {
+		if remoteHost := net.ParseIP(pm.RemoteHost); remoteHost == nil {
+			return fmt.Errorf("invalid remote host %s", pm.RemoteHost)
+		} else if (remoteHost.To4() != nil) != (ipt.Proto() == iptables.ProtocolIPv4) {
+			return fmt.Errorf("remote host %s and internal client %s are different IP families", pm.RemoteHost, pm.InternalClient)
+		}
+	}
+
+	expires := expiresNever
+	if pm.LeaseDuration > 0 {
+		expires = strconv.FormatInt(time.Now().Add(pm.LeaseDuration).Unix(), 10)
+	}
+
+	var (
+		comment      = p.comment(pm, expires)
+		dnat, accept = p.rulespecs(pm, comment)
+	)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ensureChains(ipt); err != nil {
+		return err
+	}
+
+	old, err := p.findRules(ipt, pm)
+	if err != nil {
+		return err
+	}
+
+	// Renewing an unchanged port mapping must not touch its rules besides
+	// recording when its lease now expires, so that is left out of the
+	// comparison and, if it changed, updated in place.
+	if len(old) == 2 {
+		prefix := p.commentPrefix(pm)
+		if oldComment := flagValue(old[0].rulespec, "--comment"); withoutExpiry(oldComment, prefix) == withoutExpiry(comment, prefix) {
+			oldDNAT, oldAccept := p.rulespecs(pm, oldComment)
+			if same, err := ipt.Exists(tableNAT, ChainDNAT, oldDNAT...); err != nil {
+				return err
+			} else if same {
+				if same, err = ipt.Exists(tableFilter, ChainForward, oldAccept...); err != nil {
+					return err
+				} else if same {
+					if oldComment == comment {
+						return nil
+					}
+
+					return replaceRules(ipt, old, dnat, accept)
+				}
+			}
+		}
+	}
+
+	if err := ipt.Append(tableFilter, ChainForward, accept...); err != nil {
+		return err
+	}
+
+	if err := ipt.Append(tableNAT, ChainDNAT, dnat...); err != nil {
+		return err
+	}
+
+	// Only delete the old rules once the new ones are in place so that
+	// forwarding does not lapse. iptables deletes the first matching rule,
+	// so an old rule that is the same as a new one is deleted before it.
+	return deleteRules(ipt, old)
+}
+
+// DeletePortMapping implements portfwd.PortForwarder. The rules for the
+// PortMapping are deleted from the IP family of its InternalClient, or
+// from every configured IP family if its InternalClient is not known.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ipts := p.iptables()
+	if pm.InternalClient != nil {
+		ipt, err := p.iptablesFor(pm.InternalClient)
+		if err != nil {
+			return err
+		}
+
+		ipts = []*iptables.IPTables{ipt}
+	}
+
+	errs := []error{}
+	for _, ipt := range ipts {
+		if err := p.ensureChains(ipt); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		errs = append(errs, p.delRules(ipt, pm))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ListPortMappings implements portfwd.ListingPortForwarder. The returned
+// port mappings' descriptions are the Service that they are for.
+func (p *PortForwarder) ListPortMappings(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	portMappings := []*portfwd.PortMapping{}
+	for _, ipt := range p.iptables() {
+		leases, err := p.listLeases(ipt)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, lease := range leases {
+			portMappings = append(portMappings, lease.portMapping)
+		}
+	}
+
+	return portMappings, nil
+}
+
+// ExpireLeases implements portfwd.LeaseExpirer.
+func (p *PortForwarder) ExpireLeases(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		now     = time.Now()
+		expired = []*portfwd.PortMapping{}
+		errs    = []error{}
+	)
+	for _, ipt := range p.iptables() {
+		leases, err := p.listLeases(ipt)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, lease := range leases {
+			if lease.expires.IsZero() || now.Before(lease.expires) {
+				continue
+			}
+
+			if err := p.delRules(ipt, lease.portMapping); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			expired = append(expired, lease.portMapping)
+		}
+	}
+
+	return expired, errors.Join(errs...)
+}
+
+type lease struct {
+	portMapping *portfwd.PortMapping
+	expires     time.Time
+}
+
+// listLeases parses the owned DNAT rules.
+func (p *PortForwarder) listLeases(ipt *iptables.IPTables) ([]lease, error) {
+	if err := p.ensureChains(ipt); err != nil {
+		return nil, err
+	}
+
+	rules, err := ipt.List(tableNAT, ChainDNAT)
+	if err != nil {
+		return nil, err
+	}
+
+	leases := []lease{}
+	for _, r := range rules {
+		if lease, ok := p.parseLease(r); ok {
+			leases = append(leases, *lease)
+		}
+	}
+
+	return leases, nil
+}
+
+// parseLease parses the given DNAT rule, as listed by `iptables -S`,
+// if it is owned by the PortForwarder.
+func (p *PortForwarder) parseLease(rule string) (*lease, bool) {
+	args := splitRule(rule)
+
+	rest, ok := strings.CutPrefix(flagValue(args, "--comment"), upnp.OwnerMarker(p.Owner))
+	if !ok {
+		return nil, false
+	}
+
+	fields := strings.SplitN(rest, " ", 3)
+	if len(fields) < 2 {
+		return nil, false
+	}
+
+	key := strings.SplitN(fields[0], "/", 3)
+	if len(key) < 2 {
+		return nil, false
+	}
+
+	externalPort, err := strconv.ParseInt(key[0], 10, 32)
+	if err != nil {
+		return nil, false
+	}
+
+	pm := &portfwd.PortMapping{
+		ExternalPort: int32(externalPort),
+		Protocol:     upnp.Protocol(key[1]),
+		Enabled:      true,
+	}
+	if len(key) > 2 {
+		pm.RemoteHost = key[2]
+	}
+	if len(fields) > 2 {
+		pm.Description = fields[2]
+	}
+
+	if host, port, err := net.SplitHostPort(flagValue(args, "--to-destination")); err == nil {
+		pm.InternalClient = net.ParseIP(host)
+
+		if internalPort, err := strconv.ParseInt(port, 10, 32); err == nil {
+			pm.InternalPort = int32(internalPort)
+		}
+	}
+
+	var expires time.Time
+	if fields[1] != expiresNever {
+		unix, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		expires = time.Unix(unix, 0)
+		pm.LeaseDuration = max(time.Until(expires), 0)
+	}
+
+	return &lease{portMapping: pm, expires: expires}, true
+}
+
+// ensureChains creates ChainDNAT and ChainForward and the rules jumping
+// to them if they do not already exist.
+func (p *PortForwarder) ensureChains(ipt *iptables.IPTables) error {
+	for _, table := range []struct {
+		name, chain, from string
+		jump              []string
+	}{
+		{
+			name:  tableNAT,
+			chain: ChainDNAT,
+			from:  "PREROUTING",
+			// Only traffic to the Node itself, not traffic passing through it.
+			jump: []string{"--match", "addrtype", "--dst-type", "LOCAL", "--jump", ChainDNAT},
+		},
+		{
+			name:  tableFilter,
+			chain: ChainForward,
+			from:  "FORWARD",
+			jump:  []string{"--jump", ChainForward},
+		},
+	} {
+		if exists, err := ipt.ChainExists(table.name, table.chain); err != nil {
+			return err
+		} else if !exists {
+			if err := ipt.NewChain(table.name, table.chain); err != nil {
+				return err
+			}
+		}
+
+		// Insert rather than append so that the jump
+		// comes before any rules that would drop the traffic.
+		if err := ipt.InsertUnique(table.name, table.from, 1, table.jump...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rule is a rule in one of the PortForwarder's chains.
+type rule struct {
+	table, chain string
+	// num is the rule's position in its chain, starting at 1.
+	num int
+	// rulespec is the rule's arguments after the chain.
+	rulespec []string
+}
+
+// delRules deletes the rules for the given PortMapping.
+func (p *PortForwarder) delRules(ipt *iptables.IPTables, pm *portfwd.PortMapping) error {
+	rules, err := p.findRules(ipt, pm)
+	if err != nil {
+		return err
+	}
+
+	return deleteRules(ipt, rules)
+}
+
+// findRules returns the rules for the given PortMapping.
+func (p *PortForwarder) findRules(ipt *iptables.IPTables, pm *portfwd.PortMapping) ([]rule, error) {
+	var (
+		prefix = p.commentPrefix(pm)
+		found  = []rule{}
+	)
+	for _, table := range []struct{ name, chain string }{
+		{tableNAT, ChainDNAT},
+		{tableFilter, ChainForward},
+	} {
+		rules, err := ipt.List(table.name, table.chain)
+		if err != nil {
+			return nil, err
+		}
+
+		num := 0
+		for _, r := range rules {
+			args := splitRule(r)
+			if len(args) < 2 || args[0] != "-A" {
+				continue
+			}
+
+			num++
+			if !strings.HasPrefix(flagValue(args, "--comment"), prefix) {
+				continue
+			}
+
+			found = append(found, rule{table: table.name, chain: table.chain, num: num, rulespec: args[2:]})
+		}
+	}
+
+	return found, nil
+}
+
+// deleteRules deletes the given rules.
+func deleteRules(ipt *iptables.IPTables, rules []rule) error {
+	for _, r := range rules {
+		if err := ipt.DeleteIfExists(r.table, r.chain, r.rulespec...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceRules replaces the given rules in place with
+// the given DNAT and accept rules, as appropriate.
+func replaceRules(ipt *iptables.IPTables, rules []rule, dnat, accept []string) error {
+	for _, r := range rules {
+		rulespec := accept
+		if r.table == tableNAT {
+			rulespec = dnat
+		}
+
+		if err := ipt.Replace(r.table, r.chain, r.num, rulespec...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rulespecs returns the DNAT and accept rules for
+// the given PortMapping with the given comment.
+func (p *PortForwarder) rulespecs(pm *portfwd.PortMapping, comment string) ([]string, []string) {
+	var (
+		protocol = strings.ToLower(string(pm.Protocol))
+		dnat     = []string{"--protocol", protocol}
+		accept   = []string{
+			"--protocol", protocol,
+			"--destination", pm.InternalClient.String(),
+			"--match", "comment", "--comment", comment,
+			"--match", protocol, "--destination-port", strconv.Itoa(int(pm.InternalPort)),
+			"--jump", "ACCEPT",
+		}
+	)
+	if pm.RemoteHost != "" {
+		dnat = append(dnat, "--source", pm.RemoteHost)
+	}
+	if p.InInterface != "" {
+		dnat = append(dnat, "--in-interface", p.InInterface)
+	}
+	dnat = append(dnat,
+		"--match", "comment", "--comment", comment,
+		"--match", protocol, "--destination-port", strconv.Itoa(int(pm.ExternalPort)),
+		"--jump", "DNAT", "--to-destination", net.JoinHostPort(pm.InternalClient.String(), strconv.Itoa(int(pm.InternalPort))),
+	)
+
+	return dnat, accept
+}
+
+// comment returns the comment for the rules for the given
+// PortMapping whose lease expires as given.
+func (p *PortForwarder) comment(pm *portfwd.PortMapping, expires string) string {
+	comment := p.commentPrefix(pm) + expires + " " + pm.Service
+	if len(comment) > maxCommentLen-1 {
+		comment = comment[:maxCommentLen-1]
+	}
+
+	return comment
+}
+
+// withoutExpiry returns the given comment, which starts with
+// the given prefix, without when its lease expires.
+func withoutExpiry(comment, prefix string) string {
+	_, rest, _ := strings.Cut(strings.TrimPrefix(comment, prefix), " ")
+	return prefix + rest
+}
+
+// commentPrefix identifies the rules for a PortMapping
+// by its owner and the PortMappingKey.
+func (p *PortForwarder) commentPrefix(pm *portfwd.PortMapping) string {
+	return upnp.OwnerMarker(p.Owner) + pm.Key().String() + " "
+}
+
+// iptablesFor returns the *iptables.IPTables for
+// the family of the given internal client.
+func (p *PortForwarder) iptablesFor(internalClient net.IP) (*iptables.IPTables, error) {
+	switch {
+	case internalClient.To4() != nil:
+		if p.IPv4 != nil {
+			return p.IPv4, nil
+		}
+	case internalClient.To16() != nil:
+		if p.IPv6 != nil {
+			return p.IPv6, nil
+		}
+	default:
+		return nil, fmt.Errorf("invalid internal client %s", internalClient)
+	}
+
+	return nil, fmt.Errorf("no iptables configured for the IP family of internal client %s", internalClient)
+}
+
+// iptables returns every configured *iptables.IPTables.
+func (p *PortForwarder) iptables() []*iptables.IPTables {
+	ipts := []*iptables.IPTables{}
+	for _, ipt := range []*iptables.IPTables{p.IPv4, p.IPv6} {
+		if ipt != nil {
+			ipts = append(ipts, ipt)
+		}
+	}
+
+	return ipts
+}
+
+// splitRule splits a rule as listed by `iptables -S` into its arguments,
+// unquoting double-quoted arguments such as comments.
+func splitRule(rule string) []string {
+	var (
+		args    = []string{}
+		arg     = new(strings.Builder)
+		inArg   bool
+		quoted  bool
+		escaped bool
+	)
+	for _, r := range rule {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case r == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args
+}
+
+// flagValue returns the argument following the given flag, if any.
+func flagValue(args []string, flag string) string {
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,177 @@
+package portfwdiptables_test
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdiptables"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+func TestSplitRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule     string
+		expected []string
+	}{
+		{
+			rule:     "-N PORTFWD-DNAT",
+			expected: []string{"-N", "PORTFWD-DNAT"},
+		},
+		{
+			rule:     `-A PORTFWD-DNAT -p tcp -m comment --comment "[portfwd] 8080/TCP never default/web:http" -m tcp --dport 8080 -j DNAT --to-destination 192.168.0.10:80`,
+			expected: []string{"-A", "PORTFWD-DNAT", "-p", "tcp", "-m", "comment", "--comment", "[portfwd] 8080/TCP never default/web:http", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "192.168.0.10:80"},
+		},
+		{
+			rule:     `-A PORTFWD-FWD -m comment --comment "say \"hi\"" -j ACCEPT`,
+			expected: []string{"-A", "PORTFWD-FWD", "-m", "comment", "--comment", `say "hi"`, "-j", "ACCEPT"},
+		},
+		{
+			rule:     `-A PORTFWD-FWD  -m comment --comment "" -j ACCEPT `,
+			expected: []string{"-A", "PORTFWD-FWD", "-m", "comment", "--comment", "", "-j", "ACCEPT"},
+		},
+		{
+			rule:     "",
+			expected: []string{},
+		},
+	} {
+		t.Run(tc.rule, func(t *testing.T) {
+			if args := portfwdiptables.SplitRule(tc.rule); !slices.Equal(args, tc.expected) {
+				t.Fatalf("expected %q, got %q", tc.expected, args)
+			}
+		})
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	args := []string{"-A", "PORTFWD-DNAT", "--comment", "[portfwd] 8080/TCP never", "-j", "DNAT", "--to-destination"}
+
+	for _, tc := range []struct {
+		flag     string
+		expected string
+	}{
+		{flag: "--comment", expected: "[portfwd] 8080/TCP never"},
+		{flag: "-j", expected: "DNAT"},
+		{flag: "--dport", expected: ""},
+		// A flag without a value.
+		{flag: "--to-destination", expected: ""},
+	} {
+		t.Run(tc.flag, func(t *testing.T) {
+			if value := portfwdiptables.FlagValue(args, tc.flag); value != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, value)
+			}
+		})
+	}
+}
+
+func TestWithoutExpiry(t *testing.T) {
+	const (
+		prefix = "[portfwd] 8080/TCP "
+		leased = prefix + "1700000000 default/web:http"
+	)
+
+	for _, tc := range []struct {
+		name    string
+		comment string
+		same    bool
+	}{
+		{name: "renewed lease", comment: prefix + "1700003600 default/web:http", same: true},
+		{name: "permanent lease", comment: prefix + "never default/web:http", same: true},
+		{name: "other Service", comment: prefix + "1700003600 default/api:http"},
+		{name: "no Service", comment: prefix + "1700003600 "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if same := portfwdiptables.WithoutExpiry(tc.comment, prefix) == portfwdiptables.WithoutExpiry(leased, prefix); same != tc.same {
+				t.Fatalf("expected %q and %q to be the same apart from their expiry to be %t", tc.comment, leased, tc.same)
+			}
+		})
+	}
+}
+
+func TestPortForwarderParseLease(t *testing.T) {
+	var (
+		portForwarder = &portfwdiptables.PortForwarder{Owner: "portfwd"}
+		expires       = time.Now().Add(time.Hour).Truncate(time.Second)
+	)
+
+	for _, tc := range []struct {
+		name            string
+		rule            string
+		expected        *portfwd.PortMapping
+		expectedExpires time.Time
+	}{
+		{
+			name: "permanent",
+			rule: `-A PORTFWD-DNAT -p tcp -m comment --comment "[portfwd] 8080/TCP never default/web:http" -m tcp --dport 8080 -j DNAT --to-destination 192.168.0.10:80`,
+			expected: &portfwd.PortMapping{
+				ExternalPort:   8080,
+				Protocol:       upnp.ProtocolTCP,
+				InternalPort:   80,
+				InternalClient: net.IPv4(192, 168, 0, 10),
+				Enabled:        true,
+				Description:    "default/web:http",
+			},
+		},
+		{
+			name: "lease",
+			rule: `-A PORTFWD-DNAT -s 203.0.113.1/32 -p udp -m comment --comment "[portfwd] 5353/UDP/203.0.113.1 ` + strconv.FormatInt(expires.Unix(), 10) + `" -m udp --dport 5353 -j DNAT --to-destination [2001:db8::10]:53`,
+			expected: &portfwd.PortMapping{
+				RemoteHost:     "203.0.113.1",
+				ExternalPort:   5353,
+				Protocol:       upnp.ProtocolUDP,
+				InternalPort:   53,
+				InternalClient: net.ParseIP("2001:db8::10"),
+				Enabled:        true,
+			},
+			expectedExpires: expires,
+		},
+		{
+			name: "someone else's",
+			rule: `-A PORTFWD-DNAT -p tcp -m comment --comment "[other] 8080/TCP never" -m tcp --dport 8080 -j DNAT --to-destination 192.168.0.10:80`,
+		},
+		{
+			name: "no comment",
+			rule: `-A PORTFWD-DNAT -p tcp -m tcp --dport 8080 -j DNAT --to-destination 192.168.0.10:80`,
+		},
+		{
+			name: "no expiry",
+			rule: `-A PORTFWD-DNAT -m comment --comment "[portfwd] 8080/TCP" -j DNAT --to-destination 192.168.0.10:80`,
+		},
+		{
+			name: "invalid key",
+			rule: `-A PORTFWD-DNAT -m comment --comment "[portfwd] http/TCP never" -j DNAT --to-destination 192.168.0.10:80`,
+		},
+		{
+			name: "invalid expiry",
+			rule: `-A PORTFWD-DNAT -m comment --comment "[portfwd] 8080/TCP soon" -j DNAT --to-destination 192.168.0.10:80`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pm, expires, ok := portForwarder.ParseLease(tc.rule)
+			if tc.expected == nil {
+				if ok {
+					t.Fatalf("expected rule not to be parsed, got %v", pm)
+				}
+
+				return
+			} else if !ok {
+				t.Fatal("expected rule to be parsed")
+			}
+
+			if pm.Key() != tc.expected.Key() || !pm.InternalClient.Equal(tc.expected.InternalClient) || pm.InternalPort != tc.expected.InternalPort || pm.Enabled != tc.expected.Enabled || pm.Description != tc.expected.Description {
+				t.Fatalf("expected %v, got %v", tc.expected, pm)
+			}
+
+			if !expires.Equal(tc.expectedExpires) {
+				t.Fatalf("expected lease to expire at %s, got %s", tc.expectedExpires, expires)
+			}
+
+			if !expires.IsZero() && (pm.LeaseDuration <= 0 || pm.LeaseDuration > time.Hour) {
+				t.Fatalf("expected lease duration of up to an hour, got %s", pm.LeaseDuration)
+			}
+		})
+	}
+}
@@ -0,0 +1,3 @@
+// package portfwdnatpmp provides an implementation of portfwd.PortForwarder
+// that uses NAT-PMP and a srcipmasq.SourceIPAddressMasqer.
+package portfwdnatpmp
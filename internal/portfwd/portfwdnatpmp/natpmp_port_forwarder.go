@@ -0,0 +1,95 @@
+package portfwdnatpmp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/natpmp"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/srcipmasq"
+)
+
+// DefaultLeaseDuration is the lease duration requested for port mappings
+// that ask for a permanent lease, which NAT-PMP does not support. It is
+// the lifetime recommended by RFC 6886 3.3.
+const DefaultLeaseDuration = 2 * time.Hour
+
+type PortForwarder struct {
+	*natpmp.Client
+	srcipmasq.SourceIPAddressMasqer
+	mu sync.Mutex
+}
+
+var _ portfwd.PortForwarder = &PortForwarder{}
+
+// AddPortMapping implements portfwd.PortForwarder. NAT-PMP always maps from the
+// requesting host, so the request is masqueraded as coming from the PortMapping's
+// InternalClient. The lease duration and external port assigned by the NAT-PMP
+// server are written back to the PortMapping.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if pm.RemoteHost != "" {
+		return fmt.Errorf("NAT-PMP does not support remote host %s", pm.RemoteHost)
+	}
+
+	if !pm.Enabled {
+		return p.DeletePortMapping(ctx, pm)
+	}
+
+	leaseDuration := pm.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = DefaultLeaseDuration
+	}
+
+	return p.masqAs(ctx, pm, func() error {
+		mapping, err := p.Map(ctx, pm.Protocol, uint16(pm.InternalPort), uint16(pm.ExternalPort), leaseDuration)
+		if err != nil {
+			return err
+		}
+
+		pm.LeaseDuration = mapping.Lifetime
+		if externalPort := int32(mapping.ExternalPort); externalPort != pm.ExternalPort {
+			pm.AssignedExternalPort = externalPort
+		}
+
+		return nil
+	})
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	return p.masqAs(ctx, pm, func() error {
+		_, err := p.Map(ctx, pm.Protocol, uint16(pm.InternalPort), 0, 0)
+		return err
+	})
+}
+
+// masqAs calls f while traffic to the NAT-PMP server
+// appears to come from the PortMapping's InternalClient.
+// NAT-PMP only maps to the requester, so if that is not
+// possible, e.g. because the InternalClient is an IPv6
+// address, it returns the srcipmasq.ErrFamilyMismatch.
+func (p *PortForwarder) masqAs(ctx context.Context, pm *portfwd.PortMapping, f func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	destination, err := p.GetServiceIPAddress(ctx)
+	if err != nil {
+		return err
+	}
+
+	restore, err := p.MasqSourceIPAddress(ctx, &srcipmasq.Masq{
+		OriginalSource: p.GetSourceIPAddress(ctx),
+		Destination:    destination,
+		NewSource:      pm.InternalClient,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = restore()
+	}()
+
+	return f()
+}
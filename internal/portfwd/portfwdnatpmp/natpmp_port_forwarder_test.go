@@ -0,0 +1,223 @@
+package portfwdnatpmp_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/natpmp"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdnatpmp"
+	"github.com/frantjc/port-forward/internal/srcipmasq"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// fakeMasqer pretends to masquerade traffic by remembering
+// which IP address traffic currently appears to come from.
+type fakeMasqer struct {
+	mu      sync.Mutex
+	current net.IP
+	masqs   []srcipmasq.Masq
+}
+
+func (f *fakeMasqer) MasqSourceIPAddress(_ context.Context, masq *srcipmasq.Masq) (func() error, error) {
+	if _, err := masq.IPv6(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.current = masq.NewSource
+	f.masqs = append(f.masqs, *masq)
+
+	return func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.current = nil
+		return nil
+	}, nil
+}
+
+func (f *fakeMasqer) source() net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.current
+}
+
+// fakeNATPMPServer is a NAT-PMP server which, like a real one, maps from
+// whichever host the request appears to come from according to its
+// fakeMasqer. It grants at most an hour and assigns the external port
+// after the suggested one if another host already has it.
+type fakeNATPMPServer struct {
+	mu     sync.Mutex
+	masqer *fakeMasqer
+	// mappings holds the external port of each mapping by
+	// "<internal client>/<opcode>/<internal port>".
+	mappings map[string]uint16
+}
+
+func (f *fakeNATPMPServer) serve(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		req := make([]byte, 12)
+		for {
+			n, addr, err := conn.ReadFromUDP(req)
+			if err != nil {
+				return
+			}
+
+			if _, err := conn.WriteToUDP(f.respond(req[:n]), addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (f *fakeNATPMPServer) respond(req []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := make([]byte, 16)
+	res[1] = req[1] + 128
+	if len(req) != 12 || req[1] == 0 {
+		binary.BigEndian.PutUint16(res[2:4], uint16(natpmp.ResultCodeUnsupportedOpcode))
+		return res
+	}
+
+	var (
+		internalPort = binary.BigEndian.Uint16(req[4:6])
+		externalPort = binary.BigEndian.Uint16(req[6:8])
+		lifetime     = binary.BigEndian.Uint32(req[8:12])
+		key          = fmt.Sprintf("%s/%d/%d", f.masqer.source(), req[1], internalPort)
+	)
+	copy(res[8:10], req[4:6])
+
+	if lifetime == 0 {
+		delete(f.mappings, key)
+		return res
+	}
+
+	if assigned, ok := f.mappings[key]; ok {
+		externalPort = assigned
+	} else {
+		for taken := true; taken; {
+			taken = false
+			for _, assigned := range f.mappings {
+				if assigned == externalPort {
+					externalPort++
+					taken = true
+				}
+			}
+		}
+	}
+
+	f.mappings[key] = externalPort
+	binary.BigEndian.PutUint16(res[10:12], externalPort)
+	binary.BigEndian.PutUint32(res[12:16], min(lifetime, 3600))
+
+	return res
+}
+
+func (f *fakeNATPMPServer) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.mappings)
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx           = t.Context()
+		masqer        = &fakeMasqer{}
+		server        = &fakeNATPMPServer{masqer: masqer, mappings: map[string]uint16{}}
+		portForwarder = &portfwdnatpmp.PortForwarder{
+			Client:                &natpmp.Client{Gateway: server.serve(t)},
+			SourceIPAddressMasqer: masqer,
+		}
+		pm = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 0, 10),
+			Enabled:        true,
+		}
+		other = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 0, 11),
+			Enabled:        true,
+		}
+	)
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	if pm.LeaseDuration != time.Hour || pm.AssignedExternalPort != 0 {
+		t.Fatalf("expected what the server assigned to be written back, got %+v", pm)
+	}
+
+	if len(masqer.masqs) != 1 || !masqer.masqs[0].NewSource.Equal(pm.InternalClient) || !masqer.masqs[0].Destination.Equal(portForwarder.Gateway.IP) || masqer.source() != nil {
+		t.Fatalf("expected the request to be masqueraded as the internal client and then restored, got %v", masqer.masqs)
+	}
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	if server.len() != 1 {
+		t.Fatalf("expected the mapping to be renewed, got %d mappings", server.len())
+	}
+
+	// The server may assign a different external port than the one asked for.
+	if err := portForwarder.AddPortMapping(ctx, other); err != nil {
+		t.Fatalf("add other: %v", err)
+	}
+
+	if other.AssignedExternalPort != 8081 {
+		t.Fatalf("expected the assigned external port 8081 to be written back, got %d", other.AssignedExternalPort)
+	}
+
+	// Disabling deletes only the mapping from its internal client.
+	other.Enabled = false
+	if err := portForwarder.AddPortMapping(ctx, other); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if server.len() != 0 {
+		t.Fatalf("expected the mappings to be deleted, got %d mappings", server.len())
+	}
+
+	// NAT-PMP can neither restrict mappings to a remote host nor map to an IPv6 address.
+	if err := portForwarder.AddPortMapping(ctx, &portfwd.PortMapping{RemoteHost: "203.0.113.2", ExternalPort: 8080, Protocol: upnp.ProtocolTCP, InternalPort: 80, InternalClient: pm.InternalClient, Enabled: true}); err == nil {
+		t.Fatal("expected an error for a remote host")
+	}
+
+	if err := portForwarder.AddPortMapping(ctx, &portfwd.PortMapping{ExternalPort: 8080, Protocol: upnp.ProtocolTCP, InternalPort: 80, InternalClient: net.ParseIP("2001:db8::10"), Enabled: true}); !errors.Is(err, srcipmasq.ErrFamilyMismatch) {
+		t.Fatalf("expected error %v, got %v", srcipmasq.ErrFamilyMismatch, err)
+	}
+}
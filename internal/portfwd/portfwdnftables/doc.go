@@ -0,0 +1,4 @@
+// package portfwdnftables provides an implementation of portfwd.PortForwarder
+// that installs DNAT and forward-accept rules with nftables for when the Node
+// that it runs on is itself the gateway.
+package portfwdnftables
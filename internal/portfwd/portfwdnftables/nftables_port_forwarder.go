@@ -0,0 +1,439 @@
+package portfwdnftables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultTable is the name of the inet table that rules are installed in by default.
+const DefaultTable = "portfwd"
+
+const (
+	chainPrerouting = "prerouting"
+	chainForward    = "forward"
+	// expiresNever is recorded in the comment of
+	// rules for port mappings without a lease.
+	expiresNever = "never"
+)
+
+// PortForwarder implements portfwd.PortForwarder by installing a DNAT rule for
+// traffic to the Node's own addresses and a rule accepting the DNATed traffic
+// when it is forwarded for each PortMapping, in a dedicated inet table. Each
+// rule's comment records its owner, PortMappingKey and when its lease expires.
+// nftables rules are permanent, so ExpireLeases deletes rules whose leases
+// were not renewed in time.
+//
+// An accept verdict in one table does not override a drop verdict in another,
+// so if the Node's forward policy is drop, the DNATed traffic may need to be
+// accepted there too, e.g. with "ct status dnat accept".
+type PortForwarder struct {
+	*nftables.Conn
+	// Table is the name of the inet table to install rules in.
+	// Defaults to DefaultTable.
+	Table string
+	// InInterface, if set, restricts port forwards to
+	// traffic that arrives on the given interface.
+	InInterface string
+	// Owner marks rules as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+}
+
+var (
+	_ portfwd.ListingPortForwarder = &PortForwarder{}
+	_ portfwd.LeaseExpirer         = &PortForwarder{}
+)
+
+// AddPortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	var (
+		nfproto      byte = unix.NFPROTO_IPV4
+		addr              = pm.InternalClient.To4()
+		expires           = expiresNever
+		l4proto, err      = l4proto(pm.Protocol)
+	)
+	if err != nil {
+		return err
+	}
+	if addr == nil {
+		nfproto, addr = unix.NFPROTO_IPV6, pm.InternalClient.To16()
+	}
+	if addr == nil {
+		return fmt.Errorf("invalid internal client %s", pm.InternalClient)
+	}
+	if pm.LeaseDuration > 0 {
+		expires = strconv.FormatInt(time.Now().Add(pm.LeaseDuration).Unix(), 10)
+	}
+
+	var remoteHost net.IP
+	if pm.RemoteHost != "" {
+		if remoteHost = net.ParseIP(pm.RemoteHost); remoteHost == nil {
+			return fmt.Errorf("invalid remote host %s", pm.RemoteHost)
+		}
+
+		if (remoteHost.To4() != nil) != (nfproto == unix.NFPROTO_IPV4) {
+			return fmt.Errorf("remote host %s and internal client %s are different IP families", pm.RemoteHost, pm.InternalClient)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	table, prerouting, forward := p.ensureChains()
+
+	if err := p.delRules(table, pm); err != nil {
+		return err
+	}
+
+	var (
+		comment = userdata.AppendString(nil, userdata.TypeComment, p.commentPrefix(pm)+expires+" "+strings.TrimSpace(pm.Service+" "+pm.Description))
+		match   = []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+		}
+	)
+	if remoteHost != nil {
+		match = append(match, matchAddr(nfproto, false, remoteHost)...)
+	}
+
+	dnat := append(append([]expr.Any{}, match...),
+		// Only traffic to the Node itself, not traffic passing through it.
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+	)
+	if p.InInterface != "" {
+		dnat = append(dnat,
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(p.InInterface)},
+		)
+	}
+	dnat = append(dnat,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(pm.ExternalPort))},
+		&expr.Immediate{Register: 1, Data: addr},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(pm.InternalPort))},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: uint32(nfproto), RegAddrMin: 1, RegProtoMin: 2, Specified: true},
+	)
+
+	accept := append(append([]expr.Any{}, match...), matchAddr(nfproto, true, addr)...)
+	accept = append(accept,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(pm.InternalPort))},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	)
+
+	if !pm.Enabled {
+		// Keep the rules so that the port mapping can still be listed, but
+		// stop evaluating them before they match, as nftables rules cannot
+		// be disabled. Unlike continue, break ends the evaluation of the rule.
+		dnat = append([]expr.Any{&expr.Verdict{Kind: expr.VerdictBreak}}, dnat...)
+		accept = append([]expr.Any{&expr.Verdict{Kind: expr.VerdictBreak}}, accept...)
+	}
+
+	p.AddRule(&nftables.Rule{Table: table, Chain: prerouting, Exprs: dnat, UserData: comment})
+	p.AddRule(&nftables.Rule{Table: table, Chain: forward, Exprs: accept, UserData: comment})
+
+	return p.Flush()
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	table, _, _ := p.ensureChains()
+
+	if err := p.delRules(table, pm); err != nil {
+		return err
+	}
+
+	return p.Flush()
+}
+
+// ListPortMappings implements portfwd.ListingPortForwarder. The owner marker
+// and lease expiry are removed from the returned port mappings' descriptions.
+func (p *PortForwarder) ListPortMappings(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	leases, err := p.listLeases()
+	if err != nil {
+		return nil, err
+	}
+
+	portMappings := make([]*portfwd.PortMapping, len(leases))
+	for i, lease := range leases {
+		portMappings[i] = lease.portMapping
+	}
+
+	return portMappings, nil
+}
+
+// ExpireLeases implements portfwd.LeaseExpirer.
+func (p *PortForwarder) ExpireLeases(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	leases, err := p.listLeases()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now     = time.Now()
+		expired = []*portfwd.PortMapping{}
+		errs    = []error{}
+	)
+	table, _, _ := p.ensureChains()
+	for _, lease := range leases {
+		if lease.expires.IsZero() || now.Before(lease.expires) {
+			continue
+		}
+
+		if err := p.delRules(table, lease.portMapping); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		expired = append(expired, lease.portMapping)
+	}
+
+	if len(expired) > 0 {
+		if err := p.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, errors.Join(errs...)
+}
+
+type lease struct {
+	portMapping *portfwd.PortMapping
+	expires     time.Time
+}
+
+// listLeases parses the owned DNAT rules.
+func (p *PortForwarder) listLeases() ([]lease, error) {
+	table, prerouting, _ := p.ensureChains()
+	if err := p.Flush(); err != nil {
+		return nil, err
+	}
+
+	rules, err := p.GetRules(table, prerouting)
+	if err != nil {
+		return nil, err
+	}
+
+	leases := []lease{}
+	for _, rule := range rules {
+		comment, _ := userdata.GetString(rule.UserData, userdata.TypeComment)
+
+		rest, ok := strings.CutPrefix(comment, upnp.OwnerMarker(p.Owner))
+		if !ok {
+			continue
+		}
+
+		fields := strings.SplitN(rest, " ", 3)
+		if len(fields) < 2 {
+			continue
+		}
+
+		key := strings.SplitN(fields[0], "/", 3)
+		if len(key) < 2 {
+			continue
+		}
+
+		externalPort, err := strconv.ParseInt(key[0], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		pm := &portfwd.PortMapping{
+			ExternalPort: int32(externalPort),
+			Protocol:     upnp.Protocol(key[1]),
+			Enabled:      true,
+		}
+		if len(key) > 2 {
+			pm.RemoteHost = key[2]
+		}
+		if len(fields) > 2 {
+			pm.Description = fields[2]
+		}
+
+		for _, e := range rule.Exprs {
+			switch e := e.(type) {
+			case *expr.Immediate:
+				switch e.Register {
+				case 1:
+					pm.InternalClient = net.IP(e.Data)
+				case 2:
+					pm.InternalPort = int32(binaryutil.BigEndian.Uint16(e.Data))
+				}
+			case *expr.Verdict:
+				if e.Kind == expr.VerdictBreak {
+					pm.Enabled = false
+				}
+			}
+		}
+
+		var expires time.Time
+		if fields[1] != expiresNever {
+			unix, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			expires = time.Unix(unix, 0)
+			pm.LeaseDuration = max(time.Until(expires), 0)
+		}
+
+		leases = append(leases, lease{portMapping: pm, expires: expires})
+	}
+
+	return leases, nil
+}
+
+// ensureChains queues the creation of the PortForwarder's
+// table and chains if they do not already exist.
+func (p *PortForwarder) ensureChains() (*nftables.Table, *nftables.Chain, *nftables.Chain) {
+	name := p.Table
+	if name == "" {
+		name = DefaultTable
+	}
+
+	var (
+		table = p.AddTable(&nftables.Table{
+			Name:   name,
+			Family: nftables.TableFamilyINet,
+		})
+		prerouting = p.AddChain(&nftables.Chain{
+			Name:     chainPrerouting,
+			Table:    table,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityNATDest,
+			Type:     nftables.ChainTypeNAT,
+		})
+		forward = p.AddChain(&nftables.Chain{
+			Name:     chainForward,
+			Table:    table,
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityFilter,
+			Type:     nftables.ChainTypeFilter,
+		})
+	)
+
+	return table, prerouting, forward
+}
+
+// delRules queues the deletion of the rules for the given PortMapping. If
+// its InternalClient is known, only the rules of its IP family are deleted,
+// as IPv4 and IPv6 port mappings may share a PortMappingKey.
+func (p *PortForwarder) delRules(table *nftables.Table, pm *portfwd.PortMapping) error {
+	// Make sure that the table and chains exist before getting their rules.
+	if err := p.Flush(); err != nil {
+		return err
+	}
+
+	prefix := p.commentPrefix(pm)
+
+	for _, chain := range []string{chainPrerouting, chainForward} {
+		rules, err := p.GetRules(table, &nftables.Chain{Name: chain, Table: table})
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range rules {
+			if comment, _ := userdata.GetString(rule.UserData, userdata.TypeComment); strings.HasPrefix(comment, prefix) && (pm.InternalClient == nil || ruleNFProto(rule) == nfprotoOf(pm.InternalClient)) {
+				if err := p.DelRule(rule); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// commentPrefix identifies the rules for a PortMapping
+// by its owner and the PortMappingKey.
+func (p *PortForwarder) commentPrefix(pm *portfwd.PortMapping) string {
+	return upnp.OwnerMarker(p.Owner) + pm.Key().String() + " "
+}
+
+// nfprotoOf returns the nfproto of the given IP address's family.
+func nfprotoOf(ip net.IP) byte {
+	if ip.To4() != nil {
+		return unix.NFPROTO_IPV4
+	}
+
+	return unix.NFPROTO_IPV6
+}
+
+// ruleNFProto returns the nfproto that the given rule matches, if any.
+func ruleNFProto(rule *nftables.Rule) byte {
+	for i, e := range rule.Exprs {
+		if meta, ok := e.(*expr.Meta); ok && meta.Key == expr.MetaKeyNFPROTO && i+1 < len(rule.Exprs) {
+			if cmp, ok := rule.Exprs[i+1].(*expr.Cmp); ok && len(cmp.Data) == 1 {
+				return cmp.Data[0]
+			}
+		}
+	}
+
+	return 0
+}
+
+func l4proto(protocol upnp.Protocol) (byte, error) {
+	switch protocol {
+	case upnp.ProtocolTCP:
+		return unix.IPPROTO_TCP, nil
+	case upnp.ProtocolUDP:
+		return unix.IPPROTO_UDP, nil
+	}
+
+	return 0, fmt.Errorf("unsupported protocol %s", protocol)
+}
+
+// matchAddr returns expressions matching the given source
+// or destination address in the network header.
+func matchAddr(nfproto byte, destination bool, addr net.IP) []expr.Any {
+	var offset, length uint32 = 12, 4
+	if nfproto == unix.NFPROTO_IPV6 {
+		offset, length = 8, 16
+	}
+	if destination {
+		offset += length
+	}
+
+	if length == 4 {
+		addr = addr.To4()
+	} else {
+		addr = addr.To16()
+	}
+
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+	}
+}
+
+// ifname returns the given interface name as nftables compares it.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name+"\x00")
+	return b
+}
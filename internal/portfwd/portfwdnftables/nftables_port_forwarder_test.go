@@ -0,0 +1,270 @@
+package portfwdnftables_test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdnftables"
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	newRuleHeaderType = netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_NEWRULE)
+	delRuleHeaderType = netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_DELRULE)
+	getRuleHeaderType = netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETRULE)
+)
+
+// fakeNetfilter is a stand-in for the kernel's nftables netlink API which,
+// like the kernel, gives each rule a handle and returns rules as it was given
+// them, so that they are read back as they would be from the kernel.
+type fakeNetfilter struct {
+	mu sync.Mutex
+	// rules holds the data of each rule's message by chain.
+	rules  map[string][][]byte
+	handle uint64
+}
+
+func (f *fakeNetfilter) dial(req []netlink.Message) ([]netlink.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, msg := range req {
+		var (
+			chain, handle = ruleChainAndHandle(msg)
+			rules         = f.rules[chain]
+		)
+		switch msg.Header.Type {
+		case newRuleHeaderType:
+			f.handle++
+			attr, _ := netlink.MarshalAttributes([]netlink.Attribute{{Type: unix.NFTA_RULE_HANDLE, Data: binaryutil.BigEndian.PutUint64(f.handle)}})
+			f.rules[chain] = append(rules, append(append([]byte{}, msg.Data...), attr...))
+		case delRuleHeaderType:
+			for i, rule := range rules {
+				if _, h := ruleChainAndHandle(netlink.Message{Data: rule}); h == handle {
+					f.rules[chain] = append(rules[:i:i], rules[i+1:]...)
+				}
+			}
+		case getRuleHeaderType:
+			res := []netlink.Message{}
+			for _, rule := range rules {
+				res = append(res, netlink.Message{Header: netlink.Header{Type: newRuleHeaderType, Flags: netlink.Multi}, Data: rule})
+			}
+
+			return append(res, netlink.Message{Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi}, Data: make([]byte, 4)}), nil
+		}
+	}
+
+	// Acknowledge batches by echoing them.
+	return req, nil
+}
+
+// ruleChainAndHandle returns the table and chain, as "<table> <chain>",
+// and the handle, if any, of the rule that the given message is about.
+func ruleChainAndHandle(msg netlink.Message) (string, uint64) {
+	if len(msg.Data) < 4 {
+		return "", 0
+	}
+
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		return "", 0
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	var (
+		table, chain string
+		handle       uint64
+	)
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_RULE_TABLE:
+			table = ad.String()
+		case unix.NFTA_RULE_CHAIN:
+			chain = ad.String()
+		case unix.NFTA_RULE_HANDLE:
+			handle = ad.Uint64()
+		}
+	}
+
+	return table + " " + chain, handle
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx        = t.Context()
+		netfilter  = &fakeNetfilter{rules: map[string][][]byte{}}
+		conn, err  = nftables.New(nftables.WithTestDial(netfilter.dial))
+		table      = &nftables.Table{Name: portfwdnftables.DefaultTable, Family: nftables.TableFamilyINet}
+		prerouting = &nftables.Chain{Name: "prerouting", Table: table}
+		forward    = &nftables.Chain{Name: "forward", Table: table}
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		portForwarder = &portfwdnftables.PortForwarder{
+			Conn:        conn,
+			InInterface: "eth0",
+			Owner:       "test",
+		}
+		pm = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 0, 10),
+			Enabled:        true,
+			LeaseDuration:  time.Hour,
+			Service:        "default/web:http",
+		}
+		pm6 = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.ParseIP("2001:db8::10"),
+			Enabled:        true,
+			Service:        "default/web:http",
+		}
+	)
+
+	// Someone else's rule and an owned rule with a comment that cannot be parsed.
+	for _, comment := range []string{"[other] 8080/TCP never", "[test] garbage"} {
+		conn.AddRule(&nftables.Rule{
+			Table:    table,
+			Chain:    prerouting,
+			Exprs:    []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+			UserData: userdata.AppendString(nil, userdata.TypeComment, comment),
+		})
+	}
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	rules, err := conn.GetRules(table, prerouting)
+	if err != nil {
+		t.Fatalf("get rules: %v", err)
+	}
+
+	if len(rules) != 3 {
+		t.Fatalf("expected a DNAT rule to be added, got %d rules", len(rules))
+	}
+
+	var (
+		dnat      = rules[2]
+		nat       *expr.NAT
+		addr, prt []byte
+	)
+	for _, e := range dnat.Exprs {
+		switch e := e.(type) {
+		case *expr.NAT:
+			nat = e
+		case *expr.Immediate:
+			switch e.Register {
+			case 1:
+				addr = e.Data
+			case 2:
+				prt = e.Data
+			}
+		case *expr.Verdict:
+			t.Fatalf("expected no verdict in an enabled DNAT rule, got %v", dnat.Exprs)
+		}
+	}
+
+	if nat == nil || nat.Type != expr.NATTypeDestNAT || nat.Family != unix.NFPROTO_IPV4 || !net.IP(addr).Equal(pm.InternalClient) || binaryutil.BigEndian.Uint16(prt) != 80 {
+		t.Fatalf("unexpected DNAT rule %v", dnat.Exprs)
+	}
+
+	if comment, _ := userdata.GetString(dnat.UserData, userdata.TypeComment); !strings.HasPrefix(comment, "[test] 8080/TCP ") {
+		t.Fatalf("unexpected comment %q", comment)
+	}
+
+	owned, err := portForwarder.ListPortMappings(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(owned) != 1 || owned[0].Key() != pm.Key() || !owned[0].InternalClient.Equal(pm.InternalClient) || owned[0].InternalPort != 80 || !owned[0].Enabled || owned[0].Description != "default/web:http" {
+		t.Fatalf("expected to list the owned rule, got %v", owned)
+	}
+
+	if owned[0].LeaseDuration <= 0 || owned[0].LeaseDuration > time.Hour {
+		t.Fatalf("expected the lease to be listed, got %s", owned[0].LeaseDuration)
+	}
+
+	// Disabled rules are kept, but must stop being evaluated before they match.
+	pm.Enabled = false
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+
+	for _, chain := range []*nftables.Chain{prerouting, forward} {
+		rules, err := conn.GetRules(table, chain)
+		if err != nil {
+			t.Fatalf("get rules: %v", err)
+		}
+
+		rule := rules[len(rules)-1]
+		if verdict, ok := rule.Exprs[0].(*expr.Verdict); !ok || verdict.Kind != expr.VerdictBreak {
+			t.Fatalf("expected disabled rule in %s to start with a break verdict, got %v", chain.Name, rule.Exprs)
+		}
+	}
+
+	if owned, err := portForwarder.ListPortMappings(ctx); err != nil || len(owned) != 1 || owned[0].Enabled {
+		t.Fatalf("expected to list the disabled rule, got %v, %v", owned, err)
+	}
+
+	// The IPv4 and IPv6 port mappings share a PortMappingKey but must not replace each other.
+	if err := portForwarder.AddPortMapping(ctx, pm6); err != nil {
+		t.Fatalf("add IPv6: %v", err)
+	}
+
+	if owned, err := portForwarder.ListPortMappings(ctx); err != nil || len(owned) != 2 {
+		t.Fatalf("expected to list the IPv4 and IPv6 rules, got %v, %v", owned, err)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm6); err != nil {
+		t.Fatalf("delete IPv6: %v", err)
+	}
+
+	if owned, err := portForwarder.ListPortMappings(ctx); err != nil || len(owned) != 1 || owned[0].InternalClient.To4() == nil {
+		t.Fatalf("expected only the IPv6 rule to be deleted, got %v, %v", owned, err)
+	}
+
+	// A lease that has already run out is expired.
+	pm.LeaseDuration = time.Nanosecond
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	expired, err := portForwarder.ExpireLeases(ctx)
+	if err != nil {
+		t.Fatalf("expire leases: %v", err)
+	}
+
+	if len(expired) != 1 || expired[0].Key() != pm.Key() {
+		t.Fatalf("expected the lease to expire, got %v", expired)
+	}
+
+	for _, chain := range []*nftables.Chain{prerouting, forward} {
+		rules, err := conn.GetRules(table, chain)
+		if err != nil {
+			t.Fatalf("get rules: %v", err)
+		}
+
+		if want := map[string]int{"prerouting": 2, "forward": 0}[chain.Name]; len(rules) != want {
+			t.Fatalf("expected only the rules that are not owned to remain in %s, got %d rules", chain.Name, len(rules))
+		}
+	}
+}
@@ -0,0 +1,3 @@
+// package portfwdopenwrt provides an implementation of portfwd.PortForwarder
+// that manages firewall redirect sections with UCI via OpenWrt's ubus.
+package portfwdopenwrt
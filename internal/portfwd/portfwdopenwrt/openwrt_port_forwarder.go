@@ -0,0 +1,238 @@
+package portfwdopenwrt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/ubus"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+const (
+	// DefaultSourceZone is the firewall zone that port forwards are made from by default.
+	DefaultSourceZone = "wan"
+	// DefaultDestinationZone is the firewall zone that port forwards are made to by default.
+	DefaultDestinationZone = "lan"
+)
+
+const (
+	configFirewall      = "firewall"
+	sectionTypeRedirect = "redirect"
+)
+
+// PortForwarder implements portfwd.PortForwarder by managing a firewall redirect
+// section for each PortMapping. Changes are committed, so they survive a reboot,
+// and the firewall is reloaded to apply them. The sections are named after the
+// Owner, the IP family and the PortMappingKey, which is how ownership is recorded. OpenWrt
+// redirects are permanent, so LeaseDuration is ignored.
+type PortForwarder struct {
+	*ubus.Client
+	// SourceZone is the firewall zone to port forward from.
+	// Defaults to DefaultSourceZone.
+	SourceZone string
+	// DestinationZone is the firewall zone to port forward to.
+	// Defaults to DefaultDestinationZone.
+	DestinationZone string
+	// Owner marks sections as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+}
+
+var _ portfwd.ListingPortForwarder = &PortForwarder{}
+
+// AddPortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		section = p.sectionName(pm)
+		family  = "ipv4"
+		enabled = "0"
+		values  = map[string]string{
+			"name":      strings.TrimSpace(upnp.OwnerMarker(p.Owner) + pm.Service + " " + pm.Description),
+			"target":    "DNAT",
+			"src":       p.sourceZone(),
+			"src_dport": fmt.Sprint(pm.ExternalPort),
+			"dest":      p.destinationZone(),
+			"dest_ip":   pm.InternalClient.String(),
+			"dest_port": fmt.Sprint(pm.InternalPort),
+			"proto":     strings.ToLower(string(pm.Protocol)),
+		}
+	)
+	if pm.InternalClient.To4() == nil {
+		family = "ipv6"
+	}
+	values["family"] = family
+	if pm.Enabled {
+		enabled = "1"
+	}
+	values["enabled"] = enabled
+	if pm.RemoteHost != "" {
+		values["src_ip"] = pm.RemoteHost
+	}
+
+	sections, err := p.UCIGet(ctx, configFirewall, sectionTypeRedirect)
+	if err != nil {
+		return err
+	}
+
+	if existing, ok := sections[section]; ok {
+		// Renewing an unchanged section must not reload the firewall.
+		if isSameSection(existing, values) {
+			return nil
+		}
+
+		if err := p.UCISet(ctx, configFirewall, section, values); err != nil {
+			return err
+		}
+	} else if err := p.UCIAdd(ctx, configFirewall, sectionTypeRedirect, section, values); err != nil {
+		return err
+	}
+
+	return p.apply(ctx)
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	section := p.sectionName(pm)
+
+	sections, err := p.UCIGet(ctx, configFirewall, sectionTypeRedirect)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sections[section]; !ok {
+		return nil
+	}
+
+	if err := p.UCIDelete(ctx, configFirewall, section); err != nil {
+		return err
+	}
+
+	return p.apply(ctx)
+}
+
+// ListPortMappings implements portfwd.ListingPortForwarder. The owner marker
+// is removed from the returned port mappings' descriptions.
+func (p *PortForwarder) ListPortMappings(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	sections, err := p.UCIGet(ctx, configFirewall, sectionTypeRedirect)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		owned        = regexp.MustCompile("^" + regexp.QuoteMeta(sanitize(p.Owner)) + `_(ipv6_)?\d+_(tcp|udp)(_\w+)?$`)
+		portMappings = []*portfwd.PortMapping{}
+	)
+	for name, section := range sections {
+		if !owned.MatchString(name) {
+			continue
+		}
+
+		externalPort, err := strconv.ParseInt(option(section, "src_dport"), 10, 32)
+		if err != nil {
+			continue
+		}
+
+		internalPort := externalPort
+		if destPort := option(section, "dest_port"); destPort != "" {
+			if internalPort, err = strconv.ParseInt(destPort, 10, 32); err != nil {
+				continue
+			}
+		}
+
+		portMappings = append(portMappings, &portfwd.PortMapping{
+			RemoteHost:     option(section, "src_ip"),
+			ExternalPort:   int32(externalPort),
+			Protocol:       upnp.Protocol(strings.ToUpper(option(section, "proto"))),
+			InternalPort:   int32(internalPort),
+			InternalClient: net.ParseIP(option(section, "dest_ip")),
+			Enabled:        option(section, "enabled") != "0",
+			Description:    strings.TrimPrefix(option(section, "name"), upnp.OwnerMarker(p.Owner)),
+		})
+	}
+
+	return portMappings, nil
+}
+
+// apply commits the firewall config so that it survives
+// a reboot and reloads the firewall so that it takes effect.
+func (p *PortForwarder) apply(ctx context.Context) error {
+	if err := p.UCICommit(ctx, configFirewall); err != nil {
+		return err
+	}
+
+	return p.RCInit(ctx, configFirewall, "reload")
+}
+
+func (p *PortForwarder) sourceZone() string {
+	if p.SourceZone == "" {
+		return DefaultSourceZone
+	}
+
+	return p.SourceZone
+}
+
+func (p *PortForwarder) destinationZone() string {
+	if p.DestinationZone == "" {
+		return DefaultDestinationZone
+	}
+
+	return p.DestinationZone
+}
+
+// sectionName identifies the section for a PortMapping by its owner, its IP
+// family and the PortMappingKey, e.g. portfwd_8080_tcp, portfwd_ipv6_8080_tcp or
+// portfwd_8080_tcp_203_0_113_1, so that the IPv4 and IPv6 port mappings of a
+// dual-stack Service, which share a PortMappingKey, do not overwrite each other.
+func (p *PortForwarder) sectionName(pm *portfwd.PortMapping) string {
+	family := ""
+	if pm.InternalClient != nil && pm.InternalClient.To4() == nil {
+		family = "ipv6_"
+	}
+
+	name := fmt.Sprintf("%s_%s%d_%s", sanitize(p.Owner), family, pm.ExternalPort, strings.ToLower(string(pm.Protocol)))
+	if pm.RemoteHost != "" {
+		name += "_" + sanitize(pm.RemoteHost)
+	}
+
+	return name
+}
+
+var unsafe = regexp.MustCompile(`\W`)
+
+// sanitize makes s safe for use in a UCI section name,
+// which may only contain alphanumerics and underscores.
+func sanitize(s string) string {
+	return unsafe.ReplaceAllString(s, "_")
+}
+
+// isSameSection reports whether the given section already has the given values.
+func isSameSection(section map[string]any, values map[string]string) bool {
+	for name, value := range values {
+		if option(section, name) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// option returns the given option of the given section as a string.
+func option(section map[string]any, name string) string {
+	if value, ok := section[name].(string); ok {
+		return value
+	}
+
+	return ""
+}
@@ -0,0 +1,229 @@
+package portfwdopenwrt_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdopenwrt"
+	"github.com/frantjc/port-forward/internal/ubus"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// fakeUbus is a stand-in for rpcd's JSON-RPC interface which only knows
+// about the firewall config and does not stage changes per session.
+type fakeUbus struct {
+	mu        sync.Mutex
+	sessions  int
+	session   string
+	redirects map[string]map[string]any
+	committed int
+	reloaded  int
+}
+
+func (f *fakeUbus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	req := &struct {
+		Params []json.RawMessage `json:"params"`
+	}{}
+	_ = json.NewDecoder(r.Body).Decode(req)
+
+	var (
+		session, object, method string
+		args                    = struct {
+			Section  string            `json:"section"`
+			Name     string            `json:"name"`
+			Values   map[string]string `json:"values"`
+			Username string            `json:"username"`
+		}{}
+	)
+	_ = json.Unmarshal(req.Params[0], &session)
+	_ = json.Unmarshal(req.Params[1], &object)
+	_ = json.Unmarshal(req.Params[2], &method)
+	_ = json.Unmarshal(req.Params[3], &args)
+
+	result := func(status ubus.Status, data any) {
+		res := []any{status}
+		if data != nil {
+			res = append(res, data)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": 1, "result": res})
+	}
+
+	if object == "session" && method == "login" {
+		if args.Username != "root" {
+			result(ubus.StatusPermissionDenied, nil)
+			return
+		}
+
+		f.sessions++
+		f.session = fmt.Sprint("session", f.sessions)
+		result(ubus.StatusOK, map[string]any{"ubus_rpc_session": f.session})
+		return
+	}
+
+	if session != f.session {
+		_ = json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": 1, "error": map[string]any{"code": -32002, "message": "Access denied"}})
+		return
+	}
+
+	switch object + " " + method {
+	case "uci get":
+		result(ubus.StatusOK, map[string]any{"values": f.redirects})
+	case "uci add":
+		section := map[string]any{".type": "redirect"}
+		for k, v := range args.Values {
+			section[k] = v
+		}
+		f.redirects[args.Name] = section
+		result(ubus.StatusOK, map[string]any{"section": args.Name})
+	case "uci set":
+		if _, ok := f.redirects[args.Section]; !ok {
+			result(ubus.StatusNotFound, nil)
+			return
+		}
+		for k, v := range args.Values {
+			f.redirects[args.Section][k] = v
+		}
+		result(ubus.StatusOK, nil)
+	case "uci delete":
+		if _, ok := f.redirects[args.Section]; !ok {
+			result(ubus.StatusNotFound, nil)
+			return
+		}
+		delete(f.redirects, args.Section)
+		result(ubus.StatusOK, nil)
+	case "uci commit":
+		f.committed++
+		result(ubus.StatusOK, nil)
+	case "rc init":
+		f.reloaded++
+		result(ubus.StatusOK, nil)
+	default:
+		result(ubus.StatusMethodNotFound, nil)
+	}
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx  = t.Context()
+		fake = &fakeUbus{
+			redirects: map[string]map[string]any{
+				"cfg0a1b2c": {".type": "redirect", "src_dport": "22", "proto": "tcp", "dest_ip": "192.168.1.2"},
+			},
+		}
+		server = httptest.NewServer(fake)
+	)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		portForwarder = &portfwdopenwrt.PortForwarder{
+			Client: &ubus.Client{
+				URL:      serverURL,
+				Username: "root",
+				Password: "password",
+			},
+			Owner: "test",
+		}
+		pm = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 1, 10),
+			Enabled:        true,
+			Service:        "default/web:http",
+		}
+	)
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	redirect, ok := fake.redirects["test_8080_tcp"]
+	if !ok {
+		t.Fatalf("expected redirect test_8080_tcp to be added, got %v", fake.redirects)
+	}
+
+	if redirect["dest_ip"] != "192.168.1.10" || redirect["dest_port"] != "80" || redirect["src"] != "wan" || redirect["target"] != "DNAT" {
+		t.Fatalf("unexpected redirect %v", redirect)
+	}
+
+	if fake.committed != 1 || fake.reloaded != 1 {
+		t.Fatalf("expected firewall to be committed and reloaded, got %d and %d", fake.committed, fake.reloaded)
+	}
+
+	// Expire the session to check that the Client logs in again.
+	fake.session = "expired"
+
+	pm.InternalClient = net.IPv4(192, 168, 1, 11)
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if fake.sessions != 2 {
+		t.Fatalf("expected to log in again, logged in %d times", fake.sessions)
+	}
+
+	if len(fake.redirects) != 2 || fake.redirects["test_8080_tcp"]["dest_ip"] != "192.168.1.11" {
+		t.Fatalf("expected redirect to be updated in place, got %v", fake.redirects)
+	}
+
+	// Renewing an unchanged redirect must not reload the firewall.
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	if fake.committed != 2 || fake.reloaded != 2 {
+		t.Fatalf("expected renewal not to commit or reload, got %d commits and %d reloads", fake.committed, fake.reloaded)
+	}
+
+	// The IPv4 and IPv6 port mappings of a dual-stack Service share a
+	// PortMappingKey but must not overwrite each other.
+	pm6 := *pm
+	pm6.InternalClient = net.ParseIP("2001:db8::11")
+	if err := portForwarder.AddPortMapping(ctx, &pm6); err != nil {
+		t.Fatalf("add IPv6: %v", err)
+	}
+
+	if fake.redirects["test_ipv6_8080_tcp"]["family"] != "ipv6" || fake.redirects["test_8080_tcp"]["family"] != "ipv4" {
+		t.Fatalf("expected separate IPv4 and IPv6 redirects, got %v", fake.redirects)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, &pm6); err != nil {
+		t.Fatalf("delete IPv6: %v", err)
+	}
+
+	owned, err := portForwarder.ListPortMappings(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(owned) != 1 || owned[0].Key() != pm.Key() || owned[0].Description != "default/web:http" {
+		t.Fatalf("expected to list the owned redirect, got %v", owned)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, ok := fake.redirects["cfg0a1b2c"]; len(fake.redirects) != 1 || !ok {
+		t.Fatalf("expected only someone else's redirect to remain, got %v", fake.redirects)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete absent: %v", err)
+	}
+}
@@ -0,0 +1,3 @@
+// package portfwdopnsense provides an implementation of portfwd.PortForwarder
+// that manages destination NAT and filter rules via the OPNsense REST API.
+package portfwdopnsense
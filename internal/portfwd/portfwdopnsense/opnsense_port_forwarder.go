@@ -0,0 +1,231 @@
+package portfwdopnsense
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/frantjc/port-forward/internal/opnsense"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// DefaultInterface is the OPNsense interface that port forwards are made on by default.
+const DefaultInterface = "wan"
+
+// PortForwarder implements portfwd.PortForwarder by managing a destination NAT
+// rule and a linked filter rule that passes its traffic for each PortMapping.
+// OPNsense rules are permanent, so LeaseDuration is ignored.
+type PortForwarder struct {
+	*opnsense.Client
+	// Interface is the OPNsense interface to port forward on.
+	// Defaults to DefaultInterface.
+	Interface string
+	// Owner marks rules as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+}
+
+var _ portfwd.PortForwarder = &PortForwarder{}
+
+// AddPortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		iface       = p.iface()
+		description = p.description(pm)
+		ipProtocol  = "inet"
+		enabled     = "0"
+		sourceNet   = "any"
+	)
+	if pm.InternalClient.To4() == nil {
+		ipProtocol = "inet6"
+	}
+	if pm.Enabled {
+		enabled = "1"
+	}
+	if pm.RemoteHost != "" {
+		sourceNet = pm.RemoteHost
+	}
+
+	for _, rule := range []struct {
+		controller string
+		rule       *opnsense.Rule
+	}{
+		{
+			controller: opnsense.ControllerDestinationNAT,
+			rule: &opnsense.Rule{
+				Enabled:         enabled,
+				Interface:       iface,
+				IPProtocol:      ipProtocol,
+				Protocol:        strings.ToLower(string(pm.Protocol)),
+				SourceNet:       sourceNet,
+				DestinationNet:  iface + "ip",
+				DestinationPort: fmt.Sprint(pm.ExternalPort),
+				Target:          pm.InternalClient.String(),
+				LocalPort:       fmt.Sprint(pm.InternalPort),
+				Description:     description,
+			},
+		},
+		{
+			controller: opnsense.ControllerFilter,
+			rule: &opnsense.Rule{
+				Enabled:         enabled,
+				Action:          "pass",
+				Direction:       "in",
+				Interface:       iface,
+				IPProtocol:      ipProtocol,
+				Protocol:        strings.ToLower(string(pm.Protocol)),
+				SourceNet:       sourceNet,
+				DestinationNet:  pm.InternalClient.String(),
+				DestinationPort: fmt.Sprint(pm.InternalPort),
+				Description:     description,
+			},
+		},
+	} {
+		existing, err := p.searchRules(ctx, rule.controller, pm)
+		if err != nil {
+			return err
+		}
+
+		if len(existing) == 1 {
+			// Renewing an unchanged rule must not reload the firewall. Searched
+			// rules' fields are formatted for display, so get it to compare it.
+			current, err := p.GetRule(ctx, rule.controller, existing[0].UUID)
+			if err != nil {
+				return err
+			}
+
+			if isSameRule(current, rule.rule) {
+				continue
+			}
+		}
+
+		if len(existing) == 0 {
+			if _, err := p.AddRule(ctx, rule.controller, rule.rule); err != nil {
+				return err
+			}
+		} else {
+			if err := p.SetRule(ctx, rule.controller, existing[0].UUID, rule.rule); err != nil {
+				return err
+			}
+
+			// Remove any duplicates, e.g. from a previous partial failure.
+			for _, dup := range existing[1:] {
+				if err := p.DelRule(ctx, rule.controller, dup.UUID); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := p.Reconfigure(ctx, rule.controller); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Delete the NAT rule first so that traffic stops being forwarded
+	// before the filter rule that lets it through goes away.
+	for _, controller := range []string{opnsense.ControllerDestinationNAT, opnsense.ControllerFilter} {
+		rules, err := p.searchRules(ctx, controller, pm)
+		if err != nil {
+			return err
+		}
+
+		if len(rules) == 0 {
+			continue
+		}
+
+		for _, rule := range rules {
+			if err := p.DelRule(ctx, controller, rule.UUID); err != nil {
+				return err
+			}
+		}
+
+		if err := p.Reconfigure(ctx, controller); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *PortForwarder) iface() string {
+	if p.Interface == "" {
+		return DefaultInterface
+	}
+
+	return p.Interface
+}
+
+// descriptionPrefix identifies the rules for a PortMapping by its owner, its IP
+// family and the PortMappingKey, so that the IPv4 and IPv6 port mappings of a
+// dual-stack Service, which share a PortMappingKey, do not overwrite each other.
+func (p *PortForwarder) descriptionPrefix(pm *portfwd.PortMapping) string {
+	family := ""
+	if pm.InternalClient != nil && pm.InternalClient.To4() == nil {
+		family = "inet6 "
+	}
+
+	return upnp.OwnerMarker(p.Owner) + family + pm.Key().String() + " "
+}
+
+func (p *PortForwarder) description(pm *portfwd.PortMapping) string {
+	return p.descriptionPrefix(pm) + strings.TrimSpace(pm.Service+" "+pm.Description)
+}
+
+// searchRules returns the given controller's rules for the given PortMapping.
+func (p *PortForwarder) searchRules(ctx context.Context, controller string, pm *portfwd.PortMapping) ([]opnsense.Rule, error) {
+	prefix := p.descriptionPrefix(pm)
+
+	rules, err := p.SearchRules(ctx, controller, strings.TrimSpace(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []opnsense.Rule{}
+	for _, rule := range rules {
+		// The search is fuzzy, so check for an exact match.
+		if strings.HasPrefix(rule.Description, prefix) {
+			matches = append(matches, rule)
+		}
+	}
+
+	return matches, nil
+}
+
+// isSameRule reports whether the existing rule, as gotten by
+// opnsense.Client.GetRule, already is the wanted one. OPNsense
+// may key options differently in case, e.g. "TCP" for "tcp", so
+// all fields but the Description are compared case-insensitively.
+func isSameRule(existing, wanted *opnsense.Rule) bool {
+	return normalizeRule(existing, wanted.UUID) == normalizeRule(wanted, wanted.UUID)
+}
+
+func normalizeRule(rule *opnsense.Rule, uuid string) opnsense.Rule {
+	return opnsense.Rule{
+		UUID:            uuid,
+		Enabled:         strings.ToLower(rule.Enabled),
+		Action:          strings.ToLower(rule.Action),
+		Direction:       strings.ToLower(rule.Direction),
+		Interface:       strings.ToLower(rule.Interface),
+		IPProtocol:      strings.ToLower(rule.IPProtocol),
+		Protocol:        strings.ToLower(rule.Protocol),
+		SourceNet:       strings.ToLower(rule.SourceNet),
+		DestinationNet:  strings.ToLower(rule.DestinationNet),
+		DestinationPort: strings.ToLower(rule.DestinationPort),
+		Target:          strings.ToLower(rule.Target),
+		LocalPort:       strings.ToLower(rule.LocalPort),
+		Description:     rule.Description,
+	}
+}
@@ -0,0 +1,296 @@
+package portfwdopnsense_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/opnsense"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdopnsense"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// fakeOPNsense is a stand-in for the OPNsense REST API which, like OPNsense,
+// identifies rules by UUID, searches them fuzzily and formats searched
+// rules for display, but gets them with their options.
+type fakeOPNsense struct {
+	mu    sync.Mutex
+	rules map[string]map[string]opnsense.Rule
+	// sets and applies count set_rule and apply calls per controller.
+	sets, applies map[string]int
+	nextUUID      int
+}
+
+func (f *fakeOPNsense) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key, secret, ok := r.BasicAuth(); !ok || key != "key" || secret != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		rest             = strings.TrimPrefix(r.URL.Path, "/api/")
+		controller, uuid string
+		action           string
+	)
+	for _, c := range []string{opnsense.ControllerDestinationNAT, opnsense.ControllerFilter} {
+		if after, ok := strings.CutPrefix(rest, c+"/"); ok {
+			controller = c
+			action, uuid, _ = strings.Cut(after, "/")
+		}
+	}
+
+	body := struct {
+		Rule         opnsense.Rule `json:"rule"`
+		SearchPhrase string        `json:"searchPhrase"`
+	}{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	rules := f.rules[controller]
+
+	var res any
+	switch action {
+	case "search_rule":
+		rows := []opnsense.Rule{}
+		for _, rule := range rules {
+			if strings.Contains(rule.Description, body.SearchPhrase) {
+				rule.Interface = strings.ToUpper(rule.Interface)
+				rule.IPProtocol = map[string]string{"inet": "IPv4", "inet6": "IPv6"}[rule.IPProtocol]
+				rule.Protocol = strings.ToUpper(rule.Protocol)
+				rows = append(rows, rule)
+			}
+		}
+		res = map[string]any{"rows": rows}
+	case "get_rule":
+		rule, ok := rules[uuid]
+		if !ok {
+			res = []any{}
+			break
+		}
+		res = map[string]any{"rule": map[string]any{
+			"enabled":          rule.Enabled,
+			"action":           options(rule.Action, "pass", "block", "reject"),
+			"direction":        options(rule.Direction, "in", "out"),
+			"interface":        options(rule.Interface, "lan", "wan"),
+			"ipprotocol":       options(rule.IPProtocol, "inet", "inet6"),
+			"protocol":         options(strings.ToUpper(rule.Protocol), "any", "TCP", "UDP"),
+			"source_net":       rule.SourceNet,
+			"destination_net":  rule.DestinationNet,
+			"destination_port": rule.DestinationPort,
+			"target":           rule.Target,
+			"local_port":       rule.LocalPort,
+			"description":      rule.Description,
+		}}
+	case "add_rule":
+		f.nextUUID++
+		body.Rule.UUID = fmt.Sprint(f.nextUUID)
+		rules[body.Rule.UUID] = body.Rule
+		res = map[string]any{"result": "saved", "uuid": body.Rule.UUID}
+	case "set_rule":
+		f.sets[controller]++
+		body.Rule.UUID = uuid
+		rules[uuid] = body.Rule
+		res = map[string]any{"result": "saved"}
+	case "del_rule":
+		if _, ok := rules[uuid]; !ok {
+			res = map[string]any{"result": "not found"}
+			break
+		}
+		delete(rules, uuid)
+		res = map[string]any{"result": "deleted"}
+	case "apply":
+		f.applies[controller]++
+		res = map[string]any{"status": "ok"}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// options formats an OPNsense option field with the given keys.
+func options(selected string, keys ...string) map[string]any {
+	options := map[string]any{}
+	for _, key := range keys {
+		options[key] = map[string]any{"value": strings.ToUpper(key), "selected": map[bool]int{true: 1}[key == selected]}
+	}
+
+	return options
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx  = t.Context()
+		fake = &fakeOPNsense{
+			rules: map[string]map[string]opnsense.Rule{
+				opnsense.ControllerDestinationNAT: {"other": {UUID: "other", Description: "someone else's"}},
+				opnsense.ControllerFilter:         {},
+			},
+			sets:    map[string]int{},
+			applies: map[string]int{},
+		}
+		server = httptest.NewServer(fake)
+	)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		portForwarder = &portfwdopnsense.PortForwarder{
+			Client: &opnsense.Client{
+				URL:    serverURL,
+				Key:    "key",
+				Secret: "secret",
+			},
+			Owner: "test",
+		}
+		pm = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 0, 2),
+			Enabled:        true,
+			Service:        "default/web:http",
+		}
+		pm6 = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.ParseIP("2001:db8::2"),
+			Enabled:        true,
+			Service:        "default/web:http",
+		}
+	)
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	if err := portForwarder.AddPortMapping(ctx, pm6); err != nil {
+		t.Fatalf("add IPv6: %v", err)
+	}
+
+	// The IPv4 and IPv6 port mappings share a PortMappingKey but must not overwrite each other.
+	if n, m := len(fake.rules[opnsense.ControllerDestinationNAT]), len(fake.rules[opnsense.ControllerFilter]); n != 3 || m != 2 {
+		t.Fatalf("expected 2 destination NAT and 2 filter rules to be added, got %d and %d", n-1, m)
+	}
+
+	var nat *opnsense.Rule
+	for _, rule := range fake.rules[opnsense.ControllerDestinationNAT] {
+		if rule.IPProtocol == "inet" {
+			nat = &rule
+		}
+	}
+
+	if nat == nil || nat.Target != "192.168.0.2" || nat.LocalPort != "80" || nat.DestinationPort != "8080" || nat.Protocol != "tcp" || nat.Enabled != "1" {
+		t.Fatalf("unexpected destination NAT rule %+v", nat)
+	}
+
+	if want := "[test] 8080/TCP default/web:http"; nat.Description != want {
+		t.Fatalf("expected description %q, got %q", want, nat.Description)
+	}
+
+	// Renewing unchanged port mappings must not touch the firewall.
+	applies := fake.applies[opnsense.ControllerDestinationNAT] + fake.applies[opnsense.ControllerFilter]
+
+	for _, pm := range []*portfwd.PortMapping{pm, pm6} {
+		if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+			t.Fatalf("renew: %v", err)
+		}
+	}
+
+	if sets, renewApplies := fake.sets[opnsense.ControllerDestinationNAT]+fake.sets[opnsense.ControllerFilter], fake.applies[opnsense.ControllerDestinationNAT]+fake.applies[opnsense.ControllerFilter]-applies; sets != 0 || renewApplies != 0 {
+		t.Fatalf("expected renewals to change nothing, got %d set_rule and %d apply calls", sets, renewApplies)
+	}
+
+	pm.InternalClient = net.IPv4(192, 168, 0, 3)
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if sets := fake.sets[opnsense.ControllerDestinationNAT] + fake.sets[opnsense.ControllerFilter]; sets != 2 {
+		t.Fatalf("expected both rules to be updated in place, got %d set_rule calls", sets)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm6); err != nil {
+		t.Fatalf("delete IPv6: %v", err)
+	}
+
+	if n, m := len(fake.rules[opnsense.ControllerDestinationNAT]), len(fake.rules[opnsense.ControllerFilter]); n != 2 || m != 1 {
+		t.Fatalf("expected only the IPv6 rules to be deleted, got %d destination NAT and %d filter rules", n-1, m)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, ok := fake.rules[opnsense.ControllerDestinationNAT]["other"]; !ok || len(fake.rules[opnsense.ControllerDestinationNAT]) != 1 || len(fake.rules[opnsense.ControllerFilter]) != 0 {
+		t.Fatalf("expected only someone else's rule to remain, got %v", fake.rules)
+	}
+}
+
+// Responses of OPNsense to search_rule and get_rule for the
+// rules of the same port mapping, keyed by controller.
+var (
+	searchRuleFixtures = map[string]string{
+		opnsense.ControllerDestinationNAT: `{"total":1,"rowCount":1,"current":1,"rows":[{"uuid":"5b9e7a4c-0d1f-4c3e-9a77-2f3b8c6d1e01","enabled":"1","interface":"WAN","ipprotocol":"IPv4","protocol":"TCP","source_net":"any","destination_net":"WAN address","destination_port":"8080","target":"192.168.0.2","local_port":"80","description":"[test] 8080/TCP default/web:http"}]}`,
+		opnsense.ControllerFilter:         `{"total":1,"rowCount":1,"current":1,"rows":[{"uuid":"7c1d2e3f-4a5b-4c6d-8e9f-0a1b2c3d4e02","enabled":"1","action":"Pass","direction":"In","interface":"WAN","ipprotocol":"IPv4","protocol":"TCP","source_net":"any","destination_net":"192.168.0.2","destination_port":"80","description":"[test] 8080/TCP default/web:http"}]}`,
+	}
+	getRuleFixtures = map[string]string{
+		opnsense.ControllerDestinationNAT: `{"rule":{"enabled":"1","interface":{"lan":{"value":"LAN","selected":0},"wan":{"value":"WAN","selected":1}},"ipprotocol":{"inet":{"value":"IPv4","selected":1},"inet6":{"value":"IPv6","selected":0}},"protocol":{"any":{"value":"any","selected":0},"TCP":{"value":"TCP","selected":1},"UDP":{"value":"UDP","selected":0}},"source_net":"any","destination_net":"wanip","destination_port":"8080","target":"192.168.0.2","local_port":"80","description":"[test] 8080/TCP default/web:http","sequence":"1"}}`,
+		opnsense.ControllerFilter:         `{"rule":{"enabled":"1","action":{"pass":{"value":"Pass","selected":1},"block":{"value":"Block","selected":0},"reject":{"value":"Reject","selected":0}},"direction":{"in":{"value":"In","selected":1},"out":{"value":"Out","selected":0}},"interface":{"lan":{"value":"LAN","selected":0},"wan":{"value":"WAN","selected":1}},"ipprotocol":{"inet":{"value":"IPv4","selected":1},"inet6":{"value":"IPv6","selected":0}},"protocol":{"any":{"value":"any","selected":0},"TCP":{"value":"TCP","selected":1},"UDP":{"value":"UDP","selected":0}},"source_net":"any","destination_net":"192.168.0.2","destination_port":"80","description":"[test] 8080/TCP default/web:http","sequence":"1"}}`,
+	}
+)
+
+func TestPortForwarderRenewUnchanged(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for controller, fixture := range searchRuleFixtures {
+			switch {
+			case r.URL.Path == "/api/"+controller+"/search_rule":
+				_, _ = w.Write([]byte(fixture))
+				return
+			case strings.HasPrefix(r.URL.Path, "/api/"+controller+"/get_rule/"):
+				_, _ = w.Write([]byte(getRuleFixtures[controller]))
+				return
+			}
+		}
+
+		t.Errorf("expected renewing an unchanged port mapping to only search and get rules, got %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	portForwarder := &portfwdopnsense.PortForwarder{
+		Client: &opnsense.Client{URL: serverURL},
+		Owner:  "test",
+	}
+
+	if err := portForwarder.AddPortMapping(t.Context(), &portfwd.PortMapping{
+		ExternalPort:   8080,
+		Protocol:       upnp.ProtocolTCP,
+		InternalPort:   80,
+		InternalClient: net.IPv4(192, 168, 0, 2),
+		Enabled:        true,
+		Service:        "default/web:http",
+	}); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+}
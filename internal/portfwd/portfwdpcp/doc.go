@@ -0,0 +1,3 @@
+// package portfwdpcp provides an implementation of portfwd.PortForwarder
+// that uses PCP with the THIRD_PARTY option.
+package portfwdpcp
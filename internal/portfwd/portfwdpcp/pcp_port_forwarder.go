@@ -0,0 +1,119 @@
+package portfwdpcp
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/pcp"
+	"github.com/frantjc/port-forward/internal/portfwd"
+)
+
+// DefaultLeaseDuration is the lease duration requested for port mappings
+// that ask for a permanent lease, which PCP does not support.
+const DefaultLeaseDuration = 2 * time.Hour
+
+// PortForwarder implements portfwd.PortForwarder using PCP. Unlike NAT-PMP and
+// UPnP, it does not need to masquerade as the InternalClient because the
+// THIRD_PARTY option allows it to request mappings on the InternalClient's behalf.
+//
+// Each mapping is added with a random nonce, which is written back to the
+// PortMapping's Nonce so that the mapping can be renewed and deleted by it.
+type PortForwarder struct {
+	*pcp.Client
+}
+
+var _ portfwd.PortForwarder = &PortForwarder{}
+
+// AddPortMapping implements portfwd.PortForwarder. The lease duration, external
+// port and external IP address assigned by the PCP server are written back to
+// the PortMapping.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if !pm.Enabled {
+		return p.DeletePortMapping(ctx, pm)
+	}
+
+	leaseDuration := pm.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = DefaultLeaseDuration
+	}
+
+	nonce, ok := recordedNonce(pm)
+	if !ok {
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return err
+		}
+	}
+
+	req, err := p.mapRequest(pm, nonce, leaseDuration)
+	if err != nil {
+		return err
+	}
+
+	mapping, err := p.Map(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	pm.Nonce = nonce[:]
+	pm.LeaseDuration = mapping.Lifetime
+	if externalPort := int32(mapping.ExternalPort); externalPort != pm.ExternalPort {
+		pm.AssignedExternalPort = externalPort
+	}
+	pm.AssignedExternalIPAddress = mapping.ExternalIPAddress
+
+	return nil
+}
+
+// DeletePortMapping implements portfwd.PortForwarder. A mapping
+// without a recorded Nonce cannot be deleted, so it is left to expire.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	nonce, ok := recordedNonce(pm)
+	if !ok {
+		return nil
+	}
+
+	req, err := p.mapRequest(pm, nonce, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.Map(ctx, req)
+	return err
+}
+
+func (p *PortForwarder) mapRequest(pm *portfwd.PortMapping, nonce pcp.Nonce, lifetime time.Duration) (*pcp.MapRequest, error) {
+	if pm.InternalClient == nil {
+		return nil, fmt.Errorf("internal client is required")
+	}
+
+	var remotePeer net.IP
+	if pm.RemoteHost != "" {
+		if remotePeer = net.ParseIP(pm.RemoteHost); remotePeer == nil {
+			return nil, fmt.Errorf("PCP requires remote host to be an IP address: %s", pm.RemoteHost)
+		}
+	}
+
+	return &pcp.MapRequest{
+		Nonce:                 nonce,
+		Protocol:              pm.Protocol,
+		InternalPort:          uint16(pm.InternalPort),
+		SuggestedExternalPort: uint16(pm.ExternalPort),
+		Lifetime:              lifetime,
+		ThirdParty:            pm.InternalClient,
+		RemotePeer:            remotePeer,
+	}, nil
+}
+
+// recordedNonce returns the nonce that the PortMapping was added with, if any.
+func recordedNonce(pm *portfwd.PortMapping) (pcp.Nonce, bool) {
+	nonce := pcp.Nonce{}
+	if len(pm.Nonce) != len(nonce) {
+		return nonce, false
+	}
+
+	copy(nonce[:], pm.Nonce)
+	return nonce, true
+}
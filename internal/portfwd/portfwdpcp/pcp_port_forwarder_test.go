@@ -0,0 +1,150 @@
+package portfwdpcp_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/pcp"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdpcp"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// fakePCPServer is a PCP server which, like a real one, only lets the nonce that
+// created a mapping refresh or delete it. It grants at most an hour and maps
+// every external port to 203.0.113.1.
+type fakePCPServer struct {
+	mu sync.Mutex
+	// mappings holds the nonce of each mapping by
+	// "<third party>/<protocol>/<internal port>".
+	mappings map[string][]byte
+}
+
+func (f *fakePCPServer) serve(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		req := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFromUDP(req)
+			if err != nil {
+				return
+			}
+
+			if _, err := conn.WriteToUDP(f.respond(req[:n]), addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (f *fakePCPServer) respond(req []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := make([]byte, 60)
+	res[0] = 2
+	res[1] = req[1] | 0x80
+	if len(req) < 80 || req[1] != 1 || req[60] != 1 {
+		res[3] = byte(pcp.ResultCodeMalformedRequest)
+		return res
+	}
+	copy(res[24:], req[24:60])
+
+	var (
+		lifetime = binary.BigEndian.Uint32(req[4:8])
+		nonce    = req[24:36]
+		key      = fmt.Sprintf("%s/%d/%d", net.IP(req[64:80]), req[36], binary.BigEndian.Uint16(req[40:42]))
+	)
+	if existing, ok := f.mappings[key]; ok && !bytes.Equal(existing, nonce) {
+		res[3] = byte(pcp.ResultCodeNotAuthorized)
+		return res
+	}
+
+	if lifetime == 0 {
+		delete(f.mappings, key)
+		return res
+	}
+
+	f.mappings[key] = bytes.Clone(nonce)
+	binary.BigEndian.PutUint32(res[4:8], min(lifetime, 3600))
+	copy(res[44:60], net.IPv4(203, 0, 113, 1).To16())
+
+	return res
+}
+
+func (f *fakePCPServer) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.mappings)
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx           = t.Context()
+		server        = &fakePCPServer{mappings: map[string][]byte{}}
+		portForwarder = &portfwdpcp.PortForwarder{Client: &pcp.Client{Server: server.serve(t)}}
+		pm            = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 0, 10),
+			Enabled:        true,
+		}
+	)
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	if len(pm.Nonce) != 12 || pm.LeaseDuration != time.Hour || !pm.AssignedExternalIPAddress.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Fatalf("expected the nonce and what the server assigned to be written back, got %+v", pm)
+	}
+
+	// Renewing must use the nonce that the mapping was added with.
+	nonce := bytes.Clone(pm.Nonce)
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	if !bytes.Equal(pm.Nonce, nonce) || server.len() != 1 {
+		t.Fatalf("expected the mapping to be renewed by its nonce, got %v and %d mappings", pm.Nonce, server.len())
+	}
+
+	// Nonces are random, so without the recorded one the mapping cannot be taken over.
+	unrecorded := *pm
+	unrecorded.Nonce = nil
+	if err := portForwarder.AddPortMapping(ctx, &unrecorded); !errors.Is(err, pcp.ResultCodeNotAuthorized) {
+		t.Fatalf("expected error %v, got %v", pcp.ResultCodeNotAuthorized, err)
+	}
+
+	// ...nor deleted, so it is left to expire.
+	if err := portForwarder.DeletePortMapping(ctx, &unrecorded); err != nil || server.len() != 1 {
+		t.Fatalf("expected the mapping to be left to expire, got %v and %d mappings", err, server.len())
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if server.len() != 0 {
+		t.Fatalf("expected the mapping to be deleted, got %d mappings", server.len())
+	}
+}
@@ -0,0 +1,4 @@
+// package portfwdpfsense provides an implementation of portfwd.PortForwarder
+// that manages NAT port forwards and their associated firewall rules via the
+// pfSense REST API package.
+package portfwdpfsense
@@ -0,0 +1,230 @@
+package portfwdpfsense
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/frantjc/port-forward/internal/pfsense"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// DefaultInterface is the pfSense interface that port forwards are made on by default.
+const DefaultInterface = "wan"
+
+// PortForwarder implements portfwd.PortForwarder by managing a NAT port forward
+// with an associated firewall rule that passes its traffic for each PortMapping.
+// pfSense port forwards are permanent, so LeaseDuration is ignored.
+type PortForwarder struct {
+	*pfsense.Client
+	// Interface is the pfSense interface to port forward on.
+	// Defaults to DefaultInterface.
+	Interface string
+	// Owner marks port forwards as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+}
+
+var _ portfwd.PortForwarder = &PortForwarder{}
+
+// AddPortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		iface      = p.iface()
+		ipProtocol = "inet"
+		source     = "any"
+	)
+	if pm.InternalClient.To4() == nil {
+		ipProtocol = "inet6"
+	}
+	if pm.RemoteHost != "" {
+		source = pm.RemoteHost
+	}
+
+	portForward := &pfsense.PortForward{
+		Interface:       iface,
+		IPProtocol:      ipProtocol,
+		Protocol:        strings.ToLower(string(pm.Protocol)),
+		Source:          source,
+		Destination:     iface + ":ip",
+		DestinationPort: fmt.Sprint(pm.ExternalPort),
+		Target:          pm.InternalClient.String(),
+		LocalPort:       fmt.Sprint(pm.InternalPort),
+		Disabled:        !pm.Enabled,
+		Descr:           p.description(pm),
+	}
+
+	portForwards, err := p.listPortForwards(ctx, pm)
+	if err != nil {
+		return err
+	}
+
+	if len(portForwards) == 0 {
+		portForward.AssociatedRuleID = pfsense.AssociatedRuleIDNew
+
+		if err := p.CreatePortForward(ctx, portForward); err != nil {
+			return err
+		}
+	} else {
+		changed := !isSamePortForward(&portForwards[0], portForward)
+
+		// pfSense keeps the associated firewall rule in sync with the port forward.
+		portForward.ID = portForwards[0].ID
+
+		if changed {
+			if err := p.UpdatePortForward(ctx, portForward); err != nil {
+				return err
+			}
+		}
+
+		// Remove any duplicates, e.g. from a previous partial failure.
+		if len(portForwards) > 1 {
+			if _, err := p.deletePortForwards(ctx, pm, 1); err != nil {
+				return err
+			}
+			changed = true
+		}
+
+		// Renewing an unchanged port forward must not reload the filter.
+		if !changed {
+			return nil
+		}
+	}
+
+	return p.Apply(ctx)
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deleted, err := p.deletePortForwards(ctx, pm, 0)
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return nil
+	}
+
+	return p.Apply(ctx)
+}
+
+func (p *PortForwarder) iface() string {
+	if p.Interface == "" {
+		return DefaultInterface
+	}
+
+	return p.Interface
+}
+
+// descriptionPrefix identifies the port forwards for a PortMapping by its owner,
+// its IP family and the PortMappingKey, so that the IPv4 and IPv6 port mappings of
+// a dual-stack Service, which share a PortMappingKey, do not overwrite each other.
+func (p *PortForwarder) descriptionPrefix(pm *portfwd.PortMapping) string {
+	family := ""
+	if pm.InternalClient != nil && pm.InternalClient.To4() == nil {
+		family = "inet6 "
+	}
+
+	return upnp.OwnerMarker(p.Owner) + family + pm.Key().String() + " "
+}
+
+// isSamePortForward reports whether the existing port forward already is the
+// wanted one, ignoring the fields that pfSense assigns.
+func isSamePortForward(existing, wanted *pfsense.PortForward) bool {
+	existingCopy := *existing
+	existingCopy.ID = wanted.ID
+	existingCopy.AssociatedRuleID = wanted.AssociatedRuleID
+	return existingCopy == *wanted
+}
+
+func (p *PortForwarder) description(pm *portfwd.PortMapping) string {
+	return p.descriptionPrefix(pm) + strings.TrimSpace(pm.Service+" "+pm.Description)
+}
+
+// listPortForwards returns the port forwards for the given PortMapping.
+func (p *PortForwarder) listPortForwards(ctx context.Context, pm *portfwd.PortMapping) ([]pfsense.PortForward, error) {
+	prefix := p.descriptionPrefix(pm)
+
+	portForwards, err := p.ListPortForwards(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []pfsense.PortForward{}
+	for _, portForward := range portForwards {
+		if portForward.ID != nil && strings.HasPrefix(portForward.Descr, prefix) {
+			matches = append(matches, portForward)
+		}
+	}
+
+	return matches, nil
+}
+
+// deletePortForwards deletes the port forwards for the given PortMapping, and
+// their associated firewall rules, keeping the first keep of them. pfSense IDs
+// are positions in a list which shift on every deletion, so the lists are
+// fetched again after each one.
+func (p *PortForwarder) deletePortForwards(ctx context.Context, pm *portfwd.PortMapping, keep int) (int, error) {
+	deleted := 0
+
+	for {
+		portForwards, err := p.listPortForwards(ctx, pm)
+		if err != nil {
+			return deleted, err
+		}
+
+		if len(portForwards) <= keep {
+			return deleted, nil
+		}
+
+		// Delete the port forward first so that traffic stops being forwarded
+		// before the firewall rule that lets it through goes away.
+		portForward := portForwards[keep]
+		if err := p.DeletePortForward(ctx, *portForward.ID); err != nil {
+			return deleted, err
+		}
+		deleted++
+
+		if portForward.AssociatedRuleID == "" {
+			continue
+		}
+
+		if err := p.deleteFirewallRules(ctx, portForward.AssociatedRuleID); err != nil {
+			return deleted, err
+		}
+	}
+}
+
+// deleteFirewallRules deletes the firewall rules associated with a port forward.
+func (p *PortForwarder) deleteFirewallRules(ctx context.Context, associatedRuleID string) error {
+	for {
+		firewallRules, err := p.ListFirewallRules(ctx)
+		if err != nil {
+			return err
+		}
+
+		var id *int
+		for _, firewallRule := range firewallRules {
+			if firewallRule.ID != nil && firewallRule.AssociatedRuleID == associatedRuleID {
+				id = firewallRule.ID
+				break
+			}
+		}
+
+		if id == nil {
+			return nil
+		}
+
+		if err := p.DeleteFirewallRule(ctx, *id); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package portfwdpfsense_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/pfsense"
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdpfsense"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// fakePFSense is a stand-in for the pfSense REST API which, like pfSense,
+// identifies port forwards and firewall rules by their position in a list.
+type fakePFSense struct {
+	mu            sync.Mutex
+	portForwards  []pfsense.PortForward
+	firewallRules []pfsense.FirewallRule
+	applied       int
+	nextRuleID    int
+}
+
+func (f *fakePFSense) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("X-API-Key") != "key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]any{"code": 401, "message": "Authentication failed"})
+		return
+	}
+
+	var data any
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/v2/firewall/nat/port_forwards":
+		for i := range f.portForwards {
+			f.portForwards[i].ID = &i
+		}
+		data = f.portForwards
+	case "POST /api/v2/firewall/nat/port_forward":
+		portForward := pfsense.PortForward{}
+		_ = json.NewDecoder(r.Body).Decode(&portForward)
+		if portForward.AssociatedRuleID == pfsense.AssociatedRuleIDNew {
+			f.nextRuleID++
+			portForward.AssociatedRuleID = fmt.Sprint("nat_", f.nextRuleID)
+			f.firewallRules = append(f.firewallRules, pfsense.FirewallRule{
+				AssociatedRuleID: portForward.AssociatedRuleID,
+				Descr:            "NAT " + portForward.Descr,
+			})
+		}
+		f.portForwards = append(f.portForwards, portForward)
+	case "PATCH /api/v2/firewall/nat/port_forward":
+		portForward := pfsense.PortForward{}
+		_ = json.NewDecoder(r.Body).Decode(&portForward)
+		portForward.AssociatedRuleID = f.portForwards[*portForward.ID].AssociatedRuleID
+		f.portForwards[*portForward.ID] = portForward
+	case "DELETE /api/v2/firewall/nat/port_forward":
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		f.portForwards = slices.Delete(f.portForwards, id, id+1)
+	case "GET /api/v2/firewall/rules":
+		for i := range f.firewallRules {
+			f.firewallRules[i].ID = &i
+		}
+		data = f.firewallRules
+	case "DELETE /api/v2/firewall/rule":
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		f.firewallRules = slices.Delete(f.firewallRules, id, id+1)
+	case "POST /api/v2/firewall/apply":
+		f.applied++
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{"code": 404, "message": "Endpoint not found"})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]any{"code": 200, "status": "ok", "data": data})
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx    = t.Context()
+		fake   = &fakePFSense{}
+		server = httptest.NewServer(fake)
+	)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		portForwarder = &portfwdpfsense.PortForwarder{
+			Client: &pfsense.Client{
+				URL:    serverURL,
+				APIKey: "key",
+			},
+			Owner: "test",
+		}
+		other = pfsense.PortForward{Descr: "someone else's"}
+		pm    = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 0, 2),
+			Enabled:        true,
+			Service:        "default/web:http",
+		}
+	)
+	fake.portForwards = append(fake.portForwards, other)
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	if len(fake.portForwards) != 2 || len(fake.firewallRules) != 1 {
+		t.Fatalf("expected a port forward and a firewall rule to be added, got %d and %d", len(fake.portForwards)-1, len(fake.firewallRules))
+	}
+
+	added := fake.portForwards[1]
+	if added.Target != "192.168.0.2" || added.LocalPort != "80" || added.DestinationPort != "8080" || added.Protocol != "tcp" || added.Disabled {
+		t.Fatalf("unexpected port forward %+v", added)
+	}
+
+	if want := "[test] 8080/TCP default/web:http"; added.Descr != want {
+		t.Fatalf("expected description %q, got %q", want, added.Descr)
+	}
+
+	pm.InternalClient = net.IPv4(192, 168, 0, 3)
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if len(fake.portForwards) != 2 || len(fake.firewallRules) != 1 {
+		t.Fatalf("expected the port forward to be updated in place, got %d port forwards and %d firewall rules", len(fake.portForwards)-1, len(fake.firewallRules))
+	}
+
+	if fake.portForwards[1].Target != "192.168.0.3" {
+		t.Fatalf("expected target to be updated, got %s", fake.portForwards[1].Target)
+	}
+
+	// Renewing an unchanged port forward must not reload the filter.
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	if fake.applied != 2 {
+		t.Fatalf("expected renewal not to apply changes, got %d applies", fake.applied)
+	}
+
+	// The IPv4 and IPv6 port mappings of a dual-stack Service share a
+	// PortMappingKey but must not overwrite each other.
+	pm6 := *pm
+	pm6.InternalClient = net.ParseIP("2001:db8::3")
+	if err := portForwarder.AddPortMapping(ctx, &pm6); err != nil {
+		t.Fatalf("add IPv6: %v", err)
+	}
+
+	if len(fake.portForwards) != 3 || fake.portForwards[1].Target != "192.168.0.3" || fake.portForwards[2].IPProtocol != "inet6" {
+		t.Fatalf("expected a separate IPv6 port forward, got %+v", fake.portForwards)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, &pm6); err != nil {
+		t.Fatalf("delete IPv6: %v", err)
+	}
+
+	if len(fake.portForwards) != 2 || fake.portForwards[1].Target != "192.168.0.3" {
+		t.Fatalf("expected only the IPv6 port forward to be deleted, got %+v", fake.portForwards)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if len(fake.portForwards) != 1 || fake.portForwards[0].Descr != other.Descr || len(fake.firewallRules) != 0 {
+		t.Fatalf("expected only someone else's port forward to remain, got %+v and %+v", fake.portForwards, fake.firewallRules)
+	}
+
+	if fake.applied != 5 {
+		t.Fatalf("expected changes to be applied 5 times, got %d", fake.applied)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete absent: %v", err)
+	}
+
+	portForwarder.APIKey = "wrong"
+	if err := portForwarder.AddPortMapping(ctx, pm); err == nil {
+		t.Fatal("expected an error with the wrong API key")
+	}
+}
@@ -0,0 +1,3 @@
+// package portfwdrouteros provides an implementation of portfwd.PortForwarder
+// that manages /ip firewall nat dst-nat rules via the MikroTik RouterOS REST API.
+package portfwdrouteros
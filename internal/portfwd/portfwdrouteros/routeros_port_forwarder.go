@@ -0,0 +1,179 @@
+package portfwdrouteros
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/routeros"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// DefaultInInterfaceList is the RouterOS interface list that port forwards
+// are made on by default. It exists in RouterOS's default configuration.
+const DefaultInInterfaceList = "WAN"
+
+// PortForwarder implements portfwd.PortForwarder by managing a dst-nat rule for
+// each PortMapping. RouterOS's default configuration drops traffic from the WAN
+// unless it has been destination NATed, so no filter rule is needed. RouterOS
+// rules are permanent, so LeaseDuration is ignored.
+type PortForwarder struct {
+	*routeros.Client
+	// InInterfaceList is the RouterOS interface list to port forward on.
+	// Defaults to DefaultInInterfaceList.
+	InInterfaceList string
+	// Owner marks rules as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+}
+
+var _ portfwd.ListingPortForwarder = &PortForwarder{}
+
+// AddPortMapping implements portfwd.PortForwarder. RouterOS cannot
+// port forward to IPv6 internal clients, so those are refused.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if err := portfwd.RequireIPv4("RouterOS", pm); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inInterfaceList := p.InInterfaceList
+	if inInterfaceList == "" {
+		inInterfaceList = DefaultInInterfaceList
+	}
+
+	rule := &routeros.NATRule{
+		Chain:           routeros.ChainDestinationNAT,
+		Action:          routeros.ActionDestinationNAT,
+		Protocol:        strings.ToLower(string(pm.Protocol)),
+		SrcAddress:      pm.RemoteHost,
+		DstPort:         fmt.Sprint(pm.ExternalPort),
+		InInterfaceList: inInterfaceList,
+		ToAddresses:     pm.InternalClient.String(),
+		ToPorts:         fmt.Sprint(pm.InternalPort),
+		Disabled:        strconv.FormatBool(!pm.Enabled),
+		Comment:         p.comment(pm),
+	}
+
+	ids, err := p.findNATRules(ctx, pm)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		_, err := p.AddNATRule(ctx, rule)
+		return err
+	}
+
+	if err := p.SetNATRule(ctx, ids[0], rule); err != nil {
+		return err
+	}
+
+	// Remove any duplicates, e.g. from a previous partial failure.
+	for _, id := range ids[1:] {
+		if err := p.RemoveNATRule(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids, err := p.findNATRules(ctx, pm)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := p.RemoveNATRule(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListPortMappings implements portfwd.ListingPortForwarder. The owner marker
+// is removed from the returned port mappings' descriptions.
+func (p *PortForwarder) ListPortMappings(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	rules, err := p.ListNATRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	portMappings := []*portfwd.PortMapping{}
+	for _, rule := range rules {
+		if rule.Chain != routeros.ChainDestinationNAT || rule.Action != routeros.ActionDestinationNAT {
+			continue
+		}
+
+		description, ok := strings.CutPrefix(rule.Comment, upnp.OwnerMarker(p.Owner))
+		if !ok {
+			continue
+		}
+
+		externalPort, err := strconv.ParseInt(rule.DstPort, 10, 32)
+		if err != nil {
+			continue
+		}
+
+		internalPort := externalPort
+		if rule.ToPorts != "" {
+			if internalPort, err = strconv.ParseInt(rule.ToPorts, 10, 32); err != nil {
+				continue
+			}
+		}
+
+		portMappings = append(portMappings, &portfwd.PortMapping{
+			RemoteHost:     rule.SrcAddress,
+			ExternalPort:   int32(externalPort),
+			Protocol:       upnp.Protocol(strings.ToUpper(rule.Protocol)),
+			InternalPort:   int32(internalPort),
+			InternalClient: net.ParseIP(rule.ToAddresses),
+			Enabled:        rule.Disabled != "true",
+			Description:    description,
+		})
+	}
+
+	return portMappings, nil
+}
+
+// commentPrefix identifies the rules for a PortMapping
+// by its owner and the PortMappingKey.
+func (p *PortForwarder) commentPrefix(pm *portfwd.PortMapping) string {
+	return upnp.OwnerMarker(p.Owner) + pm.Key().String() + " "
+}
+
+func (p *PortForwarder) comment(pm *portfwd.PortMapping) string {
+	return p.commentPrefix(pm) + strings.TrimSpace(pm.Service+" "+pm.Description)
+}
+
+// findNATRules returns the IDs of the dst-nat rules for the given PortMapping.
+func (p *PortForwarder) findNATRules(ctx context.Context, pm *portfwd.PortMapping) ([]string, error) {
+	prefix := p.commentPrefix(pm)
+
+	rules, err := p.ListNATRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, rule := range rules {
+		if rule.Chain == routeros.ChainDestinationNAT && strings.HasPrefix(rule.Comment, prefix) {
+			ids = append(ids, rule.ID)
+		}
+	}
+
+	return ids, nil
+}
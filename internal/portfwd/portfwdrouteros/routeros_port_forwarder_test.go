@@ -0,0 +1,168 @@
+package portfwdrouteros_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdrouteros"
+	"github.com/frantjc/port-forward/internal/routeros"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// fakeRouterOS is a stand-in for the RouterOS REST API's /ip/firewall/nat.
+type fakeRouterOS struct {
+	mu     sync.Mutex
+	rules  []routeros.NATRule
+	nextID int
+}
+
+func (f *fakeRouterOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if username, password, _ := r.BasicAuth(); username != "admin" || password != "password" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": 401, "message": "Unauthorized"})
+		return
+	}
+
+	id, _ := strings.CutPrefix(r.URL.Path, "/rest/ip/firewall/nat/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/rest/ip/firewall/nat":
+		_ = json.NewEncoder(w).Encode(f.rules)
+		return
+	case r.Method == http.MethodPut && r.URL.Path == "/rest/ip/firewall/nat":
+		rule := routeros.NATRule{}
+		_ = json.NewDecoder(r.Body).Decode(&rule)
+		f.nextID++
+		rule.ID = fmt.Sprint("*", f.nextID)
+		f.rules = append(f.rules, rule)
+		_ = json.NewEncoder(w).Encode(rule)
+		return
+	}
+
+	for i, rule := range f.rules {
+		if rule.ID != id {
+			continue
+		}
+
+		switch r.Method {
+		case http.MethodPatch:
+			_ = json.NewDecoder(r.Body).Decode(&f.rules[i])
+			f.rules[i].ID = id
+			_ = json.NewEncoder(w).Encode(f.rules[i])
+		case http.MethodDelete:
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": 404, "message": "Not Found", "detail": "no such item"})
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx    = t.Context()
+		fake   = &fakeRouterOS{rules: []routeros.NATRule{{ID: "*0", Chain: "dstnat", Action: "dst-nat", DstPort: "22", Comment: "someone else's"}}}
+		server = httptest.NewServer(fake)
+	)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	portForwarder := &portfwdrouteros.PortForwarder{
+		Client: &routeros.Client{
+			URL:      serverURL,
+			Username: "admin",
+			Password: "password",
+		},
+		Owner: "test",
+	}
+
+	for _, externalPort := range []int32{80, 443} {
+		if err := portForwarder.AddPortMapping(ctx, &portfwd.PortMapping{
+			ExternalPort:   externalPort,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   externalPort + 8000,
+			InternalClient: net.IPv4(192, 168, 88, 2),
+			Enabled:        true,
+			Service:        "default/web:http",
+		}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	if len(fake.rules) != 3 {
+		t.Fatalf("expected 2 rules to be added, got %d", len(fake.rules)-1)
+	}
+
+	if rule := fake.rules[1]; rule.ToAddresses != "192.168.88.2" || rule.ToPorts != "8080" || rule.Protocol != "tcp" || rule.InInterfaceList != portfwdrouteros.DefaultInInterfaceList || rule.Comment != "[test] 80/TCP default/web:http" {
+		t.Fatalf("unexpected rule %+v", rule)
+	}
+
+	pm := &portfwd.PortMapping{
+		ExternalPort:   80,
+		Protocol:       upnp.ProtocolTCP,
+		InternalPort:   80,
+		InternalClient: net.IPv4(192, 168, 88, 3),
+		Enabled:        true,
+		Service:        "default/web:http",
+	}
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if len(fake.rules) != 3 || fake.rules[1].ToAddresses != "192.168.88.3" {
+		t.Fatalf("expected rule to be updated in place, got %+v", fake.rules)
+	}
+
+	owned, err := portForwarder.ListPortMappings(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(owned) != 2 || owned[0].Key() != pm.Key() || !owned[0].InternalClient.Equal(pm.InternalClient) {
+		t.Fatalf("expected to list the 2 owned rules, got %v", owned)
+	}
+
+	collected, err := portfwd.CollectGarbage(ctx, portForwarder, &portfwd.GarbageCollectorOpts{
+		IsWanted: func(context.Context) (func(*portfwd.PortMapping) bool, error) {
+			return func(other *portfwd.PortMapping) bool {
+				return other.Key() == pm.Key()
+			}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("collect garbage: %v", err)
+	}
+
+	if len(collected) != 1 || collected[0].ExternalPort != 443 || len(fake.rules) != 2 {
+		t.Fatalf("expected the rule for port 443 to be collected, got %v", collected)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if len(fake.rules) != 1 || fake.rules[0].Comment != "someone else's" {
+		t.Fatalf("expected only someone else's rule to remain, got %+v", fake.rules)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete absent: %v", err)
+	}
+}
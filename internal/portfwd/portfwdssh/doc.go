@@ -0,0 +1,3 @@
+// package portfwdssh provides an implementation of portfwd.PortForwarder
+// that runs user-supplied command templates on a router over SSH.
+package portfwdssh
@@ -0,0 +1,255 @@
+package portfwdssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/upnp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Named groups that ListRegexp may have to fill in the fields of a PortMapping.
+// ListRegexp must have at least SubexpExternalPort, SubexpProtocol and
+// SubexpComment, as the comment is the only record of ownership.
+const (
+	SubexpRemoteHost     = "remoteHost"
+	SubexpExternalPort   = "externalPort"
+	SubexpProtocol       = "protocol"
+	SubexpInternalPort   = "internalPort"
+	SubexpInternalClient = "internalClient"
+	SubexpComment        = "comment"
+)
+
+// TemplateData is what the command templates are executed with.
+// Its string fields, which may come from a Service's annotations,
+// are already quoted for a POSIX shell so that they cannot inject
+// commands into a template that forgets to quote them. They shadow
+// those of the embedded PortMapping.
+type TemplateData struct {
+	*portfwd.PortMapping
+	// RemoteHost, Description and Service are the PortMapping's.
+	RemoteHost, Description, Service Quoted
+	// Owner is the PortForwarder's owner.
+	Owner Quoted
+	// Comment identifies the PortMapping by its owner, PortMappingKey and Service
+	// for routers whose rules can carry a comment. ListRegexp's SubexpComment
+	// group is expected to capture it.
+	Comment Quoted
+}
+
+// Quoted is a string that has already been quoted for a POSIX shell.
+type Quoted string
+
+// Funcs are the functions available to the command templates in addition
+// to the text/template builtins. quote single-quotes its argument for
+// a POSIX shell unless it is already Quoted, and lower and upper change
+// its case, e.g. for Protocol.
+var Funcs = template.FuncMap{
+	"quote": Quote,
+	"lower": func(v any) string {
+		return strings.ToLower(fmt.Sprint(v))
+	},
+	"upper": func(v any) string {
+		return strings.ToUpper(fmt.Sprint(v))
+	},
+}
+
+// Quote single-quotes the given value for a POSIX shell
+// unless it is already Quoted.
+func Quote(v any) Quoted {
+	if q, ok := v.(Quoted); ok {
+		return q
+	}
+
+	return Quoted("'" + strings.ReplaceAll(fmt.Sprint(v), "'", `'\''`) + "'")
+}
+
+// HostKeyCallback returns an ssh.HostKeyCallback which verifies
+// host keys against the given known_hosts file contents.
+func HostKeyCallback(knownHosts []byte) (ssh.HostKeyCallback, error) {
+	// knownhosts only reads from files.
+	f, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(knownHosts); err != nil {
+		return nil, err
+	}
+
+	return knownhosts.New(f.Name())
+}
+
+// PortForwarder implements portfwd.PortForwarder by running commands on a router
+// over SSH. The commands are rendered from templates executed with TemplateData.
+// DeleteTemplate must succeed if the port mapping does not exist.
+type PortForwarder struct {
+	// Address is the router's SSH server's <host>:<port>.
+	Address string
+	// Config configures the SSH client, including
+	// how to authenticate and verify host keys.
+	Config *ssh.ClientConfig
+	// AddTemplate, DeleteTemplate and ListTemplate render the commands
+	// to add, delete and list port mappings. ListTemplate is optional.
+	AddTemplate, DeleteTemplate, ListTemplate *template.Template
+	// ListRegexp parses each line of the output of the ListTemplate command
+	// into a PortMapping. Lines that do not match are skipped, as are lines
+	// whose SubexpComment group does not start with the owner marker.
+	ListRegexp *regexp.Regexp
+	// Owner marks port mappings as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+}
+
+var _ portfwd.ListingPortForwarder = &PortForwarder{}
+
+// AddPortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	_, err := p.run(ctx, p.AddTemplate, pm)
+	return err
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	_, err := p.run(ctx, p.DeleteTemplate, pm)
+	return err
+}
+
+// ListPortMappings implements portfwd.ListingPortForwarder. The owner marker
+// is removed from the returned port mappings' descriptions.
+func (p *PortForwarder) ListPortMappings(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	if p.ListTemplate == nil || p.ListRegexp == nil {
+		return nil, fmt.Errorf("listing port mappings requires a list template and regexp")
+	} else if p.ListRegexp.SubexpIndex(SubexpComment) < 0 {
+		// Without the comment, rules that this PortForwarder did not
+		// make could not be told apart from ones that it did.
+		return nil, fmt.Errorf("listing port mappings requires a list regexp with a %s group", SubexpComment)
+	}
+
+	out, err := p.run(ctx, p.ListTemplate, &portfwd.PortMapping{})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		portMappings = []*portfwd.PortMapping{}
+		scanner      = bufio.NewScanner(bytes.NewReader(out))
+		marker       = upnp.OwnerMarker(p.Owner)
+	)
+	for scanner.Scan() {
+		match := p.ListRegexp.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+
+		subexp := func(name string) string {
+			if i := p.ListRegexp.SubexpIndex(name); i >= 0 {
+				return match[i]
+			}
+
+			return ""
+		}
+
+		description, owned := strings.CutPrefix(subexp(SubexpComment), marker)
+		if !owned {
+			continue
+		}
+
+		externalPort, err := strconv.ParseInt(subexp(SubexpExternalPort), 10, 32)
+		if err != nil {
+			continue
+		}
+
+		internalPort := externalPort
+		if internalPortS := subexp(SubexpInternalPort); internalPortS != "" {
+			if internalPort, err = strconv.ParseInt(internalPortS, 10, 32); err != nil {
+				continue
+			}
+		}
+
+		portMappings = append(portMappings, &portfwd.PortMapping{
+			RemoteHost:     subexp(SubexpRemoteHost),
+			ExternalPort:   int32(externalPort),
+			Protocol:       upnp.Protocol(strings.ToUpper(subexp(SubexpProtocol))),
+			InternalPort:   int32(internalPort),
+			InternalClient: net.ParseIP(subexp(SubexpInternalClient)),
+			Enabled:        true,
+			Description:    description,
+		})
+	}
+
+	return portMappings, scanner.Err()
+}
+
+// run renders the given template for the given PortMapping
+// and runs the result on the router, returning its stdout.
+func (p *PortForwarder) run(ctx context.Context, tmpl *template.Template, pm *portfwd.PortMapping) ([]byte, error) {
+	command := new(strings.Builder)
+	if err := tmpl.Execute(command, &TemplateData{
+		PortMapping: pm,
+		RemoteHost:  Quote(pm.RemoteHost),
+		Description: Quote(pm.Description),
+		Service:     Quote(pm.Service),
+		Owner:       Quote(p.Owner),
+		Comment:     Quote(upnp.OwnerMarker(p.Owner) + pm.Key().String() + " " + strings.TrimSpace(pm.Service+" "+pm.Description)),
+	}); err != nil {
+		return nil, err
+	}
+
+	// Routers tend to be unhappy with concurrent configuration sessions.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop the SSH handshake and command if the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, p.Address, p.Config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	if err := session.Run(command.String()); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		return nil, fmt.Errorf("run %s: %w: %s", tmpl.Name(), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
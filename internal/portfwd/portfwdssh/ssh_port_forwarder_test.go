@@ -0,0 +1,252 @@
+package portfwdssh_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdssh"
+	"github.com/frantjc/port-forward/internal/upnp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeRouter is an in-process SSH server with a tiny command language:
+//
+//	add <external port> <protocol> <internal client> <internal port> '<comment>'
+//	delete <external port> <protocol>
+//	list
+type fakeRouter struct {
+	mu       sync.Mutex
+	rules    map[string]string
+	commands []string
+}
+
+func (f *fakeRouter) exec(command string) (string, uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commands = append(f.commands, command)
+
+	fields := strings.SplitN(command, " ", 6)
+	switch {
+	case fields[0] == "add" && len(fields) == 6:
+		f.rules[fields[1]+"/"+fields[2]] = fmt.Sprintf("%s/%s -> %s:%s # %s", fields[1], fields[2], fields[3], fields[4], strings.Trim(fields[5], "'"))
+	case fields[0] == "delete" && len(fields) == 3:
+		delete(f.rules, fields[1]+"/"+fields[2])
+	case fields[0] == "list":
+		out := new(strings.Builder)
+		for _, rule := range f.rules {
+			fmt.Fprintln(out, rule)
+		}
+		return out.String(), 0
+	default:
+		return "unknown command: " + command, 127
+	}
+
+	return "", 0
+}
+
+// serveSSH runs the fakeRouter's SSH server, which accepts the given client key.
+func serveSSH(t *testing.T, router *fakeRouter, clientKey ssh.PublicKey) (string, ssh.PublicKey) {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown public key")
+			}
+
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+
+				for newChan := range chans {
+					ch, reqs, err := newChan.Accept()
+					if err != nil {
+						continue
+					}
+
+					for req := range reqs {
+						if req.Type != "exec" {
+							_ = req.Reply(false, nil)
+							continue
+						}
+						_ = req.Reply(true, nil)
+
+						out, status := router.exec(string(req.Payload[4:]))
+						if status == 0 {
+							_, _ = ch.Write([]byte(out))
+						} else {
+							_, _ = ch.Stderr().Write([]byte(out))
+						}
+
+						_, _ = ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, status))
+						_ = ch.Close()
+					}
+				}
+			}()
+		}
+	}()
+
+	return lis.Addr().String(), hostSigner.PublicKey()
+}
+
+func TestPortForwarder(t *testing.T) {
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientSigner, err := ssh.NewSignerFromKey(clientPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx              = t.Context()
+		router           = &fakeRouter{rules: map[string]string{"22/tcp": "22/tcp -> 192.168.0.2:22 # someone else's"}}
+		address, hostKey = serveSSH(t, router, clientSigner.PublicKey())
+	)
+
+	hostKeyCallback, err := portfwdssh.HostKeyCallback([]byte(knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey) + "\n"))
+	if err != nil {
+		t.Fatalf("host key callback: %v", err)
+	}
+
+	var (
+		portForwarder = &portfwdssh.PortForwarder{
+			Address: address,
+			Config: &ssh.ClientConfig{
+				User:            "admin",
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+				HostKeyCallback: hostKeyCallback,
+			},
+			AddTemplate:    template.Must(template.New("add").Funcs(portfwdssh.Funcs).Parse(`add {{ .ExternalPort }} {{ lower .Protocol }} {{ .InternalClient }} {{ .InternalPort }} {{ quote .Comment }}`)),
+			DeleteTemplate: template.Must(template.New("delete").Funcs(portfwdssh.Funcs).Parse(`delete {{ .ExternalPort }} {{ lower .Protocol }}`)),
+			ListTemplate:   template.Must(template.New("list").Funcs(portfwdssh.Funcs).Parse(`list`)),
+			ListRegexp:     regexp.MustCompile(`^(?P<externalPort>\d+)/(?P<protocol>\w+) -> (?P<internalClient>[\d.]+):(?P<internalPort>\d+) # (?P<comment>.*)$`),
+			Owner:          "test",
+		}
+		pm = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 0, 10),
+			Enabled:        true,
+			Service:        "default/web:http",
+		}
+	)
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	if rule, want := router.rules["8080/tcp"], "8080/tcp -> 192.168.0.10:80 # [test] 8080/TCP default/web:http"; rule != want {
+		t.Fatalf("expected rule %q, got %q", want, rule)
+	}
+
+	owned, err := portForwarder.ListPortMappings(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(owned) != 1 || owned[0].Key() != pm.Key() || !owned[0].InternalClient.Equal(pm.InternalClient) || owned[0].InternalPort != 80 {
+		t.Fatalf("expected to list the owned rule, got %v", owned)
+	}
+
+	// Without the comment, someone else's rule would look owned.
+	listRegexp := portForwarder.ListRegexp
+	portForwarder.ListRegexp = regexp.MustCompile(`^(?P<externalPort>\d+)/(?P<protocol>\w+) -> `)
+	if _, err := portForwarder.ListPortMappings(ctx); err == nil {
+		t.Fatal("expected an error listing without a comment group")
+	}
+	portForwarder.ListRegexp = listRegexp
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, ok := router.rules["22/tcp"]; len(router.rules) != 1 || !ok {
+		t.Fatalf("expected only someone else's rule to remain, got %v", router.rules)
+	}
+
+	// Fields from a Service's annotations must not be able to inject commands,
+	// even into a template that forgets to quote them, nor be quoted twice.
+	for _, addTemplate := range []string{
+		`add {{ .ExternalPort }} {{ lower .Protocol }} {{ .InternalClient }} {{ .InternalPort }} {{ .Comment }}`,
+		`add {{ .ExternalPort }} {{ lower .Protocol }} {{ .InternalClient }} {{ .InternalPort }} {{ quote .Comment }}`,
+	} {
+		portForwarder.AddTemplate = template.Must(template.New("add").Funcs(portfwdssh.Funcs).Parse(addTemplate))
+		injected := *pm
+		injected.Description = "'; reboot #"
+		if err := portForwarder.AddPortMapping(ctx, &injected); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+
+		if command, want := router.commands[len(router.commands)-1], `add 8080 tcp 192.168.0.10 80 '[test] 8080/TCP default/web:http '\''; reboot #'`; command != want {
+			t.Fatalf("expected command %q, got %q", want, command)
+		}
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	portForwarder.DeleteTemplate = template.Must(template.New("delete").Parse(`remove {{ .ExternalPort }}`))
+	if err := portForwarder.DeletePortMapping(ctx, pm); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("expected an error with the command's stderr, got %v", err)
+	}
+
+	otherHostKeyCallback, err := portfwdssh.HostKeyCallback([]byte(knownhosts.Line([]string{knownhosts.Normalize(address)}, clientSigner.PublicKey()) + "\n"))
+	if err != nil {
+		t.Fatalf("host key callback: %v", err)
+	}
+
+	portForwarder.Config.HostKeyCallback = otherHostKeyCallback
+	if err := portForwarder.AddPortMapping(ctx, pm); err == nil {
+		t.Fatal("expected an error for a mismatched host key")
+	}
+}
@@ -0,0 +1,3 @@
+// package portfwdtr064 provides an implementation of portfwd.PortForwarder
+// that makes port mappings via TR-064 on a FRITZ!Box.
+package portfwdtr064
@@ -0,0 +1,41 @@
+package portfwdtr064
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/tr064"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// PortForwarder implements portfwd.PortForwarder by making port mappings via
+// TR-064. TR-064 is authenticated, so a FRITZ!Box allows port mappings to any LAN
+// IP address and, unlike with UPnP, no SNAT is needed. *upnp.Client should wrap
+// the same *tr064.Client, e.g. via upnp.WithGoUPnPClient.
+type PortForwarder struct {
+	*upnp.Client
+	TR064 *tr064.Client
+}
+
+var _ portfwd.ListingPortForwarder = &PortForwarder{}
+
+// AddPortMapping implements portfwd.PortForwarder. It refuses to make port
+// mappings to internal clients that the FRITZ!Box's host filter does not
+// allow to access the WAN, as their traffic would never make it out.
+// FRITZ!Box port forwards cannot be to IPv6 internal clients,
+// so those are refused too.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if err := portfwd.RequireIPv4("TR-064", pm); err != nil {
+		return err
+	}
+
+	if hasWANAccess, err := p.TR064.HasWANAccess(ctx, pm.InternalClient); err != nil && !errors.Is(err, tr064.ErrNoHostFilter) {
+		return err
+	} else if err == nil && !hasWANAccess {
+		return fmt.Errorf("internal client %s is not allowed to access the WAN by the FRITZ!Box host filter", pm.InternalClient)
+	}
+
+	return p.Client.AddPortMapping(ctx, pm)
+}
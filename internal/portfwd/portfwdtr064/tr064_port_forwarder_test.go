@@ -0,0 +1,218 @@
+package portfwdtr064_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdtr064"
+	"github.com/frantjc/port-forward/internal/tr064"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+const tr64desc = `<?xml version="1.0"?>
+<root xmlns="urn:dslforum-org:device-1-0">
+  <device>
+    <deviceType>urn:dslforum-org:device:InternetGatewayDevice:1</deviceType>
+    <serviceList>
+      <service>
+        <serviceType>urn:dslforum-org:service:X_AVM-DE_HostFilter:1</serviceType>
+        <controlURL>/upnp/control/x_hostfilter</controlURL>
+      </service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:dslforum-org:device:WANConnectionDevice:1</deviceType>
+        <serviceList>
+          <service>
+            <serviceType>urn:dslforum-org:service:WANIPConnection:1</serviceType>
+            <controlURL>/upnp/control/wanipconnection1</controlURL>
+          </service>
+        </serviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// fakeFRITZBox is a stand-in for a FRITZ!Box's TR-064 interface which requires
+// digest authentication and denies WAN access to 192.168.178.66.
+type fakeFRITZBox struct {
+	mu           sync.Mutex
+	portMappings []map[string]string
+}
+
+func (f *fakeFRITZBox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/tr64desc.xml" {
+		_, _ = w.Write([]byte(tr64desc))
+		return
+	}
+
+	if !authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Digest realm="F!Box SOAP-Auth", nonce="0123456789ABCDEF", algorithm=MD5, qop="auth"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	_, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPACTION"), `"`), "#")
+	args := map[string]string{}
+	for dec, name := xml.NewDecoder(r.Body), ""; ; {
+		token, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			name = token.Name.Local
+		case xml.CharData:
+			if strings.HasPrefix(name, "New") {
+				args[name] = string(token)
+			}
+		}
+	}
+
+	out := ""
+	switch action {
+	case "X_AVM-DE_GetWANAccessByIP":
+		disallow := "0"
+		if args["NewIPv4Address"] == "192.168.178.66" {
+			disallow = "1"
+		}
+		out = "<NewDisallow>" + disallow + "</NewDisallow><NewWANAccess>granted</NewWANAccess>"
+	case "GetStatusInfo":
+		out = "<NewConnectionStatus>Connected</NewConnectionStatus>"
+	case "AddPortMapping":
+		f.portMappings = append(f.portMappings, args)
+	case "DeletePortMapping":
+		for i, pm := range f.portMappings {
+			if pm["NewExternalPort"] == args["NewExternalPort"] && pm["NewProtocol"] == args["NewProtocol"] {
+				f.portMappings = append(f.portMappings[:i], f.portMappings[i+1:]...)
+				break
+			}
+		}
+	case "GetGenericPortMappingEntry":
+		var i int
+		_, _ = fmt.Sscan(args["NewPortMappingIndex"], &i)
+		if i >= len(f.portMappings) {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:dslforum-org:control-1-0"><errorCode>713</errorCode><errorDescription>SpecifiedArrayIndexInvalid</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		for k, v := range f.portMappings[i] {
+			out += "<" + k + ">" + v + "</" + k + ">"
+		}
+	}
+
+	_, _ = fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="urn:dslforum-org:service">%s</u:%sResponse></s:Body></s:Envelope>`, action, out, action)
+}
+
+func authorized(r *http.Request) bool {
+	authorization, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Digest ")
+	if !ok {
+		return false
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Split(authorization, ", ") {
+		key, value, _ := strings.Cut(param, "=")
+		params[key] = strings.Trim(value, `"`)
+	}
+
+	var (
+		ha1 = md5Hex("admin:" + params["realm"] + ":password")
+		ha2 = md5Hex(r.Method + ":" + params["uri"])
+	)
+
+	return params["username"] == "admin" && params["response"] == md5Hex(ha1+":"+params["nonce"]+":"+params["nc"]+":"+params["cnonce"]+":"+params["qop"]+":"+ha2)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx    = t.Context()
+		fake   = &fakeFRITZBox{}
+		server = httptest.NewServer(fake)
+	)
+	t.Cleanup(server.Close)
+
+	location, err := url.Parse(server.URL + "/tr64desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr064Client, err := tr064.NewClient(ctx, location, "admin", "password", nil)
+	if err != nil {
+		t.Fatalf("new TR-064 client: %v", err)
+	}
+
+	upnpClient, err := upnp.NewClient(ctx, upnp.WithGoUPnPClient(tr064Client), upnp.WithOwner("test"))
+	if err != nil {
+		t.Fatalf("new UPnP client: %v", err)
+	}
+
+	var (
+		portForwarder = &portfwdtr064.PortForwarder{
+			Client: upnpClient,
+			TR064:  tr064Client,
+		}
+		pm = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 178, 20),
+			Enabled:        true,
+			Description:    "default/web:http",
+		}
+	)
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	if len(fake.portMappings) != 1 || fake.portMappings[0]["NewInternalClient"] != "192.168.178.20" || fake.portMappings[0]["NewPortMappingDescription"] != "[test] default/web:http" {
+		t.Fatalf("unexpected port mappings %v", fake.portMappings)
+	}
+
+	if err := portForwarder.AddPortMapping(ctx, &portfwd.PortMapping{
+		ExternalPort:   2222,
+		Protocol:       upnp.ProtocolTCP,
+		InternalPort:   22,
+		InternalClient: net.IPv4(192, 168, 178, 66),
+		Enabled:        true,
+	}); err == nil {
+		t.Fatal("expected an error for an internal client without WAN access")
+	}
+
+	owned, err := portForwarder.ListPortMappings(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(owned) != 1 || owned[0].Key() != pm.Key() {
+		t.Fatalf("expected to list the owned port mapping, got %v", owned)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if len(fake.portMappings) != 0 {
+		t.Fatalf("expected port mapping to be deleted, got %v", fake.portMappings)
+	}
+}
@@ -0,0 +1,3 @@
+// package portfwdunifi provides an implementation of portfwd.PortForwarder
+// that manages port forwards via the UniFi Network controller API.
+package portfwdunifi
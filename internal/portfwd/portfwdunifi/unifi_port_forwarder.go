@@ -0,0 +1,247 @@
+package portfwdunifi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/unifi"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// DefaultLeaseDuration is the lease duration given to port forwards whose
+// lease is not known, e.g. because they were made before a restart.
+const DefaultLeaseDuration = 2 * time.Hour
+
+// PortForwarder implements portfwd.PortForwarder by managing a UniFi port forward
+// for each PortMapping. UniFi port forwards are permanent, so PortForwarder keeps
+// track of their leases itself: AddPortMapping renews a port forward's lease,
+// and ExpireLeases deletes port forwards whose leases were not renewed in time,
+// as a router would for a UPnP port mapping.
+type PortForwarder struct {
+	*unifi.Client
+	// Interface is the UniFi WAN interface to port forward on, e.g. wan or wan2.
+	// Defaults to the controller's default.
+	Interface string
+	// Owner marks port forwards as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+	// leases maps port forwards to when their lease expires,
+	// or the zero time.Time if it does not.
+	leases map[upnp.PortMappingKey]time.Time
+}
+
+var (
+	_ portfwd.ListingPortForwarder = &PortForwarder{}
+	_ portfwd.LeaseExpirer         = &PortForwarder{}
+)
+
+// AddPortMapping implements portfwd.PortForwarder. UniFi cannot
+// port forward to IPv6 internal clients, so those are refused.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if err := portfwd.RequireIPv4("UniFi", pm); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		proto = strings.ToLower(string(pm.Protocol))
+		src   = "any"
+	)
+	if pm.RemoteHost != "" {
+		src = pm.RemoteHost
+	}
+
+	portForward := &unifi.PortForward{
+		Name:          p.name(pm),
+		Enabled:       pm.Enabled,
+		Src:           src,
+		DstPort:       fmt.Sprint(pm.ExternalPort),
+		Fwd:           pm.InternalClient.String(),
+		FwdPort:       fmt.Sprint(pm.InternalPort),
+		Proto:         proto,
+		PfwdInterface: p.Interface,
+	}
+
+	ids, err := p.findPortForwards(ctx, pm)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		if err := p.CreatePortForward(ctx, portForward); err != nil {
+			return err
+		}
+	} else {
+		if err := p.UpdatePortForward(ctx, ids[0], portForward); err != nil {
+			return err
+		}
+
+		// Remove any duplicates, e.g. from a previous partial failure.
+		for _, id := range ids[1:] {
+			if err := p.DeletePortForward(ctx, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.leases == nil {
+		p.leases = map[upnp.PortMappingKey]time.Time{}
+	}
+
+	if pm.LeaseDuration > 0 {
+		p.leases[pm.Key()] = time.Now().Add(pm.LeaseDuration)
+	} else {
+		p.leases[pm.Key()] = time.Time{}
+	}
+
+	return nil
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.deletePortMapping(ctx, pm)
+}
+
+func (p *PortForwarder) deletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	ids, err := p.findPortForwards(ctx, pm)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := p.DeletePortForward(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	delete(p.leases, pm.Key())
+
+	return nil
+}
+
+// ListPortMappings implements portfwd.ListingPortForwarder. The owner marker
+// is removed from the returned port mappings' descriptions.
+func (p *PortForwarder) ListPortMappings(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	portForwards, err := p.ListPortForwards(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	portMappings := []*portfwd.PortMapping{}
+	for _, portForward := range portForwards {
+		description, ok := strings.CutPrefix(portForward.Name, upnp.OwnerMarker(p.Owner))
+		if !ok {
+			continue
+		}
+
+		externalPort, err := strconv.ParseInt(portForward.DstPort, 10, 32)
+		if err != nil {
+			continue
+		}
+
+		internalPort, err := strconv.ParseInt(portForward.FwdPort, 10, 32)
+		if err != nil {
+			continue
+		}
+
+		remoteHost := portForward.Src
+		if remoteHost == "any" {
+			remoteHost = ""
+		}
+
+		portMappings = append(portMappings, &portfwd.PortMapping{
+			RemoteHost:     remoteHost,
+			ExternalPort:   int32(externalPort),
+			Protocol:       upnp.Protocol(strings.ToUpper(portForward.Proto)),
+			InternalPort:   int32(internalPort),
+			InternalClient: net.ParseIP(portForward.Fwd),
+			Enabled:        portForward.Enabled,
+			Description:    description,
+		})
+	}
+
+	return portMappings, nil
+}
+
+// ExpireLeases implements portfwd.LeaseExpirer. Port forwards whose leases
+// are not known are given DefaultLeaseDuration starting now.
+func (p *PortForwarder) ExpireLeases(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	portMappings, err := p.ListPortMappings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.leases == nil {
+		p.leases = map[upnp.PortMappingKey]time.Time{}
+	}
+
+	var (
+		now     = time.Now()
+		expired = []*portfwd.PortMapping{}
+		errs    = []error{}
+	)
+	for _, pm := range portMappings {
+		expiry, ok := p.leases[pm.Key()]
+		if !ok {
+			p.leases[pm.Key()] = now.Add(DefaultLeaseDuration)
+			continue
+		}
+
+		if expiry.IsZero() || now.Before(expiry) {
+			continue
+		}
+
+		if err := p.deletePortMapping(ctx, pm); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		expired = append(expired, pm)
+	}
+
+	return expired, errors.Join(errs...)
+}
+
+// namePrefix identifies the port forwards for a PortMapping
+// by its owner and the PortMappingKey.
+func (p *PortForwarder) namePrefix(pm *portfwd.PortMapping) string {
+	return upnp.OwnerMarker(p.Owner) + pm.Key().String() + " "
+}
+
+func (p *PortForwarder) name(pm *portfwd.PortMapping) string {
+	return p.namePrefix(pm) + strings.TrimSpace(pm.Service+" "+pm.Description)
+}
+
+// findPortForwards returns the IDs of the port forwards for the given PortMapping.
+func (p *PortForwarder) findPortForwards(ctx context.Context, pm *portfwd.PortMapping) ([]string, error) {
+	prefix := p.namePrefix(pm)
+
+	portForwards, err := p.ListPortForwards(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, portForward := range portForwards {
+		if strings.HasPrefix(portForward.Name, prefix) {
+			ids = append(ids, portForward.ID)
+		}
+	}
+
+	return ids, nil
+}
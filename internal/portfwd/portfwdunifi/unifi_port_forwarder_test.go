@@ -0,0 +1,162 @@
+package portfwdunifi_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdunifi"
+	"github.com/frantjc/port-forward/internal/unifi"
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+// fakeUniFiOS is a stand-in for a UniFi OS console's Network controller API.
+type fakeUniFiOS struct {
+	mu           sync.Mutex
+	logins       int
+	portForwards []unifi.PortForward
+	nextID       int
+}
+
+func (f *fakeUniFiOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/api/auth/login" {
+		f.logins++
+		http.SetCookie(w, &http.Cookie{Name: "TOKEN", Value: fmt.Sprint("token", f.logins)})
+		w.Header().Set("X-CSRF-Token", "csrf")
+		return
+	}
+
+	if cookie, err := r.Cookie("TOKEN"); err != nil || cookie.Value != fmt.Sprint("token", f.logins) || r.Header.Get("X-CSRF-Token") != "csrf" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, _ := strings.CutPrefix(r.URL.Path, "/proxy/network/api/s/default/rest/portforward/")
+	data := []unifi.PortForward{}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/proxy/network/api/s/default/rest/portforward":
+		data = f.portForwards
+	case r.Method == http.MethodPost && r.URL.Path == "/proxy/network/api/s/default/rest/portforward":
+		portForward := unifi.PortForward{}
+		_ = json.NewDecoder(r.Body).Decode(&portForward)
+		f.nextID++
+		portForward.ID = fmt.Sprint(f.nextID)
+		f.portForwards = append(f.portForwards, portForward)
+		data = append(data, portForward)
+	default:
+		for i, portForward := range f.portForwards {
+			if portForward.ID != id {
+				continue
+			}
+
+			switch r.Method {
+			case http.MethodPut:
+				_ = json.NewDecoder(r.Body).Decode(&f.portForwards[i])
+				f.portForwards[i].ID = id
+				data = append(data, f.portForwards[i])
+			case http.MethodDelete:
+				f.portForwards = append(f.portForwards[:i], f.portForwards[i+1:]...)
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]any{"meta": map[string]any{"rc": "ok"}, "data": data})
+			return
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"meta": map[string]any{"rc": "error", "msg": "api.err.IdInvalid"}, "data": data})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]any{"meta": map[string]any{"rc": "ok"}, "data": data})
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx    = t.Context()
+		fake   = &fakeUniFiOS{}
+		server = httptest.NewServer(fake)
+	)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	portForwarder := &portfwdunifi.PortForwarder{
+		Client: &unifi.Client{
+			URL:      serverURL,
+			Username: "admin",
+			Password: "password",
+		},
+		Owner: "test",
+	}
+
+	fake.portForwards = append(fake.portForwards,
+		unifi.PortForward{ID: "a", Name: "someone else's", DstPort: "22", FwdPort: "22", Proto: "tcp"},
+		unifi.PortForward{ID: "b", Name: "[test] 25/TCP from before a restart", DstPort: "25", FwdPort: "25", Proto: "tcp", Src: "any"},
+	)
+
+	for _, pm := range []*portfwd.PortMapping{
+		{ExternalPort: 80, Protocol: upnp.ProtocolTCP, InternalPort: 8080, InternalClient: net.IPv4(192, 168, 1, 10), Enabled: true, LeaseDuration: time.Hour, Service: "default/web:http"},
+		{ExternalPort: 443, Protocol: upnp.ProtocolTCP, InternalPort: 8443, InternalClient: net.IPv4(192, 168, 1, 10), Enabled: true, LeaseDuration: time.Nanosecond, Service: "default/web:https"},
+	} {
+		if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	if len(fake.portForwards) != 4 {
+		t.Fatalf("expected 2 port forwards to be added, got %d", len(fake.portForwards)-2)
+	}
+
+	if portForward := fake.portForwards[2]; portForward.Name != "[test] 80/TCP default/web:http" || portForward.Fwd != "192.168.1.10" || portForward.FwdPort != "8080" || portForward.Proto != "tcp" || !portForward.Enabled {
+		t.Fatalf("unexpected port forward %+v", portForward)
+	}
+
+	// Log out to check that the Client logs in again.
+	fake.logins++
+
+	expired, err := portForwarder.ExpireLeases(ctx)
+	if err != nil {
+		t.Fatalf("expire leases: %v", err)
+	}
+
+	if len(expired) != 1 || expired[0].ExternalPort != 443 {
+		t.Fatalf("expected only the lease for port 443 to expire, got %v", expired)
+	}
+
+	if len(fake.portForwards) != 3 {
+		t.Fatalf("expected the port forward for port 443 to be deleted, got %+v", fake.portForwards)
+	}
+
+	owned, err := portForwarder.ListPortMappings(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(owned) != 2 {
+		t.Fatalf("expected 2 owned port forwards, got %v", owned)
+	}
+
+	for _, pm := range owned {
+		if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+
+	if len(fake.portForwards) != 1 || fake.portForwards[0].ID != "a" {
+		t.Fatalf("expected only someone else's port forward to remain, got %+v", fake.portForwards)
+	}
+}
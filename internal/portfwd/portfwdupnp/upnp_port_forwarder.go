@@ -2,8 +2,10 @@ package portfwdupnp
 
 import (
 	"context"
+	"errors"
 	"sync"
 
+	"github.com/frantjc/port-forward/internal/logutil"
 	"github.com/frantjc/port-forward/internal/portfwd"
 	"github.com/frantjc/port-forward/internal/srcipmasq"
 	"github.com/frantjc/port-forward/internal/upnp"
@@ -15,7 +17,24 @@ type PortForwarder struct {
 	mu sync.Mutex
 }
 
+var _ portfwd.ListingPortForwarder = &PortForwarder{}
+
 func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	return p.masqAs(ctx, pm, func() error {
+		return p.Client.AddPortMapping(ctx, pm)
+	})
+}
+
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	return p.masqAs(ctx, pm, func() error {
+		return p.Client.DeletePortMapping(ctx, pm)
+	})
+}
+
+// masqAs calls f while traffic to the router appears to come from the
+// PortMapping's InternalClient, as many routers only allow a client to
+// manage PortMappings to itself.
+func (p *PortForwarder) masqAs(ctx context.Context, pm *portfwd.PortMapping, f func() error) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -29,12 +48,19 @@ func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapp
 		Destination:    destination,
 		NewSource:      pm.InternalClient,
 	})
-	if err != nil {
+	if errors.Is(err, srcipmasq.ErrFamilyMismatch) && pm.InternalClient.To4() == nil {
+		// Traffic cannot be masqueraded as coming from an address of another
+		// family, e.g. when opening an IPv6 pinhole via a router found over
+		// IPv4, in which case the router must allow the Node to manage it.
+		// IPv4 port mappings are not pinholes, so for them, that is an error.
+		logutil.SloggerFrom(ctx).Debug("not masquerading", "err", err)
+		return f()
+	} else if err != nil {
 		return err
 	}
 	defer func() {
 		_ = restore()
 	}()
 
-	return p.Client.AddPortMapping(ctx, pm)
+	return f()
 }
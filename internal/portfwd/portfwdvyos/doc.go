@@ -0,0 +1,3 @@
+// package portfwdvyos provides an implementation of portfwd.PortForwarder
+// that manages nat destination rules via the VyOS HTTPS API.
+package portfwdvyos
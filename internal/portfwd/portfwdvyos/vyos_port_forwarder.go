@@ -0,0 +1,297 @@
+package portfwdvyos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/frantjc/port-forward/internal/vyos"
+)
+
+const (
+	// DefaultInboundInterface is the interface that port forwards are made on by default.
+	DefaultInboundInterface = "eth0"
+	// DefaultFirstRule is the first rule number that is allocated by default.
+	DefaultFirstRule = 1000
+	// DefaultLastRule is the last rule number that is allocated by default.
+	DefaultLastRule = 1999
+)
+
+// natDestinationRule is the configuration under nat destination rule <number>.
+type natDestinationRule struct {
+	Description      string `json:"description"`
+	InboundInterface struct {
+		Name string `json:"name"`
+	} `json:"inbound-interface"`
+	Destination struct {
+		Port string `json:"port"`
+	} `json:"destination"`
+	Source struct {
+		Address string `json:"address"`
+	} `json:"source"`
+	Protocol    string `json:"protocol"`
+	Translation struct {
+		Address string `json:"address"`
+		Port    string `json:"port"`
+	} `json:"translation"`
+	// Disable is set, to an empty object, if the rule is disabled.
+	Disable *struct{} `json:"disable"`
+}
+
+// PortForwarder implements portfwd.PortForwarder by managing a nat destination rule
+// for each PortMapping. Rule numbers are allocated from FirstRule to LastRule and
+// ownership is recorded in the rule description. VyOS rules are permanent, so
+// LeaseDuration is ignored.
+type PortForwarder struct {
+	*vyos.Client
+	// InboundInterface is the interface to port forward on.
+	// Defaults to DefaultInboundInterface.
+	InboundInterface string
+	// FirstRule and LastRule are the range of rule numbers to allocate from,
+	// inclusive. Default to DefaultFirstRule and DefaultLastRule.
+	FirstRule, LastRule int
+	// Save causes the configuration to be saved after each change
+	// so that the rules persist across reboots.
+	Save bool
+	// Owner marks rules as managed by this PortForwarder.
+	Owner string
+	mu    sync.Mutex
+}
+
+var _ portfwd.ListingPortForwarder = &PortForwarder{}
+
+var natDestinationRulePath = []string{"nat", "destination", "rule"}
+
+// AddPortMapping implements portfwd.PortForwarder. VyOS destination NAT
+// rules cannot be to IPv6 internal clients, so those are refused.
+func (p *PortForwarder) AddPortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	if err := portfwd.RequireIPv4("VyOS", pm); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rules, err := p.getRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	inboundInterface := p.InboundInterface
+	if inboundInterface == "" {
+		inboundInterface = DefaultInboundInterface
+	}
+
+	var (
+		numbers = p.findRules(rules, pm)
+		ops     = []vyos.Operation{}
+		number  string
+	)
+	// Renewing an unchanged rule must not touch the configuration.
+	if len(numbers) == 1 && isSameRule(rules[numbers[0]], p.rule(pm, inboundInterface)) {
+		return nil
+	}
+
+	if len(numbers) == 0 {
+		if number, err = p.allocateRule(rules); err != nil {
+			return err
+		}
+	} else {
+		// Replace the rule wholesale so that no stale configuration,
+		// e.g. disable, is left behind, and remove any duplicates,
+		// e.g. from a previous partial failure.
+		number = numbers[0]
+		for _, n := range numbers {
+			ops = append(ops, vyos.Delete(rulePath(n)...))
+		}
+	}
+
+	ops = append(ops,
+		vyos.Set(rulePath(number, "description", p.description(pm))...),
+		vyos.Set(rulePath(number, "inbound-interface", "name", inboundInterface)...),
+		vyos.Set(rulePath(number, "protocol", strings.ToLower(string(pm.Protocol)))...),
+		vyos.Set(rulePath(number, "destination", "port", fmt.Sprint(pm.ExternalPort))...),
+		vyos.Set(rulePath(number, "translation", "address", pm.InternalClient.String())...),
+		vyos.Set(rulePath(number, "translation", "port", fmt.Sprint(pm.InternalPort))...),
+	)
+	if pm.RemoteHost != "" {
+		ops = append(ops, vyos.Set(rulePath(number, "source", "address", pm.RemoteHost)...))
+	}
+	if !pm.Enabled {
+		ops = append(ops, vyos.Set(rulePath(number, "disable")...))
+	}
+
+	return p.configure(ctx, ops...)
+}
+
+// DeletePortMapping implements portfwd.PortForwarder.
+func (p *PortForwarder) DeletePortMapping(ctx context.Context, pm *portfwd.PortMapping) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rules, err := p.getRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	numbers := p.findRules(rules, pm)
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	ops := []vyos.Operation{}
+	for _, number := range numbers {
+		ops = append(ops, vyos.Delete(rulePath(number)...))
+	}
+
+	return p.configure(ctx, ops...)
+}
+
+// ListPortMappings implements portfwd.ListingPortForwarder. The owner marker
+// is removed from the returned port mappings' descriptions.
+func (p *PortForwarder) ListPortMappings(ctx context.Context) ([]*portfwd.PortMapping, error) {
+	rules, err := p.getRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	portMappings := []*portfwd.PortMapping{}
+	for _, rule := range rules {
+		description, ok := strings.CutPrefix(rule.Description, upnp.OwnerMarker(p.Owner))
+		if !ok {
+			continue
+		}
+
+		externalPort, err := strconv.ParseInt(rule.Destination.Port, 10, 32)
+		if err != nil {
+			continue
+		}
+
+		internalPort := externalPort
+		if rule.Translation.Port != "" {
+			if internalPort, err = strconv.ParseInt(rule.Translation.Port, 10, 32); err != nil {
+				continue
+			}
+		}
+
+		portMappings = append(portMappings, &portfwd.PortMapping{
+			RemoteHost:     rule.Source.Address,
+			ExternalPort:   int32(externalPort),
+			Protocol:       upnp.Protocol(strings.ToUpper(rule.Protocol)),
+			InternalPort:   int32(internalPort),
+			InternalClient: net.ParseIP(rule.Translation.Address),
+			Enabled:        rule.Disable == nil,
+			Description:    description,
+		})
+	}
+
+	return portMappings, nil
+}
+
+func (p *PortForwarder) configure(ctx context.Context, ops ...vyos.Operation) error {
+	if err := p.Configure(ctx, ops...); err != nil {
+		return err
+	}
+
+	if p.Save {
+		return p.Client.Save(ctx)
+	}
+
+	return nil
+}
+
+// getRules returns every nat destination rule keyed by rule number.
+func (p *PortForwarder) getRules(ctx context.Context) (map[string]natDestinationRule, error) {
+	rules := map[string]natDestinationRule{}
+	if err := p.ShowConfig(ctx, natDestinationRulePath, &rules); err != nil && !errors.Is(err, vyos.ErrEmptyPath) {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// descriptionPrefix identifies the rules for a PortMapping
+// by its owner and the PortMappingKey.
+func (p *PortForwarder) descriptionPrefix(pm *portfwd.PortMapping) string {
+	return upnp.OwnerMarker(p.Owner) + pm.Key().String() + " "
+}
+
+func (p *PortForwarder) description(pm *portfwd.PortMapping) string {
+	return p.descriptionPrefix(pm) + strings.TrimSpace(pm.Service+" "+pm.Description)
+}
+
+// rule returns the nat destination rule for the given PortMapping.
+func (p *PortForwarder) rule(pm *portfwd.PortMapping, inboundInterface string) natDestinationRule {
+	rule := natDestinationRule{
+		Description: p.description(pm),
+		Protocol:    strings.ToLower(string(pm.Protocol)),
+	}
+	rule.InboundInterface.Name = inboundInterface
+	rule.Destination.Port = fmt.Sprint(pm.ExternalPort)
+	rule.Source.Address = pm.RemoteHost
+	rule.Translation.Address = pm.InternalClient.String()
+	rule.Translation.Port = fmt.Sprint(pm.InternalPort)
+	if !pm.Enabled {
+		rule.Disable = &struct{}{}
+	}
+
+	return rule
+}
+
+// isSameRule reports whether the existing rule is already the wanted one.
+func isSameRule(existing, wanted natDestinationRule) bool {
+	if (existing.Disable == nil) != (wanted.Disable == nil) {
+		return false
+	}
+
+	existing.Disable, wanted.Disable = nil, nil
+
+	return existing == wanted
+}
+
+// findRules returns the numbers of the rules for the given PortMapping.
+func (p *PortForwarder) findRules(rules map[string]natDestinationRule, pm *portfwd.PortMapping) []string {
+	prefix := p.descriptionPrefix(pm)
+
+	numbers := []string{}
+	for number, rule := range rules {
+		if strings.HasPrefix(rule.Description, prefix) {
+			numbers = append(numbers, number)
+		}
+	}
+
+	slices.SortFunc(numbers, func(a, b string) int {
+		i, _ := strconv.Atoi(a)
+		j, _ := strconv.Atoi(b)
+		return i - j
+	})
+
+	return numbers
+}
+
+// allocateRule returns the lowest unused rule number in the PortForwarder's range.
+func (p *PortForwarder) allocateRule(rules map[string]natDestinationRule) (string, error) {
+	first, last := p.FirstRule, p.LastRule
+	if first == 0 && last == 0 {
+		first, last = DefaultFirstRule, DefaultLastRule
+	}
+
+	for number := first; number <= last; number++ {
+		if _, ok := rules[strconv.Itoa(number)]; !ok {
+			return strconv.Itoa(number), nil
+		}
+	}
+
+	return "", fmt.Errorf("no unused nat destination rule numbers in range %d-%d", first, last)
+}
+
+func rulePath(number string, path ...string) []string {
+	return append(append(append([]string{}, natDestinationRulePath...), number), path...)
+}
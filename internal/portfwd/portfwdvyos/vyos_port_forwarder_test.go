@@ -0,0 +1,209 @@
+package portfwdvyos_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
+	"github.com/frantjc/port-forward/internal/portfwd/portfwdvyos"
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/frantjc/port-forward/internal/vyos"
+)
+
+// leaves are the configuration nodes that the fake VyOS gives a value.
+var leaves = []string{"description", "name", "protocol", "port", "address"}
+
+// fakeVyOS is a stand-in for the VyOS HTTPS API.
+type fakeVyOS struct {
+	mu     sync.Mutex
+	config map[string]any
+	saved  int
+}
+
+func (f *fakeVyOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	respond := func(success bool, data any, err string) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"success": success, "data": data, "error": err})
+	}
+
+	if r.FormValue("key") != "key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		respond(false, nil, "Valid API key is required")
+		return
+	}
+
+	data := []byte(r.FormValue("data"))
+	switch r.URL.Path {
+	case "/retrieve":
+		op := vyos.Operation{}
+		_ = json.Unmarshal(data, &op)
+
+		node := any(f.config)
+		for _, elem := range op.Path {
+			if m, ok := node.(map[string]any); ok {
+				node = m[elem]
+			}
+		}
+
+		if m, ok := node.(map[string]any); !ok || len(m) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			respond(false, nil, "Configuration under specified path is empty\n")
+			return
+		}
+
+		respond(true, node, "")
+	case "/configure":
+		ops := []vyos.Operation{}
+		_ = json.Unmarshal(data, &ops)
+
+		for _, op := range ops {
+			node := f.config
+		path:
+			for i, elem := range op.Path {
+				last := i == len(op.Path)-1
+				switch {
+				case op.Op == "delete" && last:
+					delete(node, elem)
+				case op.Op == "set" && i == len(op.Path)-2 && slices.Contains(leaves, elem):
+					node[elem] = op.Path[i+1]
+				case op.Op == "set" || node[elem] != nil:
+					if _, ok := node[elem].(map[string]any); !ok {
+						node[elem] = map[string]any{}
+					}
+					node = node[elem].(map[string]any)
+					continue
+				}
+				break path
+			}
+		}
+
+		respond(true, nil, "")
+	case "/config-file":
+		f.saved++
+		respond(true, nil, "")
+	}
+}
+
+func (f *fakeVyOS) rules() map[string]any {
+	rules, _ := f.config["nat"].(map[string]any)["destination"].(map[string]any)["rule"].(map[string]any)
+	return rules
+}
+
+func TestPortForwarder(t *testing.T) {
+	var (
+		ctx  = t.Context()
+		fake = &fakeVyOS{
+			config: map[string]any{
+				"nat": map[string]any{
+					"destination": map[string]any{
+						"rule": map[string]any{
+							"1000": map[string]any{"description": "someone else's"},
+						},
+					},
+				},
+			},
+		}
+		server = httptest.NewServer(fake)
+	)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		portForwarder = &portfwdvyos.PortForwarder{
+			Client: &vyos.Client{
+				URL: serverURL,
+				Key: "key",
+			},
+			FirstRule: 1000,
+			LastRule:  1001,
+			Save:      true,
+			Owner:     "test",
+		}
+		pm = &portfwd.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.IPv4(192, 168, 0, 10),
+			Enabled:        false,
+			Service:        "default/web:http",
+		}
+	)
+
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	rule, ok := fake.rules()["1001"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected rule 1001 to be allocated, got %v", fake.rules())
+	}
+
+	if rule["description"] != "[test] 8080/TCP default/web:http" || rule["protocol"] != "tcp" || rule["translation"].(map[string]any)["address"] != "192.168.0.10" || rule["disable"] == nil {
+		t.Fatalf("unexpected rule %v", rule)
+	}
+
+	// Renewing an unchanged rule must not touch the configuration.
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	if fake.saved != 1 {
+		t.Fatalf("expected renewal not to save the config, got %d saves", fake.saved)
+	}
+
+	pm.Enabled = true
+	if err := portForwarder.AddPortMapping(ctx, pm); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if rule := fake.rules()["1001"].(map[string]any); rule["disable"] != nil {
+		t.Fatalf("expected rule to be enabled, got %v", rule)
+	}
+
+	if err := portForwarder.AddPortMapping(ctx, &portfwd.PortMapping{
+		ExternalPort:   8443,
+		Protocol:       upnp.ProtocolTCP,
+		InternalPort:   443,
+		InternalClient: net.IPv4(192, 168, 0, 10),
+		Enabled:        true,
+	}); err == nil {
+		t.Fatal("expected an error when the rule range is exhausted")
+	}
+
+	owned, err := portForwarder.ListPortMappings(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(owned) != 1 || owned[0].Key() != pm.Key() || !owned[0].Enabled {
+		t.Fatalf("expected to list the owned rule, got %v", owned)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, ok := fake.rules()["1000"]; len(fake.rules()) != 1 || !ok {
+		t.Fatalf("expected only someone else's rule to remain, got %v", fake.rules())
+	}
+
+	if fake.saved != 3 {
+		t.Fatalf("expected the config to be saved 3 times, got %d", fake.saved)
+	}
+
+	if err := portForwarder.DeletePortMapping(ctx, pm); err != nil {
+		t.Fatalf("delete absent: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package routeros
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const (
+	ChainDestinationNAT  = "dstnat"
+	ActionDestinationNAT = "dst-nat"
+)
+
+// NATRule is an /ip firewall nat rule. RouterOS represents
+// every value as a string, e.g. Disabled is "true" or "false".
+type NATRule struct {
+	ID              string `json:".id,omitempty"`
+	Chain           string `json:"chain,omitempty"`
+	Action          string `json:"action,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	SrcAddress      string `json:"src-address,omitempty"`
+	DstPort         string `json:"dst-port,omitempty"`
+	InInterfaceList string `json:"in-interface-list,omitempty"`
+	ToAddresses     string `json:"to-addresses,omitempty"`
+	ToPorts         string `json:"to-ports,omitempty"`
+	Disabled        string `json:"disabled,omitempty"`
+	Comment         string `json:"comment,omitempty"`
+}
+
+// ErrNotFound is returned when the requested item does not exist.
+var ErrNotFound = errors.New("no such item")
+
+// Client is a RouterOS REST API client.
+type Client struct {
+	// URL is the base URL of the RouterOS web server, e.g. https://192.168.88.1.
+	URL *url.URL
+	// Username and Password authenticate to the RouterOS REST API.
+	Username, Password string
+	// HTTPClient is used to make requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// ListNATRules lists every /ip firewall nat rule.
+func (c *Client) ListNATRules(ctx context.Context) ([]NATRule, error) {
+	rules := []NATRule{}
+	return rules, c.do(ctx, http.MethodGet, "ip/firewall/nat", nil, &rules)
+}
+
+// AddNATRule adds the given /ip firewall nat rule and returns it with its ID.
+func (c *Client) AddNATRule(ctx context.Context, rule *NATRule) (*NATRule, error) {
+	added := &NATRule{}
+	return added, c.do(ctx, http.MethodPut, "ip/firewall/nat", rule, added)
+}
+
+// SetNATRule updates the /ip firewall nat rule with the given ID.
+func (c *Client) SetNATRule(ctx context.Context, id string, rule *NATRule) error {
+	return c.do(ctx, http.MethodPatch, "ip/firewall/nat/"+url.PathEscape(id), rule, nil)
+}
+
+// RemoveNATRule removes the /ip firewall nat rule with the given ID.
+// It does not return an error if the rule does not exist.
+func (c *Client) RemoveNATRule(ctx context.Context, id string) error {
+	if err := c.do(ctx, http.MethodDelete, "ip/firewall/nat/"+url.PathEscape(id), nil, nil); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+type errorResponse struct {
+	Error   int    `json:"error"`
+	Message string `json:"message"`
+	Detail  string `json:"detail"`
+}
+
+func (c *Client) do(ctx context.Context, method, endpoint string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.URL.JoinPath("rest", endpoint).String(), body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		errRes := &errorResponse{}
+		_ = json.NewDecoder(res.Body).Decode(errRes)
+
+		if res.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s %s: %w", method, endpoint, ErrNotFound)
+		}
+
+		return fmt.Errorf("%s %s: %s: %s %s", method, endpoint, res.Status, errRes.Message, errRes.Detail)
+	}
+
+	if out != nil && res.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+
+	return nil
+}
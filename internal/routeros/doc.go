@@ -0,0 +1,3 @@
+// package routeros provides a client for the parts of the MikroTik
+// RouterOS v7 REST API that manage firewall NAT rules.
+package routeros
@@ -0,0 +1,3 @@
+// package secretref provides a way to reference and
+// get values from Kubernetes Secrets, such as credentials.
+package secretref
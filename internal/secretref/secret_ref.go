@@ -0,0 +1,49 @@
+package secretref
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups="",namespace=kube-system,resources=secrets,verbs=get
+
+// Parse parses a reference to a Secret of the form "<namespace>/<name>".
+func Parse(s string) (types.NamespacedName, error) {
+	namespace, name, ok := strings.Cut(s, "/")
+	if !ok || namespace == "" || name == "" {
+		return types.NamespacedName{}, fmt.Errorf("invalid Secret reference %s, expected <namespace>/<name>", s)
+	}
+
+	return types.NamespacedName{Namespace: namespace, Name: name}, nil
+}
+
+// GetValues gets the values of the given keys from the referenced
+// Secret, in order. It is an error if any of the keys are missing.
+func GetValues(ctx context.Context, reader client.Reader, ref string, keys ...string) ([]string, error) {
+	key, err := Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, key, secret); err != nil {
+		return nil, fmt.Errorf("get Secret %s: %w", key, err)
+	}
+
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		value, ok := secret.Data[k]
+		if !ok {
+			return nil, fmt.Errorf("Secret %s has no key %s", key, k)
+		}
+
+		values[i] = string(value)
+	}
+
+	return values, nil
+}
@@ -2,7 +2,10 @@ package srcipmasq
 
 import (
 	"context"
+	"fmt"
 	"net"
+
+	"github.com/frantjc/port-forward/internal/portfwd"
 )
 
 // Masq is the IP to masquerade as when targeting a specific destination.
@@ -10,6 +13,33 @@ type Masq struct {
 	OriginalSource, Destination, NewSource net.IP
 }
 
+var (
+	// ErrFamilyMismatch is returned when asked to masquerade as an IP address
+	// of a different family than the traffic, e.g. as an IPv6 address when the
+	// destination is only reachable over IPv4, which is impossible. It is
+	// portfwd.ErrFamilyMismatch, as the port mapping then cannot be made.
+	ErrFamilyMismatch = portfwd.ErrFamilyMismatch
+)
+
+// IPv6 reports whether the Masq is of IPv6 traffic. It returns an error wrapping
+// ErrFamilyMismatch if the Masq's IP addresses are not all of the same family.
+func (m *Masq) IPv6() (bool, error) {
+	if m.Destination.To16() == nil {
+		return false, fmt.Errorf("invalid destination IP address %s", m.Destination)
+	}
+
+	ipv6 := m.Destination.To4() == nil
+	for _, ip := range []net.IP{m.OriginalSource, m.NewSource} {
+		if ip.To16() == nil {
+			return false, fmt.Errorf("invalid source IP address %s", ip)
+		} else if (ip.To4() == nil) != ipv6 {
+			return false, fmt.Errorf("%w: cannot masquerade traffic from %s to %s as %s", ErrFamilyMismatch, m.OriginalSource, m.Destination, m.NewSource)
+		}
+	}
+
+	return ipv6, nil
+}
+
 // SourceIPAddressMasqer masqs traffic to an IP address as an IP address.
 type SourceIPAddressMasqer interface {
 	MasqSourceIPAddress(context.Context, *Masq) (func() error, error)
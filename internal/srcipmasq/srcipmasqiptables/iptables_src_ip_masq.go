@@ -2,19 +2,37 @@ package srcipmasqiptables
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/frantjc/port-forward/internal/srcipmasq"
 )
 
 // SourceIPAddressMasqer implements srcipmasq.SourceIPAddressMasqer
-// using `iptables`.
+// using `iptables` and `ip6tables`.
 type SourceIPAddressMasqer struct {
-	*iptables.IPTables
+	// IPv4 is used to masquerade IPv4 traffic.
+	IPv4 *iptables.IPTables
+	// IPv6, if set, is used to masquerade IPv6 traffic.
+	IPv6 *iptables.IPTables
 }
 
 // MasqSourceIPAddress implements srcipmasq.SourceIPAddressMasqer.
+// It uses the IPTables of the Masq's family.
 func (m *SourceIPAddressMasqer) MasqSourceIPAddress(ctx context.Context, masq *srcipmasq.Masq) (func() error, error) {
+	ipv6, err := masq.IPv6()
+	if err != nil {
+		return nil, err
+	}
+
+	ipt := m.IPv4
+	if ipv6 {
+		ipt = m.IPv6
+	}
+	if ipt == nil {
+		return nil, fmt.Errorf("no iptables configured for the IP family of destination IP address %s", masq.Destination)
+	}
+
 	var (
 		table    = "nat"
 		chain    = "POSTROUTING"
@@ -26,10 +44,10 @@ func (m *SourceIPAddressMasqer) MasqSourceIPAddress(ctx context.Context, masq *s
 		}
 	)
 
-	if err := m.Append(table, chain, ruleSpec...); err != nil {
+	if err := ipt.Append(table, chain, ruleSpec...); err != nil {
 		return nil, err
 	}
 	return func() error {
-		return m.DeleteIfExists(table, chain, ruleSpec...)
+		return ipt.DeleteIfExists(table, chain, ruleSpec...)
 	}, nil
 }
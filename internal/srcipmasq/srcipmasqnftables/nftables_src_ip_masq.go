@@ -1,12 +1,17 @@
 package srcipmasqnftables
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net"
 
 	"github.com/frantjc/port-forward/internal/srcipmasq"
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
 )
 
 // SourceIPAddressMasqer implements srcipmasq.SourceIPAddressMasqer
@@ -15,24 +20,38 @@ type SourceIPAddressMasqer struct {
 	*nftables.Conn
 }
 
-// MasqSourceIPAddress implements srcipmasq.SourceIPAddressMasqer.
+// MasqSourceIPAddress implements srcipmasq.SourceIPAddressMasqer. It adds an SNAT
+// rule to the postrouting chain of the nat table for the Masq's family.
+// nftables does not report the handle of added rules, so each rule is given a
+// unique comment by which it is found again so that exactly it is deleted.
 func (m *SourceIPAddressMasqer) MasqSourceIPAddress(ctx context.Context, masq *srcipmasq.Masq) (func() error, error) {
-	return nil, fmt.Errorf("unimplemented")
-}
+	ipv6, err := masq.IPv6()
+	if err != nil {
+		return nil, err
+	}
 
-func (m *SourceIPAddressMasqer) MasqSourceIPAddress_(ctx context.Context, masq *srcipmasq.Masq) (func() error, error) {
 	var (
-		family nftables.TableFamily
+		family         = nftables.TableFamilyIPv4
+		offset, length = uint32(12), uint32(net.IPv4len)
+		originalSource = masq.OriginalSource.To4()
+		destination    = masq.Destination.To4()
+		newSource      = masq.NewSource.To4()
 	)
-	if masq.Destination.To4() != nil {
-		family = nftables.TableFamilyIPv4
-	} else if masq.Destination.To16() != nil {
-		family = nftables.TableFamilyIPv6
-	} else {
-		return nil, fmt.Errorf("unable to determine family of destination IP address %s", masq.Destination)
+	if ipv6 {
+		family, offset, length = nftables.TableFamilyIPv6, 8, net.IPv6len
+		originalSource, destination, newSource = masq.OriginalSource.To16(), masq.Destination.To16(), masq.NewSource.To16()
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
 	}
 
 	var (
+		comment = userdata.AppendString(nil, userdata.TypeComment, fmt.Sprintf(
+			"port-forward masq %s to %s as %s %s",
+			masq.OriginalSource, masq.Destination, masq.NewSource, hex.EncodeToString(id),
+		))
 		table = m.AddTable(&nftables.Table{
 			Name:   "nat",
 			Family: family,
@@ -44,18 +63,45 @@ func (m *SourceIPAddressMasqer) MasqSourceIPAddress_(ctx context.Context, masq *
 			Priority: nftables.ChainPriorityNATSource,
 			Type:     nftables.ChainTypeNAT,
 		})
-		rule = m.AddRule(&nftables.Rule{
-			Table: table,
-			Chain: chain,
-			Exprs: []expr.Any{
-				&expr.NAT{
-					Type: expr.NATTypeSourceNAT,
-				},
-			},
-		})
 	)
 
-	return func() error {
-		return m.DelRule(rule)
-	}, m.Flush()
+	m.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			// Match the original source address.
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: originalSource},
+			// Match the destination address, which directly follows the source address.
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset + length, Len: length},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: destination},
+			// Rewrite the source address to the new one.
+			&expr.Immediate{Register: 1, Data: newSource},
+			&expr.NAT{Type: expr.NATTypeSourceNAT, Family: uint32(family), RegAddrMin: 1},
+		},
+		UserData: comment,
+	})
+
+	if err := m.Flush(); err != nil {
+		return nil, err
+	}
+
+	rules, err := m.GetRules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if bytes.Equal(rule.UserData, comment) {
+			return func() error {
+				if err := m.DelRule(rule); err != nil {
+					return err
+				}
+
+				return m.Flush()
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to find added rule in table %s chain %s", table.Name, chain.Name)
 }
@@ -0,0 +1,217 @@
+package srcipmasqnftables_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/srcipmasq"
+	"github.com/frantjc/port-forward/internal/srcipmasq/srcipmasqnftables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	newRuleHeaderType = netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_NEWRULE)
+	delRuleHeaderType = netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_DELRULE)
+	getRuleHeaderType = netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETRULE)
+)
+
+// fakeNetfilter is a stand-in for the kernel's nftables netlink API which,
+// like the kernel, gives each rule a handle and returns rules as it was given
+// them, so that they are read back as they would be from the kernel.
+type fakeNetfilter struct {
+	mu sync.Mutex
+	// rules holds the data of each rule's message by family and chain.
+	rules  map[string][][]byte
+	handle uint64
+}
+
+func (f *fakeNetfilter) dial(req []netlink.Message) ([]netlink.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, msg := range req {
+		var (
+			chain, handle = ruleChainAndHandle(msg)
+			rules         = f.rules[chain]
+		)
+		switch msg.Header.Type {
+		case newRuleHeaderType:
+			f.handle++
+			attr, _ := netlink.MarshalAttributes([]netlink.Attribute{{Type: unix.NFTA_RULE_HANDLE, Data: binaryutil.BigEndian.PutUint64(f.handle)}})
+			f.rules[chain] = append(rules, append(append([]byte{}, msg.Data...), attr...))
+		case delRuleHeaderType:
+			for i, rule := range rules {
+				if _, h := ruleChainAndHandle(netlink.Message{Data: rule}); h == handle {
+					f.rules[chain] = append(rules[:i:i], rules[i+1:]...)
+				}
+			}
+		case getRuleHeaderType:
+			res := []netlink.Message{}
+			for _, rule := range rules {
+				res = append(res, netlink.Message{Header: netlink.Header{Type: newRuleHeaderType, Flags: netlink.Multi}, Data: rule})
+			}
+
+			return append(res, netlink.Message{Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi}, Data: make([]byte, 4)}), nil
+		}
+	}
+
+	// Acknowledge batches by echoing them.
+	return req, nil
+}
+
+// ruleChainAndHandle returns the family, table and chain, as
+// "<family> <table> <chain>", and the handle, if any, of the
+// rule that the given message is about.
+func ruleChainAndHandle(msg netlink.Message) (string, uint64) {
+	if len(msg.Data) < 4 {
+		return "", 0
+	}
+
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		return "", 0
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	var (
+		table, chain string
+		handle       uint64
+	)
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_RULE_TABLE:
+			table = ad.String()
+		case unix.NFTA_RULE_CHAIN:
+			chain = ad.String()
+		case unix.NFTA_RULE_HANDLE:
+			handle = ad.Uint64()
+		}
+	}
+
+	return fmt.Sprint(msg.Data[0], " ", table, " ", chain), handle
+}
+
+func TestSourceIPAddressMasqer(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		masq   *srcipmasq.Masq
+		family nftables.TableFamily
+		// offset and length are of the source address in the network header.
+		offset, length uint32
+	}{
+		{
+			name: "IPv4",
+			masq: &srcipmasq.Masq{
+				OriginalSource: net.IPv4(10, 0, 0, 1),
+				Destination:    net.IPv4(192, 168, 0, 1),
+				NewSource:      net.IPv4(192, 168, 0, 2),
+			},
+			family: nftables.TableFamilyIPv4,
+			offset: 12,
+			length: net.IPv4len,
+		},
+		{
+			name: "IPv6",
+			masq: &srcipmasq.Masq{
+				OriginalSource: net.ParseIP("fd00::1"),
+				Destination:    net.ParseIP("2001:db8::1"),
+				NewSource:      net.ParseIP("2001:db8::2"),
+			},
+			family: nftables.TableFamilyIPv6,
+			offset: 8,
+			length: net.IPv6len,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				netfilter = &fakeNetfilter{rules: map[string][][]byte{}}
+				conn, err = nftables.New(nftables.WithTestDial(netfilter.dial))
+				table     = &nftables.Table{Name: "nat", Family: tc.family}
+				chain     = &nftables.Chain{Name: "postrouting", Table: table}
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			masqer := &srcipmasqnftables.SourceIPAddressMasqer{Conn: conn}
+
+			unmasq, err := masqer.MasqSourceIPAddress(t.Context(), tc.masq)
+			if err != nil {
+				t.Fatalf("masq: %v", err)
+			}
+
+			rules, err := conn.GetRules(table, chain)
+			if err != nil {
+				t.Fatalf("get rules: %v", err)
+			}
+
+			if len(rules) != 1 {
+				t.Fatalf("expected an SNAT rule to be added, got %d rules", len(rules))
+			}
+
+			var (
+				exprs    = rules[0].Exprs
+				expected = []expr.Any{
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: tc.offset, Len: tc.length},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: tc.masq.OriginalSource},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: tc.offset + tc.length, Len: tc.length},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: tc.masq.Destination},
+					&expr.Immediate{Register: 1, Data: tc.masq.NewSource},
+					&expr.NAT{Type: expr.NATTypeSourceNAT, Family: uint32(tc.family), RegAddrMin: 1},
+				}
+			)
+			if len(exprs) != len(expected) {
+				t.Fatalf("expected %d expressions, got %d", len(expected), len(exprs))
+			}
+
+			for i, e := range exprs {
+				switch want := expected[i].(type) {
+				case *expr.Payload:
+					if got, ok := e.(*expr.Payload); !ok || got.Base != want.Base || got.Offset != want.Offset || got.Len != want.Len || got.DestRegister != want.DestRegister {
+						t.Fatalf("expected expression %d to be %+v, got %+v", i, want, e)
+					}
+				case *expr.Cmp:
+					if got, ok := e.(*expr.Cmp); !ok || got.Op != want.Op || got.Register != want.Register || len(got.Data) != int(tc.length) || !net.IP(got.Data).Equal(net.IP(want.Data)) {
+						t.Fatalf("expected expression %d to be %+v, got %+v", i, want, e)
+					}
+				case *expr.Immediate:
+					if got, ok := e.(*expr.Immediate); !ok || got.Register != want.Register || len(got.Data) != int(tc.length) || !net.IP(got.Data).Equal(net.IP(want.Data)) {
+						t.Fatalf("expected expression %d to be %+v, got %+v", i, want, e)
+					}
+				case *expr.NAT:
+					if got, ok := e.(*expr.NAT); !ok || got.Type != want.Type || got.Family != want.Family || got.RegAddrMin != want.RegAddrMin {
+						t.Fatalf("expected expression %d to be %+v, got %+v", i, want, e)
+					}
+				}
+			}
+
+			if err := unmasq(); err != nil {
+				t.Fatalf("unmasq: %v", err)
+			}
+
+			if rules, err := conn.GetRules(table, chain); err != nil || len(rules) != 0 {
+				t.Fatalf("expected the SNAT rule to be deleted, got %d rules, %v", len(rules), err)
+			}
+		})
+	}
+
+	t.Run("family mismatch", func(t *testing.T) {
+		masqer := &srcipmasqnftables.SourceIPAddressMasqer{}
+
+		if _, err := masqer.MasqSourceIPAddress(t.Context(), &srcipmasq.Masq{
+			OriginalSource: net.IPv4(10, 0, 0, 1),
+			Destination:    net.ParseIP("2001:db8::1"),
+			NewSource:      net.IPv4(192, 168, 0, 2),
+		}); !errors.Is(err, srcipmasq.ErrFamilyMismatch) {
+			t.Fatalf("expected ErrFamilyMismatch, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,321 @@
+package tr064
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/soap"
+)
+
+// DefaultLocation is where a FRITZ!Box serves its TR-064 description.
+const DefaultLocation = "http://fritz.box:49000/tr64desc.xml"
+
+const (
+	ServiceTypeWANIPConnection1  = "urn:dslforum-org:service:WANIPConnection:1"
+	ServiceTypeWANPPPConnection1 = "urn:dslforum-org:service:WANPPPConnection:1"
+	ServiceTypeHostFilter1       = "urn:dslforum-org:service:X_AVM-DE_HostFilter:1"
+)
+
+// Client is a TR-064 client. It implements upnp.GoUPnPClient
+// so that it can be wrapped by a upnp.Client.
+type Client struct {
+	serviceClient    *goupnp.ServiceClient
+	connectionType   string
+	hostFilterClient *soap.SOAPClient
+}
+
+var _ upnp.GoUPnPClient = &Client{}
+
+// NewClient returns a Client for the WAN connection and host filter described at the
+// given location, authenticating with the given username and password. Connected
+// WANPPPConnection services are preferred over WANIPConnection services, as a
+// FRITZ!Box with a DSL uplink describes both. The given *http.Client's Transport,
+// if any, is wrapped to do digest authentication.
+func NewClient(ctx context.Context, location *url.URL, username, password string, httpClient *http.Client) (*Client, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	authHTTPClient := *httpClient
+	authHTTPClient.Transport = &DigestTransport{
+		Username:  username,
+		Password:  password,
+		Transport: httpClient.Transport,
+	}
+
+	services, err := getServices(ctx, httpClient, location)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{}
+	for _, serviceType := range []string{ServiceTypeWANPPPConnection1, ServiceTypeWANIPConnection1} {
+		controlURL, ok := services[serviceType]
+		if !ok {
+			continue
+		}
+
+		soapClient := soap.NewSOAPClient(*location.ResolveReference(controlURL))
+		soapClient.HTTPClient = authHTTPClient
+
+		candidate := &Client{
+			serviceClient: &goupnp.ServiceClient{
+				SOAPClient: soapClient,
+				Location:   location,
+				Service:    &goupnp.Service{ServiceType: serviceType},
+			},
+			connectionType: serviceType,
+		}
+
+		if c.serviceClient == nil {
+			c = candidate
+		}
+
+		if connected, err := candidate.isConnected(ctx); err == nil && connected {
+			c = candidate
+			break
+		}
+	}
+
+	if c.serviceClient == nil {
+		return nil, fmt.Errorf("no WAN connection service found at %s", location)
+	}
+
+	if controlURL, ok := services[ServiceTypeHostFilter1]; ok {
+		c.hostFilterClient = soap.NewSOAPClient(*location.ResolveReference(controlURL))
+		c.hostFilterClient.HTTPClient = authHTTPClient
+	}
+
+	return c, nil
+}
+
+// description is the subset of a TR-064 description needed to find services.
+// Its elements are matched without regard to their namespace.
+type description struct {
+	Device device `xml:"device"`
+}
+
+type device struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []device `xml:"deviceList>device"`
+}
+
+// getServices returns the control URLs of the services
+// described at the given location, keyed by service type.
+func getServices(ctx context.Context, httpClient *http.Client, location *url.URL) (map[string]*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: %s", location, res.Status)
+	}
+
+	desc := &description{}
+	if err := xml.NewDecoder(res.Body).Decode(desc); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", location, err)
+	}
+
+	var (
+		services = map[string]*url.URL{}
+		visit    func(device)
+	)
+	visit = func(d device) {
+		for _, service := range d.Services {
+			if _, ok := services[service.ServiceType]; ok {
+				continue
+			}
+
+			if controlURL, err := url.Parse(service.ControlURL); err == nil {
+				services[service.ServiceType] = controlURL
+			}
+		}
+
+		for _, child := range d.Devices {
+			visit(child)
+		}
+	}
+	visit(desc.Device)
+
+	return services, nil
+}
+
+func (c *Client) perform(ctx context.Context, action string, in, out any) error {
+	return c.serviceClient.SOAPClient.PerformActionCtx(ctx, c.connectionType, action, in, out)
+}
+
+func (c *Client) isConnected(ctx context.Context) (bool, error) {
+	out := &struct {
+		NewConnectionStatus string
+	}{}
+	if err := c.perform(ctx, "GetStatusInfo", nil, out); err != nil {
+		return false, err
+	}
+
+	return out.NewConnectionStatus == "Connected", nil
+}
+
+// GetServiceClient implements upnp.GoUPnPClient.
+func (c *Client) GetServiceClient() *goupnp.ServiceClient {
+	return c.serviceClient
+}
+
+// GetExternalIPAddressCtx implements upnp.GoUPnPClient.
+func (c *Client) GetExternalIPAddressCtx(ctx context.Context) (string, error) {
+	out := &struct {
+		NewExternalIPAddress string
+	}{}
+	if err := c.perform(ctx, "GetExternalIPAddress", nil, out); err != nil {
+		return "", err
+	}
+
+	return out.NewExternalIPAddress, nil
+}
+
+// AddPortMappingCtx implements upnp.GoUPnPClient. Unlike plain UPnP,
+// the internal client may be any LAN IP address.
+func (c *Client) AddPortMappingCtx(
+	ctx context.Context,
+	remoteHost string,
+	externalPort uint16,
+	protocol string,
+	internalPort uint16,
+	internalClient string,
+	enabled bool,
+	description string,
+	leaseDuration uint32,
+) error {
+	return c.perform(ctx, "AddPortMapping", &struct {
+		NewRemoteHost             string
+		NewExternalPort           string
+		NewProtocol               string
+		NewInternalPort           string
+		NewInternalClient         string
+		NewEnabled                string
+		NewPortMappingDescription string
+		NewLeaseDuration          string
+	}{
+		NewRemoteHost:             remoteHost,
+		NewExternalPort:           strconv.Itoa(int(externalPort)),
+		NewProtocol:               protocol,
+		NewInternalPort:           strconv.Itoa(int(internalPort)),
+		NewInternalClient:         internalClient,
+		NewEnabled:                marshalBoolean(enabled),
+		NewPortMappingDescription: description,
+		NewLeaseDuration:          strconv.Itoa(int(leaseDuration)),
+	}, nil)
+}
+
+// DeletePortMappingCtx implements upnp.GoUPnPClient.
+func (c *Client) DeletePortMappingCtx(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	return c.perform(ctx, "DeletePortMapping", &struct {
+		NewRemoteHost   string
+		NewExternalPort string
+		NewProtocol     string
+	}{
+		NewRemoteHost:   remoteHost,
+		NewExternalPort: strconv.Itoa(int(externalPort)),
+		NewProtocol:     protocol,
+	}, nil)
+}
+
+// GetGenericPortMappingEntryCtx implements upnp.GoUPnPClient.
+func (c *Client) GetGenericPortMappingEntryCtx(ctx context.Context, index uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	out := &struct {
+		NewRemoteHost             string
+		NewExternalPort           string
+		NewProtocol               string
+		NewInternalPort           string
+		NewInternalClient         string
+		NewEnabled                string
+		NewPortMappingDescription string
+		NewLeaseDuration          string
+	}{}
+	if err := c.perform(ctx, "GetGenericPortMappingEntry", &struct {
+		NewPortMappingIndex string
+	}{
+		NewPortMappingIndex: strconv.Itoa(int(index)),
+	}, out); err != nil {
+		return "", 0, "", 0, "", false, "", 0, err
+	}
+
+	externalPort, err := soap.UnmarshalUi2(out.NewExternalPort)
+	if err != nil {
+		return "", 0, "", 0, "", false, "", 0, err
+	}
+
+	internalPort, err := soap.UnmarshalUi2(out.NewInternalPort)
+	if err != nil {
+		return "", 0, "", 0, "", false, "", 0, err
+	}
+
+	enabled, err := soap.UnmarshalBoolean(out.NewEnabled)
+	if err != nil {
+		return "", 0, "", 0, "", false, "", 0, err
+	}
+
+	var leaseDuration uint32
+	if out.NewLeaseDuration != "" {
+		if leaseDuration, err = soap.UnmarshalUi4(out.NewLeaseDuration); err != nil {
+			return "", 0, "", 0, "", false, "", 0, err
+		}
+	}
+
+	return out.NewRemoteHost, externalPort, out.NewProtocol, internalPort, out.NewInternalClient, enabled, out.NewPortMappingDescription, leaseDuration, nil
+}
+
+// ErrNoHostFilter is returned when the X_AVM-DE_HostFilter service is not available.
+var ErrNoHostFilter = errors.New("no X_AVM-DE_HostFilter service found")
+
+// HasWANAccess reports whether the given IPv4 address is allowed
+// to access the WAN by the FRITZ!Box's host filter.
+func (c *Client) HasWANAccess(ctx context.Context, ip net.IP) (bool, error) {
+	if c.hostFilterClient == nil {
+		return false, ErrNoHostFilter
+	}
+
+	out := &struct {
+		NewDisallow  string
+		NewWANAccess string
+	}{}
+	if err := c.hostFilterClient.PerformActionCtx(ctx, ServiceTypeHostFilter1, "X_AVM-DE_GetWANAccessByIP", &struct {
+		NewIPv4Address string
+	}{
+		NewIPv4Address: ip.String(),
+	}, out); err != nil {
+		return false, err
+	}
+
+	disallow, err := soap.UnmarshalBoolean(out.NewDisallow)
+	if err != nil {
+		return false, err
+	}
+
+	return !disallow && out.NewWANAccess != "denied", nil
+}
+
+func marshalBoolean(b bool) string {
+	if b {
+		return "1"
+	}
+
+	return "0"
+}
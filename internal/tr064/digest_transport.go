@@ -0,0 +1,166 @@
+package tr064
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DigestTransport is an http.RoundTripper which answers
+// HTTP digest authentication challenges (RFC 2617).
+type DigestTransport struct {
+	Username, Password string
+	// Transport is used to make requests. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+var _ http.RoundTripper = &DigestTransport{}
+
+// RoundTrip implements http.RoundTripper.
+func (t *DigestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// The request is sent twice, so its body must be replayable.
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+
+		if err := req.Body.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := transport.RoundTrip(withBody(req, body))
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	challenge, ok := strings.CutPrefix(res.Header.Get("WWW-Authenticate"), "Digest ")
+	if !ok {
+		return res, nil
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	authorization, err := t.authorization(req, parseChallenge(challenge))
+	if err != nil {
+		return nil, err
+	}
+
+	authReq := withBody(req, body)
+	authReq.Header.Set("Authorization", authorization)
+
+	return transport.RoundTrip(authReq)
+}
+
+func withBody(req *http.Request, body []byte) *http.Request {
+	clone := req.Clone(req.Context())
+	if body != nil {
+		clone.Body = io.NopCloser(bytes.NewReader(body))
+		clone.ContentLength = int64(len(body))
+	}
+
+	return clone
+}
+
+// authorization returns the Authorization header
+// that answers the given challenge for the given request.
+func (t *DigestTransport) authorization(req *http.Request, challenge map[string]string) (string, error) {
+	if algorithm := challenge["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", fmt.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+
+	var (
+		uri   = req.URL.RequestURI()
+		ha1   = md5Hex(t.Username + ":" + challenge["realm"] + ":" + t.Password)
+		ha2   = md5Hex(req.Method + ":" + uri)
+		nonce = challenge["nonce"]
+		b     = new(strings.Builder)
+	)
+	fmt.Fprintf(b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5`, t.Username, challenge["realm"], nonce, uri)
+
+	if qops := strings.Split(challenge["qop"], ","); challenge["qop"] != "" {
+		hasAuth := false
+		for _, qop := range qops {
+			if strings.TrimSpace(qop) == "auth" {
+				hasAuth = true
+			}
+		}
+
+		if !hasAuth {
+			return "", fmt.Errorf("unsupported digest qop %s", challenge["qop"])
+		}
+
+		cnonce := make([]byte, 8)
+		if _, err := rand.Read(cnonce); err != nil {
+			return "", err
+		}
+
+		var (
+			nc       = "00000001"
+			cnonceS  = hex.EncodeToString(cnonce)
+			response = md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonceS + ":auth:" + ha2)
+		)
+		fmt.Fprintf(b, `, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonceS, response)
+	} else {
+		fmt.Fprintf(b, `, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+	}
+
+	if opaque, ok := challenge["opaque"]; ok {
+		fmt.Fprintf(b, `, opaque="%s"`, opaque)
+	}
+
+	return b.String(), nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseChallenge parses the comma-separated key=value or
+// key="value" parameters of a digest authentication challenge.
+func parseChallenge(challenge string) map[string]string {
+	params := map[string]string{}
+
+	for s := strings.TrimSpace(challenge); s != ""; {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if quoted, ok := strings.CutPrefix(rest, `"`); ok {
+			end := strings.Index(quoted, `"`)
+			if end < 0 {
+				end = len(quoted)
+			}
+			value = quoted[:end]
+			rest = quoted[min(end+1, len(quoted)):]
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+
+		params[key] = value
+		s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), ","))
+	}
+
+	return params
+}
@@ -0,0 +1,4 @@
+// package tr064 provides a client for TR-064 as implemented by AVM's FRITZ!Box,
+// which reuses goupnp's SOAP plumbing but authenticates with HTTP digest
+// authentication, allowing port mappings to be made for any LAN IP address.
+package tr064
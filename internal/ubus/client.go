@@ -0,0 +1,207 @@
+package ubus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Status is a ubus status code.
+type Status int
+
+const (
+	StatusOK Status = iota
+	StatusInvalidCommand
+	StatusInvalidArgument
+	StatusMethodNotFound
+	StatusNotFound
+	StatusNoData
+	StatusPermissionDenied
+	StatusTimeout
+	StatusNotSupported
+	StatusUnknownError
+	StatusConnectionFailed
+)
+
+// Error implements error.
+func (s Status) Error() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusInvalidCommand:
+		return "invalid command"
+	case StatusInvalidArgument:
+		return "invalid argument"
+	case StatusMethodNotFound:
+		return "method not found"
+	case StatusNotFound:
+		return "not found"
+	case StatusNoData:
+		return "no data"
+	case StatusPermissionDenied:
+		return "permission denied"
+	case StatusTimeout:
+		return "timeout"
+	case StatusNotSupported:
+		return "not supported"
+	case StatusConnectionFailed:
+		return "connection failed"
+	}
+
+	return fmt.Sprintf("status %d", int(s))
+}
+
+// nullSession is the session used to log in.
+const nullSession = "00000000000000000000000000000000"
+
+// errorCodeAccessDenied is the JSON-RPC error code
+// that rpcd returns for an expired or invalid session.
+const errorCodeAccessDenied = -32002
+
+// Client is a ubus JSON-RPC client.
+type Client struct {
+	// URL is the base URL of the OpenWrt web server, e.g. http://192.168.1.1.
+	URL *url.URL
+	// Username and Password are used to log in to rpcd.
+	Username, Password string
+	// HTTPClient is used to make requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	mu      sync.Mutex
+	session string
+}
+
+// Call calls the given method on the given ubus object with the given arguments,
+// decoding its result into out if it is non-nil. It logs in to rpcd as needed.
+func (c *Client) Call(ctx context.Context, object, method string, args, out any) error {
+	session, err := c.getSession(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	if err := c.call(ctx, session, object, method, args, out); errors.Is(err, StatusPermissionDenied) || errors.Is(err, errAccessDenied) {
+		// The session may have expired, so log in again and retry once.
+		if session, err = c.getSession(ctx, true); err != nil {
+			return err
+		}
+
+		return c.call(ctx, session, object, method, args, out)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var errAccessDenied = errors.New("access denied")
+
+func (c *Client) getSession(ctx context.Context, renew bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session != "" && !renew {
+		return c.session, nil
+	}
+
+	res := &struct {
+		Session string `json:"ubus_rpc_session"`
+	}{}
+	if err := c.call(ctx, nullSession, "session", "login", map[string]string{
+		"username": c.Username,
+		"password": c.Password,
+	}, res); err != nil {
+		return "", fmt.Errorf("log in: %w", err)
+	}
+	c.session = res.Session
+
+	return c.session, nil
+}
+
+type request struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type response struct {
+	Result []json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *Client) call(ctx context.Context, session, object, method string, args, out any) error {
+	if args == nil {
+		args = map[string]any{}
+	}
+
+	b, err := json.Marshal(&request{
+		JSONRPC: "2.0",
+		ID:      1,
+		Method:  "call",
+		Params:  []any{session, object, method, args},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL.JoinPath("ubus").String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	httpRes, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+
+	if httpRes.StatusCode < 200 || httpRes.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", object, method, httpRes.Status)
+	}
+
+	res := &response{}
+	if err := json.NewDecoder(httpRes.Body).Decode(res); err != nil {
+		return err
+	}
+
+	if res.Error != nil {
+		if res.Error.Code == errorCodeAccessDenied {
+			return fmt.Errorf("%s %s: %w", object, method, errAccessDenied)
+		}
+
+		return fmt.Errorf("%s %s: %s", object, method, res.Error.Message)
+	}
+
+	if len(res.Result) == 0 {
+		return fmt.Errorf("%s %s: empty result", object, method)
+	}
+
+	var status Status
+	if err := json.Unmarshal(res.Result[0], &status); err != nil {
+		return err
+	}
+
+	if status != StatusOK {
+		return fmt.Errorf("%s %s: %w", object, method, status)
+	}
+
+	if out != nil && len(res.Result) > 1 {
+		return json.Unmarshal(res.Result[1], out)
+	}
+
+	return nil
+}
@@ -0,0 +1,3 @@
+// package ubus provides a client for OpenWrt's ubus over rpcd's
+// HTTP JSON-RPC interface, with helpers for the uci and rc objects.
+package ubus
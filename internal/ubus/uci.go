@@ -0,0 +1,74 @@
+package ubus
+
+import (
+	"context"
+	"errors"
+)
+
+// UCIGet returns the sections of the given type in the given
+// config, keyed by section name, each with its options.
+func (c *Client) UCIGet(ctx context.Context, config, sectionType string) (map[string]map[string]any, error) {
+	res := &struct {
+		Values map[string]map[string]any `json:"values"`
+	}{}
+	if err := c.Call(ctx, "uci", "get", map[string]any{
+		"config": config,
+		"type":   sectionType,
+	}, res); err != nil {
+		// An empty config results in "not found".
+		if errors.Is(err, StatusNotFound) {
+			return map[string]map[string]any{}, nil
+		}
+
+		return nil, err
+	}
+
+	return res.Values, nil
+}
+
+// UCIAdd adds a section of the given type with the given name and options to the given config.
+func (c *Client) UCIAdd(ctx context.Context, config, sectionType, name string, values map[string]string) error {
+	return c.Call(ctx, "uci", "add", map[string]any{
+		"config": config,
+		"type":   sectionType,
+		"name":   name,
+		"values": values,
+	}, nil)
+}
+
+// UCISet sets the given options on the given section of the given config.
+func (c *Client) UCISet(ctx context.Context, config, section string, values map[string]string) error {
+	return c.Call(ctx, "uci", "set", map[string]any{
+		"config":  config,
+		"section": section,
+		"values":  values,
+	}, nil)
+}
+
+// UCIDelete deletes the given section from the given config.
+// It does not return an error if the section does not exist.
+func (c *Client) UCIDelete(ctx context.Context, config, section string) error {
+	if err := c.Call(ctx, "uci", "delete", map[string]any{
+		"config":  config,
+		"section": section,
+	}, nil); err != nil && !errors.Is(err, StatusNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// UCICommit commits pending changes to the given config.
+func (c *Client) UCICommit(ctx context.Context, config string) error {
+	return c.Call(ctx, "uci", "commit", map[string]any{
+		"config": config,
+	}, nil)
+}
+
+// RCInit runs the given action, e.g. "reload", of the given init script.
+func (c *Client) RCInit(ctx context.Context, name, action string) error {
+	return c.Call(ctx, "rc", "init", map[string]any{
+		"name":   name,
+		"action": action,
+	}, nil)
+}
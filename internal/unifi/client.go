@@ -0,0 +1,234 @@
+package unifi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// DefaultSite is the name of the site that UniFi controllers create.
+const DefaultSite = "default"
+
+// PortForward is a UniFi port forward.
+type PortForward struct {
+	ID            string `json:"_id,omitempty"`
+	Name          string `json:"name"`
+	Enabled       bool   `json:"enabled"`
+	Src           string `json:"src"`
+	DstPort       string `json:"dst_port"`
+	Fwd           string `json:"fwd"`
+	FwdPort       string `json:"fwd_port"`
+	Proto         string `json:"proto"`
+	Log           bool   `json:"log"`
+	PfwdInterface string `json:"pfwd_interface,omitempty"`
+}
+
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("not found")
+
+var errUnauthorized = errors.New("unauthorized")
+
+// Client is a UniFi Network controller client. It supports both
+// UniFi OS consoles, e.g. a UDM, and standalone controllers.
+type Client struct {
+	// URL is the base URL of the UniFi controller, e.g. https://192.168.1.1.
+	URL *url.URL
+	// Username and Password are used to log in to the controller.
+	Username, Password string
+	// Site is the name of the site to manage. Defaults to DefaultSite.
+	Site string
+	// HTTPClient is used to make requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	loggedIn  bool
+	unifiOS   bool
+	cookies   []*http.Cookie
+	csrfToken string
+}
+
+// ListPortForwards lists every port forward on the site.
+func (c *Client) ListPortForwards(ctx context.Context) ([]PortForward, error) {
+	portForwards := []PortForward{}
+	return portForwards, c.call(ctx, http.MethodGet, "rest/portforward", nil, &portForwards)
+}
+
+// CreatePortForward creates the given port forward.
+func (c *Client) CreatePortForward(ctx context.Context, portForward *PortForward) error {
+	return c.call(ctx, http.MethodPost, "rest/portforward", portForward, nil)
+}
+
+// UpdatePortForward updates the port forward with the given ID.
+func (c *Client) UpdatePortForward(ctx context.Context, id string, portForward *PortForward) error {
+	return c.call(ctx, http.MethodPut, "rest/portforward/"+url.PathEscape(id), portForward, nil)
+}
+
+// DeletePortForward deletes the port forward with the given ID.
+// It does not return an error if the port forward does not exist.
+func (c *Client) DeletePortForward(ctx context.Context, id string) error {
+	if err := c.call(ctx, http.MethodDelete, "rest/portforward/"+url.PathEscape(id), nil, nil); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+type response struct {
+	Meta struct {
+		RC  string `json:"rc"`
+		Msg string `json:"msg"`
+	} `json:"meta"`
+	Data json.RawMessage `json:"data"`
+}
+
+// call calls the given site endpoint, logging in as needed.
+func (c *Client) call(ctx context.Context, method, endpoint string, in, out any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loggedIn {
+		if err := c.login(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := c.siteRequest(ctx, method, endpoint, in, out); errors.Is(err, errUnauthorized) {
+		// The session may have expired, so log in again and retry once.
+		if err := c.login(ctx); err != nil {
+			return err
+		}
+
+		return c.siteRequest(ctx, method, endpoint, in, out)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) siteRequest(ctx context.Context, method, endpoint string, in, out any) error {
+	site := c.Site
+	if site == "" {
+		site = DefaultSite
+	}
+
+	path := []string{"api/s", site, endpoint}
+	if c.unifiOS {
+		path = append([]string{"proxy/network"}, path...)
+	}
+
+	res, err := c.do(ctx, method, c.URL.JoinPath(path...).String(), in)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if token := res.Header.Get("X-Updated-CSRF-Token"); token != "" {
+		c.csrfToken = token
+	}
+
+	return decode(method, endpoint, res, out)
+}
+
+// login logs in to the controller, first as if it is
+// a UniFi OS console and then as if it is standalone.
+func (c *Client) login(ctx context.Context) error {
+	c.loggedIn = false
+	credentials := map[string]string{
+		"username": c.Username,
+		"password": c.Password,
+	}
+
+	res, err := c.do(ctx, http.MethodPost, c.URL.JoinPath("api/auth/login").String(), credentials)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	c.unifiOS = res.StatusCode != http.StatusNotFound
+	if !c.unifiOS {
+		if res, err = c.do(ctx, http.MethodPost, c.URL.JoinPath("api/login").String(), credentials); err != nil {
+			return err
+		}
+		defer res.Body.Close()
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		b, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("log in: %s: %s", res.Status, bytes.TrimSpace(b))
+	}
+
+	c.cookies = res.Cookies()
+	c.csrfToken = res.Header.Get("X-CSRF-Token")
+	c.loggedIn = true
+
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, u string, in any) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.csrfToken != "" {
+		req.Header.Set("X-CSRF-Token", c.csrfToken)
+	}
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return httpClient.Do(req)
+}
+
+func decode(method, endpoint string, res *http.Response, out any) error {
+	switch res.StatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%s %s: %w", method, endpoint, errUnauthorized)
+	case http.StatusNotFound:
+		return fmt.Errorf("%s %s: %w", method, endpoint, ErrNotFound)
+	}
+
+	resp := &response{}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return fmt.Errorf("%s %s: %s", method, endpoint, res.Status)
+	}
+
+	switch {
+	case resp.Meta.Msg == "api.err.LoginRequired":
+		return fmt.Errorf("%s %s: %w", method, endpoint, errUnauthorized)
+	case resp.Meta.Msg == "api.err.IdInvalid":
+		return fmt.Errorf("%s %s: %w", method, endpoint, ErrNotFound)
+	case res.StatusCode < 200 || res.StatusCode >= 300 || resp.Meta.RC != "ok":
+		return fmt.Errorf("%s %s: %s: %s", method, endpoint, res.Status, resp.Meta.Msg)
+	}
+
+	if out != nil {
+		return json.Unmarshal(resp.Data, out)
+	}
+
+	return nil
+}
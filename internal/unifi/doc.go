@@ -0,0 +1,3 @@
+// package unifi provides a client for the parts of the UniFi
+// Network controller API that manage port forwards.
+package unifi
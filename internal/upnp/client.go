@@ -5,12 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"sync"
 	"time"
 
+	"github.com/frantjc/port-forward/internal/logutil"
 	xslices "github.com/frantjc/x/slices"
 	"github.com/huin/goupnp"
 	"github.com/huin/goupnp/dcps/internetgateway1"
 	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/soap"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -19,37 +23,96 @@ type Protocol corev1.Protocol
 
 const (
 	// ProtocolUDP is the UDP Protocol.
-	ProtocolUDP = corev1.ProtocolUDP
+	ProtocolUDP = Protocol(corev1.ProtocolUDP)
 	// ProtocolTCP is the TCP Protocol.
-	ProtocolTCP = corev1.ProtocolTCP
+	ProtocolTCP = Protocol(corev1.ProtocolTCP)
 )
 
 // PortMapping is the mapping of an external port
 // to an internal address.
 type PortMapping struct {
-	RemoteHost     string
-	ExternalPort   int32
-	Protocol       Protocol
-	InternalPort   int32
-	InternalClient net.IP
-	Enabled        bool
-	Description    string
-	LeaseDuration  time.Duration
+	RemoteHost     string   `json:"remoteHost,omitempty"`
+	ExternalPort   int32    `json:"externalPort"`
+	Protocol       Protocol `json:"protocol"`
+	InternalPort   int32    `json:"internalPort"`
+	InternalClient net.IP   `json:"internalClient"`
+	Enabled        bool     `json:"enabled"`
+	Description    string   `json:"description,omitempty"`
+	// Service identifies the Service and port that the port mapping is for
+	// as "<namespace>/<name>:<port>", for implementations that can record it.
+	Service string `json:"-"`
+	// LeaseDuration is how long the port mapping should last. Implementations
+	// whose routers may grant a different lease duration update it to match.
+	LeaseDuration time.Duration `json:"-"`
+	// AssignedExternalPort is set by implementations whose routers may
+	// assign a different external port than the requested ExternalPort.
+	AssignedExternalPort int32 `json:"assignedExternalPort,omitempty"`
+	// AssignedExternalIPAddress is set by implementations whose routers
+	// report which external IP address they assigned to the port mapping.
+	AssignedExternalIPAddress net.IP `json:"assignedExternalIPAddress,omitempty"`
+	// PinholeID is the UniqueID of the IPv6 pinhole opened for the port
+	// mapping by implementations that do so, by which it is renewed and deleted.
+	PinholeID *uint16 `json:"pinholeID,omitempty"`
+	// Nonce is the random nonce that the port mapping was added with by
+	// implementations whose routers require it to renew and delete it.
+	Nonce []byte `json:"nonce,omitempty"`
+}
+
+// PortMappingKey is what a router uses to tell
+// one PortMapping apart from another.
+type PortMappingKey struct {
+	RemoteHost   string
+	ExternalPort int32
+	Protocol     Protocol
+}
+
+// String returns the PortMappingKey as "<external port>/<protocol>",
+// followed by "/<remote host>" if the PortMappingKey has one.
+func (k PortMappingKey) String() string {
+	if k.RemoteHost != "" {
+		return fmt.Sprintf("%d/%s/%s", k.ExternalPort, k.Protocol, k.RemoteHost)
+	}
+
+	return fmt.Sprintf("%d/%s", k.ExternalPort, k.Protocol)
+}
+
+// Key returns the PortMappingKey of the PortMapping.
+func (pm *PortMapping) Key() PortMappingKey {
+	return PortMappingKey{
+		RemoteHost:   pm.RemoteHost,
+		ExternalPort: pm.ExternalPort,
+		Protocol:     pm.Protocol,
+	}
 }
 
 // Client is a wrapper around any goupnp client to standardize
 // the API for doing UPnP operations.
 type Client struct {
-	goUPnPClient GoUPnPClient
+	opts  *NewClientOpts
+	owner string
+	// gateway is the gateway that the Client talks to,
+	// or nil if there is none at the moment.
+	gateway *gateway
+	// lazy is whether the gateway is discovered in
+	// the background by RunDiscovery.
+	lazy       bool
+	rediscover chan struct{}
+	discoverMu sync.Mutex
+	mu         sync.Mutex
 }
 
 // GetExternalIPAddress gets the external IP address via UPnP.
 func (c *Client) GetExternalIPAddress(ctx context.Context) (net.IP, error) {
-	ips, err := c.goUPnPClient.GetExternalIPAddressCtx(ctx)
+	gw, err := c.getGateway(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	ips, err := gw.goUPnPClient.GetExternalIPAddressCtx(ctx)
+	if err != nil {
+		return nil, c.checkError(ctx, gw, err)
+	}
+
 	ip := net.ParseIP(ips)
 	if ip == nil {
 		return nil, fmt.Errorf("unable to parse IP address: %s", ips)
@@ -58,41 +121,107 @@ func (c *Client) GetExternalIPAddress(ctx context.Context) (net.IP, error) {
 	return ip, nil
 }
 
-// GetExternalIPAddress adds the port mapping via UPnP.
+// AddPortMapping adds the port mapping via UPnP. The port mapping's
+// description is marked with the Client's owner so that it can be
+// found again by ListPortMappings. IPv6 is not NATed, so port mappings
+// to IPv6 addresses open a pinhole via WANIPv6FirewallControl instead.
 func (c *Client) AddPortMapping(ctx context.Context, pm *PortMapping) error {
-	return c.goUPnPClient.AddPortMappingCtx(ctx,
+	internalClient := pm.InternalClient.To4()
+	if internalClient == nil {
+		if pm.InternalClient.To16() == nil {
+			return fmt.Errorf("invalid internal client %s", pm.InternalClient)
+		}
+
+		return c.addPinhole(ctx, pm)
+	}
+
+	gw, err := c.getGateway(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.checkError(ctx, gw, gw.goUPnPClient.AddPortMappingCtx(ctx,
 		pm.RemoteHost,
 		uint16(pm.ExternalPort),
 		string(pm.Protocol),
 		uint16(pm.InternalPort),
-		pm.InternalClient.To4().String(),
+		internalClient.String(),
 		pm.Enabled,
-		pm.Description,
+		OwnerMarker(c.owner)+pm.Description,
 		uint32(pm.LeaseDuration.Seconds()),
-	)
+	))
 }
 
-// GetServiceIPAddress gets the IP address of the router.
-func (c *Client) GetServiceIPAddress(context.Context) (net.IP, error) {
-	location := c.goUPnPClient.GetServiceClient().Location
+// OwnerMarker returns the marker that is prepended to the description
+// of port mappings to mark them as owned by the given owner.
+func OwnerMarker(owner string) string {
+	return "[" + owner + "] "
+}
+
+// DeletePortMapping deletes the port mapping via UPnP, or its pinhole
+// if it is to an IPv6 address. It is not an error if the port mapping
+// does not exist.
+func (c *Client) DeletePortMapping(ctx context.Context, pm *PortMapping) error {
+	if pm.InternalClient != nil && pm.InternalClient.To4() == nil {
+		return c.deletePinhole(ctx, pm)
+	}
+
+	gw, err := c.getGateway(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := gw.goUPnPClient.DeletePortMappingCtx(ctx,
+		pm.RemoteHost,
+		uint16(pm.ExternalPort),
+		string(pm.Protocol),
+	); err != nil && errorCode(err) != errorCodeNoSuchEntryInArray {
+		return c.checkError(ctx, gw, err)
+	}
+
+	return nil
+}
 
-	ips, err := net.LookupIP(location.Hostname())
+// GetServiceIPAddress gets the IP address of the router. It is
+// resolved from the router's location once and then cached until
+// the gateway is rediscovered.
+func (c *Client) GetServiceIPAddress(ctx context.Context) (net.IP, error) {
+	gw, err := c.getGateway(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, ip := range ips {
-		if ip != nil {
-			return ip, nil
-		}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gw.serviceIPAddress != nil {
+		return gw.serviceIPAddress, nil
+	}
+
+	location := gw.goUPnPClient.GetServiceClient().Location
+
+	ip, err := lookupIPAddress(location)
+	if err != nil {
+		return nil, fmt.Errorf("resolve UPnP service location %s: %w", location, err)
 	}
+	gw.serviceIPAddress = ip
 
-	return nil, fmt.Errorf("no IP addresses found for UPnP service location %s", location)
+	return ip, nil
 }
 
-// GetSourceIPAddress gets the IP address of the client.
-func (c *Client) GetSourceIPAddress(context.Context) net.IP {
-	return c.goUPnPClient.GetServiceClient().LocalAddr()
+// GetSourceIPAddress gets the IP address of the client,
+// or nil if there is no gateway at the moment.
+func (c *Client) GetSourceIPAddress(ctx context.Context) net.IP {
+	gw, err := c.getGateway(ctx)
+	if err != nil {
+		return nil
+	}
+
+	if gw.sourceIPAddress != nil {
+		return gw.sourceIPAddress
+	}
+
+	return gw.goUPnPClient.GetServiceClient().LocalAddr()
 }
 
 type GoUPnPClient interface {
@@ -115,6 +244,30 @@ type GoUPnPClient interface {
 		uint16,
 		string,
 	) error
+	GetGenericPortMappingEntryCtx(
+		context.Context,
+		uint16,
+	) (string, uint16, string, uint16, string, bool, string, uint32, error)
+}
+
+const (
+	// errorCodeSpecifiedArrayIndexInvalid is the UPnP error code
+	// returned when the specified port mapping index is out of bounds.
+	errorCodeSpecifiedArrayIndexInvalid = 713
+	// errorCodeNoSuchEntryInArray is the UPnP error code
+	// returned when the specified port mapping does not exist.
+	errorCodeNoSuchEntryInArray = 714
+)
+
+// errorCode returns the UPnP error code from the
+// given error's SOAP fault, if any.
+func errorCode(err error) int {
+	fault := &soap.SOAPFaultError{}
+	if errors.As(err, &fault) {
+		return fault.Detail.UPnPError.Errorcode
+	}
+
+	return 0
 }
 
 var (
@@ -125,7 +278,16 @@ var (
 type getClients func(context.Context) ([]GoUPnPClient, []error, error)
 
 type NewClientOpts struct {
-	getClients []getClients
+	getClients            []getClients
+	firewallControlClient GoUPnPFirewallControlClient
+	gatewayMatcher        *GatewayMatcher
+	location              *url.URL
+	iface                 *net.Interface
+	rootDevices           map[string]*goupnp.RootDevice
+	// defaultConnectionServices caches the default connection
+	// service of each gateway by location for one discovery.
+	defaultConnectionServices map[string]*defaultConnectionService
+	owner                     string
 }
 
 type NewClientOpt func(*NewClientOpts)
@@ -141,10 +303,7 @@ func WithIG2WANIPConnection2(opts *NewClientOpts) {
 		opts.getClients = []getClients{}
 	}
 
-	opts.getClients = append(opts.getClients, func(ctx context.Context) ([]GoUPnPClient, []error, error) {
-		clients, errs, err := internetgateway2.NewWANIPConnection2ClientsCtx(ctx)
-		return castToGoUPnPClients(clients), errs, err
-	})
+	opts.getClients = append(opts.getClients, getClientsOf(opts, internetgateway2.URN_WANIPConnection_2, internetgateway2.NewWANIPConnection2ClientsCtx, internetgateway2.NewWANIPConnection2ClientsFromRootDevice))
 }
 
 func WithIG2WANIPConnection1(opts *NewClientOpts) {
@@ -152,10 +311,7 @@ func WithIG2WANIPConnection1(opts *NewClientOpts) {
 		opts.getClients = []getClients{}
 	}
 
-	opts.getClients = append(opts.getClients, func(ctx context.Context) ([]GoUPnPClient, []error, error) {
-		clients, errs, err := internetgateway2.NewWANIPConnection1ClientsCtx(ctx)
-		return castToGoUPnPClients(clients), errs, err
-	})
+	opts.getClients = append(opts.getClients, getClientsOf(opts, internetgateway2.URN_WANIPConnection_1, internetgateway2.NewWANIPConnection1ClientsCtx, internetgateway2.NewWANIPConnection1ClientsFromRootDevice))
 }
 
 func WithIG2WANPPPConnection1(opts *NewClientOpts) {
@@ -163,10 +319,7 @@ func WithIG2WANPPPConnection1(opts *NewClientOpts) {
 		opts.getClients = []getClients{}
 	}
 
-	opts.getClients = append(opts.getClients, func(ctx context.Context) ([]GoUPnPClient, []error, error) {
-		clients, errs, err := internetgateway2.NewWANPPPConnection1ClientsCtx(ctx)
-		return castToGoUPnPClients(clients), errs, err
-	})
+	opts.getClients = append(opts.getClients, getClientsOf(opts, internetgateway2.URN_WANPPPConnection_1, internetgateway2.NewWANPPPConnection1ClientsCtx, internetgateway2.NewWANPPPConnection1ClientsFromRootDevice))
 }
 
 func WithIG1WANIP1Connection1(opts *NewClientOpts) {
@@ -174,10 +327,7 @@ func WithIG1WANIP1Connection1(opts *NewClientOpts) {
 		opts.getClients = []getClients{}
 	}
 
-	opts.getClients = append(opts.getClients, func(ctx context.Context) ([]GoUPnPClient, []error, error) {
-		clients, errs, err := internetgateway1.NewWANIPConnection1ClientsCtx(ctx)
-		return castToGoUPnPClients(clients), errs, err
-	})
+	opts.getClients = append(opts.getClients, getClientsOf(opts, internetgateway1.URN_WANIPConnection_1, internetgateway1.NewWANIPConnection1ClientsCtx, internetgateway1.NewWANIPConnection1ClientsFromRootDevice))
 }
 
 func WithIG1WANPPP1Connection1(opts *NewClientOpts) {
@@ -185,10 +335,7 @@ func WithIG1WANPPP1Connection1(opts *NewClientOpts) {
 		opts.getClients = []getClients{}
 	}
 
-	opts.getClients = append(opts.getClients, func(ctx context.Context) ([]GoUPnPClient, []error, error) {
-		clients, errs, err := internetgateway1.NewWANPPPConnection1ClientsCtx(ctx)
-		return castToGoUPnPClients(clients), errs, err
-	})
+	opts.getClients = append(opts.getClients, getClientsOf(opts, internetgateway1.URN_WANPPPConnection_1, internetgateway1.NewWANPPPConnection1ClientsCtx, internetgateway1.NewWANPPPConnection1ClientsFromRootDevice))
 }
 
 func WithAnyConnection(opts *NewClientOpts) {
@@ -210,36 +357,156 @@ func WithGoUPnPClient(client GoUPnPClient) NewClientOpt {
 	}
 }
 
+// WithFirewallControlClient sets the client used to open IPv6 pinholes instead of
+// looking for the WANIPv6FirewallControl service on the router that is found.
+func WithFirewallControlClient(client GoUPnPFirewallControlClient) NewClientOpt {
+	return func(opts *NewClientOpts) {
+		opts.firewallControlClient = client
+	}
+}
+
+// WithGatewayMatcher pins which of the discovered gateways to use
+// instead of using the first one found.
+func WithGatewayMatcher(gatewayMatcher *GatewayMatcher) NewClientOpt {
+	return func(opts *NewClientOpts) {
+		opts.gatewayMatcher = gatewayMatcher
+	}
+}
+
+// DefaultOwner is the owner that port mappings are marked
+// with if no other owner is given via WithOwner.
+const DefaultOwner = "portfwd"
+
+// WithOwner sets the owner to mark port mappings with. Clients that share a
+// router should use different owners so that they do not garbage collect each
+// other's port mappings.
+func WithOwner(owner string) NewClientOpt {
+	return func(opts *NewClientOpts) {
+		opts.owner = owner
+	}
+}
+
+// NewClient discovers a gateway to create a Client for. The kinds of clients
+// given by opts are tried in order, and the first gateway found that matches
+// the GatewayMatcher, if any, is used. Every gateway found is logged along
+// with why it was rejected, if it was. If no gateway is used, the returned
+// error wraps ErrNoClients and says why each one found was rejected.
+//
+// If the gateway goes away, such as when it reboots and comes back with a
+// new SOAP port, it is discovered again when the Client is next used.
 func NewClient(ctx context.Context, opts ...NewClientOpt) (*Client, error) {
-	o := &NewClientOpts{}
+	c := newClient(opts...)
+
+	if _, err := c.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func newClient(opts ...NewClientOpt) *Client {
+	o := &NewClientOpts{owner: DefaultOwner}
 
 	for _, opt := range opts {
 		opt(o)
 	}
 
+	return &Client{
+		opts:       o,
+		owner:      o.owner,
+		rediscover: make(chan struct{}, 1),
+	}
+}
+
+// discoverGateway finds the gateway as described by NewClient.
+func (o *NewClientOpts) discoverGateway(ctx context.Context) (*gateway, error) {
+	// The gateway's device description may have changed since it was
+	// last loaded, so that must not be cached between discoveries.
+	o.rootDevices = nil
+	o.defaultConnectionServices = nil
+
+	rejections := []error{ErrNoClients}
+
 	for _, getClient := range o.getClients {
-		goUPnPClient, err := getOneGoUPnPClient(ctx, getClient)
+		goUPnPClient, clientRejections, err := o.getOneGoUPnPClient(ctx, getClient)
 		if err != nil {
-			if errors.Is(err, ErrNoClients) {
-				continue
-			}
+			return nil, err
+		} else if goUPnPClient == nil {
+			rejections = append(rejections, clientRejections...)
+			continue
+		}
 
+		firewallControlClient := o.firewallControlClient
+		if firewallControlClient == nil {
+			firewallControlClient = getFirewallControlClient(goUPnPClient)
+		}
+
+		sourceIPAddress, err := o.getSourceIPAddress(goUPnPClient.GetServiceClient().Location)
+		if err != nil {
 			return nil, err
 		}
 
-		return &Client{goUPnPClient}, nil
+		return &gateway{
+			goUPnPClient:          goUPnPClient,
+			firewallControlClient: firewallControlClient,
+			sourceIPAddress:       sourceIPAddress,
+		}, nil
 	}
 
-	return nil, ErrNoClients
+	return nil, errors.Join(rejections...)
 }
 
-func getOneGoUPnPClient(ctx context.Context, f getClients) (GoUPnPClient, error) {
-	clients, _, err := f(ctx)
+// getOneGoUPnPClient returns the first client from f for a gateway that matches
+// the GatewayMatcher, if any, and for the service that the gateway says is its
+// default connection service, if it does, along with why each other gateway
+// was rejected.
+func (o *NewClientOpts) getOneGoUPnPClient(ctx context.Context, f getClients) (GoUPnPClient, []error, error) {
+	clients, errs, err := f(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("get clients: %w", err)
-	} else if len(clients) == 0 {
-		return nil, ErrNoClients
+		return nil, nil, fmt.Errorf("get clients: %w", err)
+	}
+
+	var (
+		log        = logutil.SloggerFrom(ctx)
+		chosen     GoUPnPClient
+		rejections = []error{}
+	)
+
+	for _, err := range errs {
+		log.Info("rejected gateway", "reason", err)
+		rejections = append(rejections, fmt.Errorf("rejected gateway: %w", err))
+	}
+
+	for _, client := range clients {
+		log := log.With(describeGateway(client)...)
+
+		reason := o.gatewayMatcher.reject(client)
+		if reason == nil {
+			reason = o.rejectNonDefaultConnection(ctx, client)
+		}
+		if reason == nil && chosen != nil {
+			reason = errors.New("another gateway was found first")
+		}
+
+		if reason != nil {
+			log.Info("rejected gateway", "reason", reason)
+			rejections = append(rejections, fmt.Errorf("rejected gateway at %s: %w", gatewayLocation(client), reason))
+			continue
+		}
+
+		log.Info("chose gateway")
+		chosen = client
+	}
+
+	return chosen, rejections, nil
+}
+
+// gatewayLocation returns the location of the gateway
+// that the given GoUPnPClient is for, if known.
+func gatewayLocation(goUPnPClient GoUPnPClient) string {
+	if serviceClient := goUPnPClient.GetServiceClient(); serviceClient != nil && serviceClient.Location != nil {
+		return serviceClient.Location.String()
 	}
 
-	return clients[0], nil
+	return "unknown location"
 }
@@ -0,0 +1,244 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/httpu"
+	"github.com/huin/goupnp/ssdp"
+)
+
+// WithLocation skips discovery via SSDP and instead loads
+// the gateway's device description from the given URL.
+func WithLocation(location *url.URL) NewClientOpt {
+	return func(opts *NewClientOpts) {
+		opts.location = location
+	}
+}
+
+// WithInterface binds discovery via SSDP to the given network interface
+// instead of searching from every multicast-capable one, and has the
+// Client talk to the gateway from the interface's address.
+func WithInterface(iface *net.Interface) NewClientOpt {
+	return func(opts *NewClientOpts) {
+		opts.iface = iface
+	}
+}
+
+// getClientsOf returns a getClients that finds clients for the service with the
+// given URN. By default, it discovers them via SSDP with discover, but if the
+// NewClientOpts have a location or interface, it finds the gateway's device
+// description itself and gets them from it with fromRootDevice.
+func getClientsOf[client GoUPnPClient](
+	opts *NewClientOpts,
+	urn string,
+	discover func(context.Context) ([]client, []error, error),
+	fromRootDevice func(*goupnp.RootDevice, *url.URL) ([]client, error),
+) getClients {
+	return func(ctx context.Context) ([]GoUPnPClient, []error, error) {
+		if opts.location == nil && opts.iface == nil {
+			clients, errs, err := discover(ctx)
+			return castToGoUPnPClients(clients), errs, err
+		}
+
+		locations := []*url.URL{opts.location}
+		if opts.location == nil {
+			var err error
+			if locations, err = searchInterface(ctx, opts.iface, urn); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		var (
+			clients = []GoUPnPClient{}
+			errs    = []error{}
+		)
+		for _, location := range locations {
+			rootDevice, err := opts.getRootDevice(ctx, location)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			locationClients, err := fromRootDevice(rootDevice, location)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			clients = append(clients, castToGoUPnPClients(locationClients)...)
+		}
+
+		return clients, errs, nil
+	}
+}
+
+// getRootDevice loads the device description at the given location, caching
+// it so that it is not loaded again for each kind of client that is tried.
+func (o *NewClientOpts) getRootDevice(ctx context.Context, location *url.URL) (*goupnp.RootDevice, error) {
+	if rootDevice, ok := o.rootDevices[location.String()]; ok {
+		return rootDevice, nil
+	}
+
+	rootDevice, err := goupnp.DeviceByURLCtx(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.rootDevices == nil {
+		o.rootDevices = map[string]*goupnp.RootDevice{}
+	}
+	o.rootDevices[location.String()] = rootDevice
+
+	return rootDevice, nil
+}
+
+// searchInterface searches for the service with the given URN via SSDP
+// from the IPv4 addresses of the given interface, returning the locations
+// of the device descriptions of the gateways that responded.
+func searchInterface(ctx context.Context, iface *net.Interface, urn string) ([]*url.URL, error) {
+	addrs, err := interfaceIPAddresses(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		delegates = []httpu.ClientInterfaceCtx{}
+		closers   = []*httpu.HTTPUClient{}
+	)
+	defer func() {
+		for _, closer := range closers {
+			_ = closer.Close()
+		}
+	}()
+
+	for _, addr := range addrs {
+		// SSDP is IPv4 multicast.
+		if addr.To4() == nil {
+			continue
+		}
+
+		httpuClient, err := httpu.NewHTTPUClientAddr(addr.String())
+		if err != nil {
+			return nil, fmt.Errorf("create HTTPU client for address %s on interface %s: %w", addr, iface.Name, err)
+		}
+
+		closers = append(closers, httpuClient)
+		delegates = append(delegates, httpuClient)
+	}
+
+	if len(delegates) == 0 {
+		return nil, fmt.Errorf("interface %s has no IPv4 addresses to search from", iface.Name)
+	}
+
+	searchCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	responses, err := ssdp.RawSearch(searchCtx, httpu.NewMultiClientCtx(delegates), urn, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := []*url.URL{}
+	for _, response := range responses {
+		if location, err := response.Location(); err == nil {
+			locations = append(locations, location)
+		}
+	}
+
+	return locations, nil
+}
+
+// getSourceIPAddress returns the IP address that the Client talks to the gateway
+// at the given location from. goupnp only knows it for gateways that it discovered
+// itself, so it is worked out here for those found via a location or interface.
+func (o *NewClientOpts) getSourceIPAddress(location *url.URL) (net.IP, error) {
+	if o.location == nil && o.iface == nil {
+		return nil, nil
+	}
+
+	gatewayIPAddress, err := lookupIPAddress(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.iface != nil {
+		addrs, err := interfaceIPAddresses(o.iface)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			if (addr.To4() == nil) == (gatewayIPAddress.To4() == nil) {
+				return addr, nil
+			}
+		}
+
+		return nil, fmt.Errorf("interface %s has no address of the same family as gateway IP address %s", o.iface.Name, gatewayIPAddress)
+	}
+
+	// Dialing UDP does not send anything, but picks
+	// the address that traffic to the gateway is from.
+	conn, err := net.Dial("udp", net.JoinHostPort(gatewayIPAddress.String(), locationPort(location)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return udpAddr.IP, nil
+	}
+
+	return nil, fmt.Errorf("unable to determine source IP address for gateway at %s", location)
+}
+
+// interfaceIPAddresses returns the IP addresses of the given interface.
+func interfaceIPAddresses(iface *net.Interface) ([]net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("get addresses of interface %s: %w", iface.Name, err)
+	}
+
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	return ips, nil
+}
+
+// lookupIPAddress returns the IP address of the host of the given location.
+func lookupIPAddress(location *url.URL) (net.IP, error) {
+	ips, err := net.LookupIP(location.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		if ip != nil {
+			return ip, nil
+		}
+	}
+
+	return nil, errors.New("no IP addresses found for location " + location.String())
+}
+
+// locationPort returns the port of the given location, defaulting by its scheme.
+func locationPort(location *url.URL) string {
+	if port := location.Port(); port != "" {
+		return port
+	}
+
+	if location.Scheme == "https" {
+		return "443"
+	}
+
+	return "80"
+}
@@ -0,0 +1,100 @@
+package upnp_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+const testRootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<specVersion><major>1</major><minor>0</minor></specVersion>
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+		<friendlyName>Router</friendlyName>
+		<UDN>uuid:router</UDN>
+		<deviceList>
+			<device>
+				<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+				<deviceList>
+					<device>
+						<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+						<serviceList>
+							<service>
+								<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+								<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+								<controlURL>/ctl/IPConn</controlURL>
+								<eventSubURL>/evt/IPConn</eventSubURL>
+								<SCPDURL>/WANIPCn.xml</SCPDURL>
+							</service>
+						</serviceList>
+					</device>
+				</deviceList>
+			</device>
+		</deviceList>
+	</device>
+</root>`
+
+func TestNewClientWithLocation(t *testing.T) {
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rootDesc.xml" {
+			http.NotFound(w, r)
+			return
+		}
+
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(testRootDesc))
+	}))
+	defer server.Close()
+
+	location, err := url.Parse(server.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatalf("parse location: %v", err)
+	}
+
+	client, err := upnp.NewClient(t.Context(), upnp.WithAnyConnection, upnp.WithLocation(location), upnp.WithGatewayMatcher(&upnp.GatewayMatcher{UDN: "uuid:router"}))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	// The device description should only be loaded
+	// once even though several kinds of clients are tried.
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("expected device description to be requested once, got %d", n)
+	}
+
+	serviceIPAddress, err := client.GetServiceIPAddress(t.Context())
+	if err != nil {
+		t.Fatalf("get service IP address: %v", err)
+	}
+
+	if !serviceIPAddress.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected service IP address 127.0.0.1, got %s", serviceIPAddress)
+	}
+
+	if sourceIPAddress := client.GetSourceIPAddress(t.Context()); !sourceIPAddress.IsLoopback() {
+		t.Fatalf("expected loopback source IP address, got %s", sourceIPAddress)
+	}
+}
+
+func TestNewClientWithUnreachableLocation(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	location, err := url.Parse(server.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatalf("parse location: %v", err)
+	}
+
+	if _, err := upnp.NewClient(t.Context(), upnp.WithAnyConnection, upnp.WithLocation(location)); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,62 @@
+package upnp
+
+import (
+	"fmt"
+)
+
+// ErrorCode is the UPnP error code of a SOAP fault returned by a gateway.
+// Errors returned by the Client wrap the ErrorCode of the SOAP fault that
+// caused them, if it is one of these, so that they can be told apart with
+// errors.Is.
+type ErrorCode int
+
+const (
+	// ErrorCodeActionNotAuthorized is returned when the gateway
+	// does not allow the Client to perform the action.
+	ErrorCodeActionNotAuthorized ErrorCode = 606
+	// ErrorCodeConflictInMappingEntry is returned when the port mapping
+	// conflicts with one that the gateway has for another internal client.
+	ErrorCodeConflictInMappingEntry ErrorCode = 718
+	// ErrorCodeSamePortValuesRequired is returned when the gateway requires
+	// the port mapping's internal and external ports to be the same.
+	ErrorCodeSamePortValuesRequired ErrorCode = 724
+	// ErrorCodeOnlyPermanentLeasesSupported is returned when the
+	// gateway requires the port mapping's lease duration to be 0.
+	ErrorCodeOnlyPermanentLeasesSupported ErrorCode = 725
+	// ErrorCodeNoPortMapsAvailable is returned when the
+	// gateway has no room for any more port mappings.
+	ErrorCodeNoPortMapsAvailable ErrorCode = 728
+)
+
+// Error implements error.
+func (c ErrorCode) Error() string {
+	switch c {
+	case ErrorCodeActionNotAuthorized:
+		return "action not authorized"
+	case ErrorCodeConflictInMappingEntry:
+		return "conflict in mapping entry"
+	case ErrorCodeSamePortValuesRequired:
+		return "same port values required"
+	case ErrorCodeOnlyPermanentLeasesSupported:
+		return "only permanent leases supported"
+	case ErrorCodeNoPortMapsAvailable:
+		return "no port maps available"
+	}
+
+	return fmt.Sprintf("error code %d", int(c))
+}
+
+// typedError wraps the given error with the ErrorCode
+// of its SOAP fault, if it is one of the known ones.
+func typedError(err error) error {
+	switch code := ErrorCode(errorCode(err)); code {
+	case ErrorCodeActionNotAuthorized,
+		ErrorCodeConflictInMappingEntry,
+		ErrorCodeSamePortValuesRequired,
+		ErrorCodeOnlyPermanentLeasesSupported,
+		ErrorCodeNoPortMapsAvailable:
+		return fmt.Errorf("%w: %w", code, err)
+	}
+
+	return err
+}
@@ -0,0 +1,55 @@
+package upnp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/huin/goupnp/soap"
+)
+
+type testFaultGoUPnPClient struct {
+	testGoUPnPClient
+	errorCode int
+}
+
+func (c *testFaultGoUPnPClient) AddPortMappingCtx(context.Context, string, uint16, string, uint16, string, bool, string, uint32) error {
+	fault := &soap.SOAPFaultError{}
+	fault.Detail.UPnPError.Errorcode = c.errorCode
+	return fault
+}
+
+func TestClientAddPortMappingErrorCodes(t *testing.T) {
+	for _, errorCode := range []upnp.ErrorCode{
+		upnp.ErrorCodeActionNotAuthorized,
+		upnp.ErrorCodeConflictInMappingEntry,
+		upnp.ErrorCodeSamePortValuesRequired,
+		upnp.ErrorCodeOnlyPermanentLeasesSupported,
+		upnp.ErrorCodeNoPortMapsAvailable,
+	} {
+		t.Run(errorCode.Error(), func(t *testing.T) {
+			client, err := upnp.NewClient(t.Context(), upnp.WithGoUPnPClient(&testFaultGoUPnPClient{errorCode: int(errorCode)}))
+			if err != nil {
+				t.Fatalf("new client: %v", err)
+			}
+
+			err = client.AddPortMapping(t.Context(), &upnp.PortMapping{
+				ExternalPort:   80,
+				Protocol:       upnp.ProtocolTCP,
+				InternalPort:   80,
+				InternalClient: net.IPv4(192, 168, 0, 2),
+				Enabled:        true,
+			})
+			if !errors.Is(err, errorCode) {
+				t.Fatalf("expected error to be %d, got %v", int(errorCode), err)
+			}
+
+			fault := &soap.SOAPFaultError{}
+			if !errors.As(err, &fault) {
+				t.Fatalf("expected error to still be a SOAP fault, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// GatewayMatcher pins which of the discovered gateways to use. Its
+// empty fields match any gateway.
+type GatewayMatcher struct {
+	// UDN is the gateway's unique device name, e.g. "uuid:...".
+	UDN string
+	// FriendlyName is the gateway's friendly name. It is matched case-insensitively.
+	FriendlyName string
+	// Location is the URL of the gateway's device description.
+	Location string
+	// IP is the gateway's LAN IP address, i.e. that of its Location.
+	IP net.IP
+}
+
+// IsZero reports whether the GatewayMatcher matches any gateway.
+func (m *GatewayMatcher) IsZero() bool {
+	return m == nil || (m.UDN == "" && m.FriendlyName == "" && m.Location == "" && m.IP == nil)
+}
+
+// reject returns why the gateway that the given GoUPnPClient
+// is for does not match, or nil if it does.
+func (m *GatewayMatcher) reject(goUPnPClient GoUPnPClient) error {
+	if m.IsZero() {
+		return nil
+	}
+
+	serviceClient := goUPnPClient.GetServiceClient()
+	if serviceClient == nil || serviceClient.RootDevice == nil || serviceClient.Location == nil {
+		return errors.New("gateway does not describe itself")
+	}
+
+	device := serviceClient.RootDevice.Device
+
+	if m.UDN != "" && device.UDN != m.UDN {
+		return fmt.Errorf("UDN %s is not %s", device.UDN, m.UDN)
+	}
+
+	if m.FriendlyName != "" && !strings.EqualFold(device.FriendlyName, m.FriendlyName) {
+		return fmt.Errorf("friendly name %q is not %q", device.FriendlyName, m.FriendlyName)
+	}
+
+	if m.Location != "" && serviceClient.Location.String() != m.Location {
+		return fmt.Errorf("location %s is not %s", serviceClient.Location, m.Location)
+	}
+
+	if m.IP != nil {
+		ips, err := net.LookupIP(serviceClient.Location.Hostname())
+		if err != nil {
+			return fmt.Errorf("look up IP address of location %s: %w", serviceClient.Location, err)
+		}
+
+		found := false
+		for _, ip := range ips {
+			if ip.Equal(m.IP) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("IP addresses %v of location %s are not %s", ips, serviceClient.Location, m.IP)
+		}
+	}
+
+	return nil
+}
+
+// describeGateway returns attributes identifying the gateway that
+// the given GoUPnPClient is for, for reporting discovered candidates.
+func describeGateway(goUPnPClient GoUPnPClient) []any {
+	serviceClient := goUPnPClient.GetServiceClient()
+	if serviceClient == nil {
+		return nil
+	}
+
+	attrs := []any{}
+	if serviceClient.RootDevice != nil {
+		attrs = append(attrs, "udn", serviceClient.RootDevice.Device.UDN, "friendlyName", serviceClient.RootDevice.Device.FriendlyName)
+	}
+	if serviceClient.Location != nil {
+		attrs = append(attrs, "location", serviceClient.Location.String())
+	}
+	if serviceClient.Service != nil {
+		attrs = append(attrs, "serviceType", serviceClient.Service.ServiceType)
+	}
+
+	return attrs
+}
@@ -0,0 +1,73 @@
+package upnp_test
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/huin/goupnp"
+)
+
+type testGatewayGoUPnPClient struct {
+	testGoUPnPClient
+	serviceClient *goupnp.ServiceClient
+}
+
+func (c *testGatewayGoUPnPClient) GetServiceClient() *goupnp.ServiceClient {
+	return c.serviceClient
+}
+
+func newTestGatewayGoUPnPClient(t *testing.T, udn, friendlyName, location string) *testGatewayGoUPnPClient {
+	t.Helper()
+
+	loc, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("parse location: %v", err)
+	}
+
+	rootDevice := &goupnp.RootDevice{}
+	rootDevice.Device.UDN = udn
+	rootDevice.Device.FriendlyName = friendlyName
+
+	return &testGatewayGoUPnPClient{
+		serviceClient: &goupnp.ServiceClient{
+			RootDevice: rootDevice,
+			Location:   loc,
+		},
+	}
+}
+
+func TestNewClientWithGatewayMatcher(t *testing.T) {
+	goUPnPClient := newTestGatewayGoUPnPClient(t, "uuid:router", "Router", "http://192.168.0.1:5000/rootDesc.xml")
+
+	for _, gatewayMatcher := range []*upnp.GatewayMatcher{
+		nil,
+		{UDN: "uuid:router"},
+		{FriendlyName: "router"},
+		{Location: "http://192.168.0.1:5000/rootDesc.xml"},
+		{IP: net.ParseIP("192.168.0.1")},
+		{UDN: "uuid:router", IP: net.ParseIP("192.168.0.1")},
+	} {
+		if _, err := upnp.NewClient(t.Context(), upnp.WithGoUPnPClient(goUPnPClient), upnp.WithGatewayMatcher(gatewayMatcher)); err != nil {
+			t.Fatalf("expected gateway to match %+v, got %v", gatewayMatcher, err)
+		}
+	}
+
+	for reason, gatewayMatcher := range map[string]*upnp.GatewayMatcher{
+		"UDN uuid:router is not uuid:modem":                                                      {UDN: "uuid:modem"},
+		`friendly name "Router" is not "Mesh"`:                                                   {FriendlyName: "Mesh"},
+		"location http://192.168.0.1:5000/rootDesc.xml is not http://192.168.0.254/rootDesc.xml": {Location: "http://192.168.0.254/rootDesc.xml"},
+		"are not 192.168.0.254":                                                                  {IP: net.ParseIP("192.168.0.254")},
+	} {
+		_, err := upnp.NewClient(t.Context(), upnp.WithGoUPnPClient(goUPnPClient), upnp.WithGatewayMatcher(gatewayMatcher))
+		if err == nil {
+			t.Fatalf("expected gateway not to match %+v", gatewayMatcher)
+		}
+
+		if !strings.Contains(err.Error(), reason) {
+			t.Fatalf("expected error to say %q, got %q", reason, err.Error())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/frantjc/port-forward/internal/logutil"
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway1"
+)
+
+// defaultConnectionService is the WAN connection service that a gateway's
+// Layer3Forwarding service says is in use.
+type defaultConnectionService struct {
+	// udn is that of the WANConnectionDevice that the service is on.
+	udn string
+	// serviceID is the service's ID, e.g. "urn:upnp-org:serviceId:WANIPConn1".
+	serviceID string
+	// raw is the defaultConnectionService as Layer3Forwarding returned it.
+	raw string
+}
+
+// String returns the defaultConnectionService
+// as Layer3Forwarding returned it.
+func (s *defaultConnectionService) String() string {
+	return s.raw
+}
+
+// parseDefaultConnectionService parses the result of Layer3Forwarding's
+// GetDefaultConnectionService, which looks like
+// "uuid:<UDN>:WANConnectionDevice:1,urn:upnp-org:serviceId:WANIPConn1".
+func parseDefaultConnectionService(s string) (*defaultConnectionService, error) {
+	device, serviceID, ok := strings.Cut(s, ",")
+	if !ok || serviceID == "" {
+		return nil, fmt.Errorf("invalid default connection service %q", s)
+	}
+
+	udn, _, _ := strings.Cut(device, ":WANConnectionDevice:")
+
+	return &defaultConnectionService{
+		udn:       udn,
+		serviceID: serviceID,
+		raw:       s,
+	}, nil
+}
+
+// getDefaultConnectionService returns the default connection service of the gateway
+// that the given GoUPnPClient is for, or nil if the gateway does not say, such as
+// when it does not offer Layer3Forwarding. It is cached by the gateway's location
+// so that it is not asked again for each kind of client that is tried.
+func (o *NewClientOpts) getDefaultConnectionService(ctx context.Context, goUPnPClient GoUPnPClient) *defaultConnectionService {
+	serviceClient := goUPnPClient.GetServiceClient()
+	if serviceClient == nil || serviceClient.RootDevice == nil || serviceClient.Location == nil {
+		return nil
+	}
+
+	location := serviceClient.Location.String()
+	if service, ok := o.defaultConnectionServices[location]; ok {
+		return service
+	}
+
+	service := lookupDefaultConnectionService(ctx, serviceClient.RootDevice, serviceClient.Location)
+
+	if o.defaultConnectionServices == nil {
+		o.defaultConnectionServices = map[string]*defaultConnectionService{}
+	}
+	o.defaultConnectionServices[location] = service
+
+	return service
+}
+
+// lookupDefaultConnectionService asks the given gateway's Layer3Forwarding
+// service for its default connection service. Gateways that fail to answer
+// are treated as if they did not offer Layer3Forwarding.
+func lookupDefaultConnectionService(ctx context.Context, rootDevice *goupnp.RootDevice, location *url.URL) *defaultConnectionService {
+	log := logutil.SloggerFrom(ctx).With("location", location.String())
+
+	// Layer3Forwarding:1 is the same service in IGD1 and IGD2.
+	clients, err := internetgateway1.NewLayer3Forwarding1ClientsFromRootDevice(rootDevice, location)
+	if err != nil || len(clients) == 0 {
+		log.Debug("gateway does not offer Layer3Forwarding")
+		return nil
+	}
+
+	s, err := clients[0].GetDefaultConnectionServiceCtx(ctx)
+	if err != nil {
+		log.Info("get default connection service failed", "err", err)
+		return nil
+	} else if s == "" {
+		return nil
+	}
+
+	defaultConnectionService, err := parseDefaultConnectionService(s)
+	if err != nil {
+		log.Info("get default connection service failed", "err", err)
+		return nil
+	}
+
+	log.Info("found default connection service", "defaultConnectionService", s)
+
+	return defaultConnectionService
+}
+
+// rejectNonDefaultConnection returns why the given GoUPnPClient is not for the
+// service that its gateway says is the default connection service, or nil if it
+// is or the gateway does not say.
+func (o *NewClientOpts) rejectNonDefaultConnection(ctx context.Context, goUPnPClient GoUPnPClient) error {
+	defaultConnectionService := o.getDefaultConnectionService(ctx, goUPnPClient)
+	if defaultConnectionService == nil {
+		return nil
+	}
+
+	serviceClient := goUPnPClient.GetServiceClient()
+	if serviceClient.Service == nil || serviceClient.Service.ServiceId != defaultConnectionService.serviceID {
+		return fmt.Errorf("not the default connection service %s", defaultConnectionService)
+	}
+
+	if defaultConnectionService.udn != "" {
+		if udn := connectionDeviceUDN(serviceClient); udn != defaultConnectionService.udn {
+			return fmt.Errorf("not the default connection service %s", defaultConnectionService)
+		}
+	}
+
+	return nil
+}
+
+// connectionDeviceUDN returns the UDN of the
+// device that the given ServiceClient's service is on.
+func connectionDeviceUDN(serviceClient *goupnp.ServiceClient) string {
+	udn := ""
+	serviceClient.RootDevice.Device.VisitDevices(func(device *goupnp.Device) {
+		for i := range device.Services {
+			if &device.Services[i] == serviceClient.Service {
+				udn = device.UDN
+			}
+		}
+	})
+
+	return udn
+}
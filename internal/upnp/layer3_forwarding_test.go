@@ -0,0 +1,145 @@
+package upnp_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+const testDualWANRootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<specVersion><major>1</major><minor>0</minor></specVersion>
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+		<friendlyName>Router</friendlyName>
+		<UDN>uuid:router</UDN>
+		<serviceList>%s</serviceList>
+		<deviceList>
+			<device>
+				<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+				<deviceList>
+					<device>
+						<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+						<UDN>uuid:wanconn-ip</UDN>
+						<serviceList>
+							<service>
+								<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+								<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+								<controlURL>/ctl/IPConn</controlURL>
+								<eventSubURL>/evt/IPConn</eventSubURL>
+								<SCPDURL>/WANIPCn.xml</SCPDURL>
+							</service>
+						</serviceList>
+					</device>
+					<device>
+						<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+						<UDN>uuid:wanconn-ppp</UDN>
+						<serviceList>
+							<service>
+								<serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType>
+								<serviceId>urn:upnp-org:serviceId:WANPPPConn1</serviceId>
+								<controlURL>/ctl/PPPConn</controlURL>
+								<eventSubURL>/evt/PPPConn</eventSubURL>
+								<SCPDURL>/WANPPPCn.xml</SCPDURL>
+							</service>
+						</serviceList>
+					</device>
+				</deviceList>
+			</device>
+		</deviceList>
+	</device>
+</root>`
+
+const testLayer3ForwardingService = `<service>
+	<serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+	<serviceId>urn:upnp-org:serviceId:L3Forwarding1</serviceId>
+	<controlURL>/ctl/L3F</controlURL>
+	<eventSubURL>/evt/L3F</eventSubURL>
+	<SCPDURL>/L3F.xml</SCPDURL>
+</service>`
+
+const testGetDefaultConnectionServiceResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+	<s:Body>
+		<u:GetDefaultConnectionServiceResponse xmlns:u="urn:schemas-upnp-org:service:Layer3Forwarding:1">
+			<NewDefaultConnectionService>uuid:wanconn-ppp:WANConnectionDevice:1,urn:upnp-org:serviceId:WANPPPConn1</NewDefaultConnectionService>
+		</u:GetDefaultConnectionServiceResponse>
+	</s:Body>
+</s:Envelope>`
+
+func TestNewClientWithLayer3Forwarding(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		layer3Forwarding   bool
+		expectedControlURL string
+	}{
+		{
+			name:               "default connection service",
+			layer3Forwarding:   true,
+			expectedControlURL: "/ctl/PPPConn",
+		},
+		{
+			name:               "fallback order",
+			layer3Forwarding:   false,
+			expectedControlURL: "/ctl/IPConn",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu          sync.Mutex
+				controlURLs = []string{}
+			)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/xml")
+
+				switch r.URL.Path {
+				case "/rootDesc.xml":
+					services := ""
+					if tc.layer3Forwarding {
+						services = testLayer3ForwardingService
+					}
+
+					_, _ = fmt.Fprintf(w, testDualWANRootDesc, services)
+				case "/ctl/L3F":
+					_, _ = w.Write([]byte(testGetDefaultConnectionServiceResponse))
+				case "/ctl/IPConn", "/ctl/PPPConn":
+					mu.Lock()
+					controlURLs = append(controlURLs, r.URL.Path)
+					mu.Unlock()
+
+					_, _ = w.Write([]byte(testGetExternalIPAddressResponse))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			location, err := url.Parse(server.URL + "/rootDesc.xml")
+			if err != nil {
+				t.Fatalf("parse location: %v", err)
+			}
+
+			client, err := upnp.NewClient(t.Context(), upnp.WithAnyConnection, upnp.WithLocation(location))
+			if err != nil {
+				t.Fatalf("new client: %v", err)
+			}
+
+			if _, err := client.GetExternalIPAddress(t.Context()); err != nil {
+				t.Fatalf("get external IP address: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if len(controlURLs) != 1 || controlURLs[0] != tc.expectedControlURL {
+				t.Fatalf("expected requests to %s, got %v", tc.expectedControlURL, controlURLs)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"strings"
+	"time"
+)
+
+// goUPnPPortMappingsLister is implemented by the goupnp clients for
+// IGD2 services which can list many port mappings in a single request.
+type goUPnPPortMappingsLister interface {
+	GetListOfPortMappingsCtx(
+		context.Context,
+		uint16,
+		uint16,
+		string,
+		bool,
+		uint16,
+	) (string, error)
+}
+
+// portMappingList is the XML document returned by GetListOfPortMappings.
+type portMappingList struct {
+	Entries []struct {
+		RemoteHost     string `xml:"NewRemoteHost"`
+		ExternalPort   uint16 `xml:"NewExternalPort"`
+		Protocol       string `xml:"NewProtocol"`
+		InternalPort   uint16 `xml:"NewInternalPort"`
+		InternalClient string `xml:"NewInternalClient"`
+		Enabled        string `xml:"NewEnabled"`
+		Description    string `xml:"NewDescription"`
+		LeaseTime      uint32 `xml:"NewLeaseTime"`
+	} `xml:"PortMappingEntry"`
+}
+
+// ListPortMappings lists the port mappings on the router that are owned by the
+// Client. The owner marker is removed from the returned port mappings' descriptions.
+func (c *Client) ListPortMappings(ctx context.Context) ([]*PortMapping, error) {
+	portMappings, err := c.listAllPortMappings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := []*PortMapping{}
+	for _, pm := range portMappings {
+		if description, ok := strings.CutPrefix(pm.Description, OwnerMarker(c.owner)); ok {
+			pm.Description = description
+			owned = append(owned, pm)
+		}
+	}
+
+	return owned, nil
+}
+
+func (c *Client) listAllPortMappings(ctx context.Context) ([]*PortMapping, error) {
+	gw, err := c.getGateway(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if lister, ok := gw.goUPnPClient.(goUPnPPortMappingsLister); ok {
+		if portMappings, err := listPortMappings(ctx, lister); err == nil {
+			return portMappings, nil
+		}
+		// Plenty of IGD2 devices do not actually implement GetListOfPortMappings,
+		// or do not allow managing every port mapping, so fall back to
+		// GetGenericPortMappingEntry.
+	}
+
+	portMappings := []*PortMapping{}
+	for i := uint16(0); ; i++ {
+		remoteHost, externalPort, protocol, internalPort, internalClient, enabled, description, leaseDuration, err := gw.goUPnPClient.GetGenericPortMappingEntryCtx(ctx, i)
+		if err != nil {
+			switch errorCode(err) {
+			case errorCodeSpecifiedArrayIndexInvalid, errorCodeNoSuchEntryInArray:
+				return portMappings, nil
+			}
+
+			return nil, c.checkError(ctx, gw, err)
+		}
+
+		portMappings = append(portMappings, &PortMapping{
+			RemoteHost:     remoteHost,
+			ExternalPort:   int32(externalPort),
+			Protocol:       Protocol(protocol),
+			InternalPort:   int32(internalPort),
+			InternalClient: net.ParseIP(internalClient),
+			Enabled:        enabled,
+			Description:    description,
+			LeaseDuration:  time.Duration(leaseDuration) * time.Second,
+		})
+
+		if i == maxPortMappingIndex {
+			return portMappings, nil
+		}
+	}
+}
+
+const maxPortMappingIndex = ^uint16(0)
+
+func listPortMappings(ctx context.Context, lister goUPnPPortMappingsLister) ([]*PortMapping, error) {
+	portMappings := []*PortMapping{}
+
+	for _, protocol := range []Protocol{ProtocolTCP, ProtocolUDP} {
+		// Manage is required to list port mappings to internal clients other than
+		// ourselves, which is all of them due to the SNAT used to create them.
+		// A NumberOfPorts of 0 means no limit.
+		listing, err := lister.GetListOfPortMappingsCtx(ctx, 0, ^uint16(0), string(protocol), true, 0)
+		if err != nil {
+			if errorCode(err) == errorCodeNoSuchEntryInArray {
+				continue
+			}
+
+			return nil, err
+		}
+
+		list := &portMappingList{}
+		if err := xml.Unmarshal([]byte(listing), list); err != nil {
+			return nil, err
+		}
+
+		for _, entry := range list.Entries {
+			portMappings = append(portMappings, &PortMapping{
+				RemoteHost:     entry.RemoteHost,
+				ExternalPort:   int32(entry.ExternalPort),
+				Protocol:       Protocol(entry.Protocol),
+				InternalPort:   int32(entry.InternalPort),
+				InternalClient: net.ParseIP(entry.InternalClient),
+				Enabled:        entry.Enabled == "1" || strings.EqualFold(entry.Enabled, "true"),
+				Description:    entry.Description,
+				LeaseDuration:  time.Duration(entry.LeaseTime) * time.Second,
+			})
+		}
+	}
+
+	return portMappings, nil
+}
@@ -0,0 +1,101 @@
+package upnp_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/soap"
+)
+
+type testGoUPnPClient struct {
+	portMappings []*upnp.PortMapping
+}
+
+func (c *testGoUPnPClient) GetExternalIPAddressCtx(context.Context) (string, error) {
+	return "203.0.113.1", nil
+}
+
+func (c *testGoUPnPClient) GetServiceClient() *goupnp.ServiceClient {
+	return &goupnp.ServiceClient{}
+}
+
+func (c *testGoUPnPClient) AddPortMappingCtx(_ context.Context, remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, _ uint32) error {
+	c.portMappings = append(c.portMappings, &upnp.PortMapping{
+		RemoteHost:     remoteHost,
+		ExternalPort:   int32(externalPort),
+		Protocol:       upnp.Protocol(protocol),
+		InternalPort:   int32(internalPort),
+		InternalClient: net.ParseIP(internalClient),
+		Enabled:        enabled,
+		Description:    description,
+	})
+	return nil
+}
+
+func (c *testGoUPnPClient) DeletePortMappingCtx(_ context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	for i, pm := range c.portMappings {
+		if pm.RemoteHost == remoteHost && pm.ExternalPort == int32(externalPort) && string(pm.Protocol) == protocol {
+			c.portMappings = append(c.portMappings[:i], c.portMappings[i+1:]...)
+			return nil
+		}
+	}
+
+	return noSuchEntryInArray()
+}
+
+func (c *testGoUPnPClient) GetGenericPortMappingEntryCtx(_ context.Context, i uint16) (string, uint16, string, uint16, string, bool, string, uint32, error) {
+	if int(i) >= len(c.portMappings) {
+		return "", 0, "", 0, "", false, "", 0, noSuchEntryInArray()
+	}
+
+	pm := c.portMappings[i]
+	return pm.RemoteHost, uint16(pm.ExternalPort), string(pm.Protocol), uint16(pm.InternalPort), pm.InternalClient.String(), pm.Enabled, pm.Description, 0, nil
+}
+
+func noSuchEntryInArray() error {
+	fault := &soap.SOAPFaultError{}
+	fault.Detail.UPnPError.Errorcode = 714
+	return fault
+}
+
+func TestClientListPortMappings(t *testing.T) {
+	goUPnPClient := &testGoUPnPClient{
+		portMappings: []*upnp.PortMapping{
+			{ExternalPort: 22, Protocol: upnp.ProtocolTCP, InternalPort: 22, InternalClient: net.ParseIP("192.168.0.2"), Description: "someone else's"},
+		},
+	}
+
+	client, err := upnp.NewClient(t.Context(), upnp.WithGoUPnPClient(goUPnPClient), upnp.WithOwner("test"))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	for _, externalPort := range []int32{80, 443} {
+		if err := client.AddPortMapping(t.Context(), &upnp.PortMapping{
+			ExternalPort:   externalPort,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   externalPort,
+			InternalClient: net.ParseIP("192.168.0.11"),
+			Enabled:        true,
+			Description:    "port-forward default/sample",
+		}); err != nil {
+			t.Fatalf("add port mapping: %v", err)
+		}
+	}
+
+	owned, err := client.ListPortMappings(t.Context())
+	if err != nil {
+		t.Fatalf("list port mappings: %v", err)
+	}
+
+	if len(owned) != 2 {
+		t.Fatalf("expected 2 owned port mappings, got %d", len(owned))
+	}
+
+	if owned[0].Description != "port-forward default/sample" {
+		t.Fatalf("expected description without owner marker, got %q", owned[0].Description)
+	}
+}
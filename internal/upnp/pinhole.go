@@ -0,0 +1,167 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway2"
+)
+
+// GoUPnPFirewallControlClient is the subset of goupnp's
+// WANIPv6FirewallControl1 client that is used to open IPv6 pinholes.
+type GoUPnPFirewallControlClient interface {
+	AddPinholeCtx(
+		context.Context,
+		string,
+		uint16,
+		string,
+		uint16,
+		uint16,
+		uint32,
+	) (uint16, error)
+	UpdatePinholeCtx(
+		context.Context,
+		uint16,
+		uint32,
+	) error
+	DeletePinholeCtx(
+		context.Context,
+		uint16,
+	) error
+}
+
+var _ GoUPnPFirewallControlClient = &internetgateway2.WANIPv6FirewallControl1{}
+
+const (
+	// errorCodePinholeNoSuchEntry is the UPnP error code
+	// returned when the specified pinhole does not exist.
+	errorCodePinholeNoSuchEntry = 704
+	// maxPinholeLeaseDuration is the longest
+	// lease that WANIPv6FirewallControl allows.
+	maxPinholeLeaseDuration = 24 * time.Hour
+)
+
+var (
+	// ErrNoFirewallControl is returned when asked to port forward to an IPv6 address
+	// but the router does not have the WANIPv6FirewallControl service.
+	ErrNoFirewallControl = errors.New("router does not support IPv6 pinholes")
+)
+
+// addPinhole opens a pinhole to the PortMapping's InternalClient and InternalPort, as
+// IPv6 is not NATed. If the PortMapping already has a PinholeID, its lease is renewed
+// instead, falling back to opening a new pinhole if the router no longer has it. The
+// PortMapping's PinholeID is set to that of the pinhole.
+func (c *Client) addPinhole(ctx context.Context, pm *PortMapping) error {
+	gw, err := c.getGateway(ctx)
+	if err != nil {
+		return err
+	}
+
+	if gw.firewallControlClient == nil {
+		return ErrNoFirewallControl
+	}
+
+	protocol, err := ianaProtocolNumber(pm.Protocol)
+	if err != nil {
+		return err
+	}
+
+	// Pinholes cannot be disabled, so disabled port mappings
+	// just do not have one.
+	if !pm.Enabled {
+		if err := c.deletePinhole(ctx, pm); err != nil {
+			return err
+		}
+
+		pm.PinholeID = nil
+		return nil
+	}
+
+	// Pinholes cannot be permanent, so the lease is capped
+	// and the PortMapping updated to be renewed in time.
+	if pm.LeaseDuration <= 0 || pm.LeaseDuration > maxPinholeLeaseDuration {
+		pm.LeaseDuration = maxPinholeLeaseDuration
+	}
+	leaseTime := uint32(max(pm.LeaseDuration, time.Second).Seconds())
+
+	if pm.PinholeID != nil {
+		if err := gw.firewallControlClient.UpdatePinholeCtx(ctx, *pm.PinholeID, leaseTime); err == nil {
+			return nil
+		} else if errorCode(err) != errorCodePinholeNoSuchEntry {
+			return c.checkError(ctx, gw, err)
+		}
+	}
+
+	// The RemoteHost is a wildcard when empty, but the RemotePort must be explicitly
+	// wildcarded. There is no external port to speak of.
+	uniqueID, err := gw.firewallControlClient.AddPinholeCtx(ctx,
+		pm.RemoteHost,
+		0,
+		pm.InternalClient.String(),
+		uint16(pm.InternalPort),
+		protocol,
+		leaseTime,
+	)
+	if err != nil {
+		return c.checkError(ctx, gw, err)
+	}
+
+	pm.PinholeID = &uniqueID
+
+	return nil
+}
+
+// deletePinhole deletes the PortMapping's pinhole, if it has one. It is not an error if
+// the pinhole does not exist. IPv6 pinholes cannot be listed, so one without a
+// recorded PinholeID is left to expire on its own.
+func (c *Client) deletePinhole(ctx context.Context, pm *PortMapping) error {
+	if pm.PinholeID == nil {
+		return nil
+	}
+
+	gw, err := c.getGateway(ctx)
+	if err != nil {
+		return err
+	}
+
+	if gw.firewallControlClient == nil {
+		return ErrNoFirewallControl
+	}
+
+	if err := gw.firewallControlClient.DeletePinholeCtx(ctx, *pm.PinholeID); err != nil && errorCode(err) != errorCodePinholeNoSuchEntry {
+		return c.checkError(ctx, gw, err)
+	}
+
+	return nil
+}
+
+// ianaProtocolNumber returns the IANA protocol
+// number that pinholes identify protocols by.
+func ianaProtocolNumber(protocol Protocol) (uint16, error) {
+	switch protocol {
+	case ProtocolTCP:
+		return 6, nil
+	case ProtocolUDP:
+		return 17, nil
+	}
+
+	return 0, fmt.Errorf("unsupported protocol %s", protocol)
+}
+
+// getFirewallControlClient returns a client for the WANIPv6FirewallControl service of
+// the device that the given GoUPnPClient is for, if it has one.
+func getFirewallControlClient(goUPnPClient GoUPnPClient) GoUPnPFirewallControlClient {
+	serviceClient := goUPnPClient.GetServiceClient()
+	if serviceClient == nil || serviceClient.RootDevice == nil {
+		return nil
+	}
+
+	clients, err := internetgateway2.NewWANIPv6FirewallControl1ClientsFromRootDevice(serviceClient.RootDevice, serviceClient.Location)
+	if err != nil || len(clients) == 0 {
+		return nil
+	}
+
+	return clients[0]
+}
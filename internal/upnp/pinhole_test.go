@@ -0,0 +1,131 @@
+package upnp_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+	"github.com/huin/goupnp/soap"
+)
+
+type testPinhole struct {
+	internalClient string
+	internalPort   uint16
+	protocol       uint16
+	leaseTime      uint32
+}
+
+type testFirewallControlClient struct {
+	nextUniqueID uint16
+	pinholes     map[uint16]*testPinhole
+}
+
+func (c *testFirewallControlClient) AddPinholeCtx(_ context.Context, _ string, _ uint16, internalClient string, internalPort uint16, protocol uint16, leaseTime uint32) (uint16, error) {
+	c.nextUniqueID++
+	c.pinholes[c.nextUniqueID] = &testPinhole{internalClient, internalPort, protocol, leaseTime}
+	return c.nextUniqueID, nil
+}
+
+func (c *testFirewallControlClient) UpdatePinholeCtx(_ context.Context, uniqueID uint16, leaseTime uint32) error {
+	pinhole, ok := c.pinholes[uniqueID]
+	if !ok {
+		return pinholeNoSuchEntry()
+	}
+
+	pinhole.leaseTime = leaseTime
+	return nil
+}
+
+func (c *testFirewallControlClient) DeletePinholeCtx(_ context.Context, uniqueID uint16) error {
+	if _, ok := c.pinholes[uniqueID]; !ok {
+		return pinholeNoSuchEntry()
+	}
+
+	delete(c.pinholes, uniqueID)
+	return nil
+}
+
+func pinholeNoSuchEntry() error {
+	fault := &soap.SOAPFaultError{}
+	fault.Detail.UPnPError.Errorcode = 704
+	return fault
+}
+
+func TestClientPinholes(t *testing.T) {
+	var (
+		goUPnPClient          = &testGoUPnPClient{}
+		firewallControlClient = &testFirewallControlClient{pinholes: map[uint16]*testPinhole{}}
+	)
+
+	client, err := upnp.NewClient(t.Context(), upnp.WithGoUPnPClient(goUPnPClient), upnp.WithFirewallControlClient(firewallControlClient))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	for _, internalClient := range []string{"192.168.0.11", "2001:db8::11"} {
+		pm := &upnp.PortMapping{
+			ExternalPort:   8080,
+			Protocol:       upnp.ProtocolTCP,
+			InternalPort:   80,
+			InternalClient: net.ParseIP(internalClient),
+			Enabled:        true,
+			LeaseDuration:  time.Hour,
+		}
+
+		if err := client.AddPortMapping(t.Context(), pm); err != nil {
+			t.Fatalf("add port mapping to %s: %v", internalClient, err)
+		}
+
+		if (pm.PinholeID != nil) != (pm.InternalClient.To4() == nil) {
+			t.Fatalf("expected only the port mapping to an IPv6 address to be a pinhole, got pinhole ID %v for %s", pm.PinholeID, internalClient)
+		}
+	}
+
+	if len(goUPnPClient.portMappings) != 1 || len(firewallControlClient.pinholes) != 1 {
+		t.Fatalf("expected 1 port mapping and 1 pinhole, got %d and %d", len(goUPnPClient.portMappings), len(firewallControlClient.pinholes))
+	}
+
+	pinhole := firewallControlClient.pinholes[1]
+	if pinhole.internalClient != "2001:db8::11" || pinhole.internalPort != 80 || pinhole.protocol != 6 || pinhole.leaseTime != 3600 {
+		t.Fatalf("unexpected pinhole %+v", pinhole)
+	}
+
+	// Renewing should update the existing pinhole rather than adding another.
+	uniqueID := uint16(1)
+	pm := &upnp.PortMapping{
+		ExternalPort:   8080,
+		Protocol:       upnp.ProtocolTCP,
+		InternalPort:   80,
+		InternalClient: net.ParseIP("2001:db8::11"),
+		Enabled:        true,
+		PinholeID:      &uniqueID,
+	}
+
+	if err := client.AddPortMapping(t.Context(), pm); err != nil {
+		t.Fatalf("renew pinhole: %v", err)
+	}
+
+	if len(firewallControlClient.pinholes) != 1 || *pm.PinholeID != uniqueID {
+		t.Fatalf("expected pinhole %d to be renewed, got %d pinholes", uniqueID, len(firewallControlClient.pinholes))
+	}
+
+	// Pinholes cannot be permanent.
+	if pm.LeaseDuration != 24*time.Hour || pinhole.leaseTime != 86400 {
+		t.Fatalf("expected lease to be capped at 24h, got %s", pm.LeaseDuration)
+	}
+
+	if err := client.DeletePortMapping(t.Context(), pm); err != nil {
+		t.Fatalf("delete pinhole: %v", err)
+	}
+
+	if len(firewallControlClient.pinholes) != 0 || len(goUPnPClient.portMappings) != 1 {
+		t.Fatalf("expected only the pinhole to be deleted")
+	}
+
+	// Deleting it again should not be an error.
+	if err := client.DeletePortMapping(t.Context(), pm); err != nil {
+		t.Fatalf("delete deleted pinhole: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package upnp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/logutil"
+)
+
+const (
+	// minDiscoveryBackoff is how long RunDiscovery waits
+	// before retrying discovery after it first fails.
+	minDiscoveryBackoff = time.Second
+	// maxDiscoveryBackoff is the longest that RunDiscovery
+	// waits before retrying discovery.
+	maxDiscoveryBackoff = 5 * time.Minute
+)
+
+// gateway is a gateway that a Client has discovered.
+type gateway struct {
+	goUPnPClient          GoUPnPClient
+	firewallControlClient GoUPnPFirewallControlClient
+	// sourceIPAddress overrides the IP address that
+	// goupnp says that the Client talks to the gateway from.
+	sourceIPAddress net.IP
+	// serviceIPAddress caches the resolved IP address of the gateway.
+	serviceIPAddress net.IP
+}
+
+// NewLazyClient creates a Client like NewClient, but without discovering a
+// gateway. Instead, RunDiscovery must be run to discover one in the background.
+// Until it has, and whenever the gateway goes away until it is rediscovered,
+// the Client's methods return ErrNoClients.
+func NewLazyClient(opts ...NewClientOpt) *Client {
+	c := newClient(opts...)
+	c.lazy = true
+	return c
+}
+
+// RunDiscovery discovers a gateway for the Client, retrying with backoff
+// until it does, and then again whenever the gateway goes away, such as when
+// it reboots and comes back with a new SOAP port, until the given context is
+// done.
+func (c *Client) RunDiscovery(ctx context.Context) error {
+	var (
+		log     = logutil.SloggerFrom(ctx)
+		backoff = minDiscoveryBackoff
+	)
+
+	for {
+		if _, err := c.discover(ctx); err != nil {
+			log.Error("gateway discovery failed", "err", err, "retryIn", backoff)
+
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			case <-timer.C:
+			}
+
+			backoff = min(backoff*2, maxDiscoveryBackoff)
+			continue
+		}
+
+		backoff = minDiscoveryBackoff
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.rediscover:
+		}
+	}
+}
+
+// Ready is a healthz.Checker that fails while
+// the Client does not have a gateway.
+func (c *Client) Ready(*http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gateway == nil {
+		return ErrNoClients
+	}
+
+	return nil
+}
+
+// getGateway returns the Client's gateway. If it does not have one, it is
+// discovered, unless the Client is lazy, in which case RunDiscovery is
+// asked to discover one and ErrNoClients is returned.
+func (c *Client) getGateway(ctx context.Context) (*gateway, error) {
+	c.mu.Lock()
+	gw := c.gateway
+	c.mu.Unlock()
+
+	if gw != nil {
+		return gw, nil
+	}
+
+	if c.lazy {
+		c.requestDiscovery()
+		return nil, ErrNoClients
+	}
+
+	return c.discover(ctx)
+}
+
+// discover discovers a gateway for the Client if it does not already have one.
+func (c *Client) discover(ctx context.Context) (*gateway, error) {
+	c.discoverMu.Lock()
+	defer c.discoverMu.Unlock()
+
+	c.mu.Lock()
+	gw := c.gateway
+	c.mu.Unlock()
+
+	if gw != nil {
+		return gw, nil
+	}
+
+	gw, err := c.opts.discoverGateway(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logutil.SloggerFrom(ctx).Info("discovered gateway", "location", gatewayLocation(gw.goUPnPClient))
+
+	c.mu.Lock()
+	c.gateway = gw
+	c.mu.Unlock()
+
+	return gw, nil
+}
+
+// checkError forgets the given gateway so that it is rediscovered if the
+// given error from talking to it says that it has gone away. It returns the
+// given error, wrapping the ErrorCode of its SOAP fault, if it has a known one.
+func (c *Client) checkError(ctx context.Context, gw *gateway, err error) error {
+	if err == nil {
+		return nil
+	} else if ctx.Err() != nil || !isGatewayGone(err) {
+		return typedError(err)
+	}
+
+	c.mu.Lock()
+	forgotten := c.gateway == gw
+	if forgotten {
+		c.gateway = nil
+	}
+	c.mu.Unlock()
+
+	if forgotten {
+		logutil.SloggerFrom(ctx).Info("lost gateway", "location", gatewayLocation(gw.goUPnPClient), "reason", err)
+		c.requestDiscovery()
+	}
+
+	return err
+}
+
+// requestDiscovery asks RunDiscovery, if it is running,
+// to discover a gateway without blocking.
+func (c *Client) requestDiscovery() {
+	select {
+	case c.rediscover <- struct{}{}:
+	default:
+	}
+}
+
+// isGatewayGone returns whether the given error from goupnp says that
+// the gateway could not be reached or no longer serves the service where
+// it used to. goupnp does not wrap the errors that cause these, so they
+// can only be told apart by their messages.
+func isGatewayGone(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "error performing SOAP HTTP request") ||
+		strings.Contains(msg, "SOAP request got HTTP 404") ||
+		strings.Contains(msg, "error decoding response body")
+}
@@ -0,0 +1,129 @@
+package upnp_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/frantjc/port-forward/internal/upnp"
+)
+
+const testGetExternalIPAddressResponse = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+	<s:Body>
+		<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+			<NewExternalIPAddress>203.0.113.1</NewExternalIPAddress>
+		</u:GetExternalIPAddressResponse>
+	</s:Body>
+</s:Envelope>`
+
+// newTestGatewayServer serves testRootDesc with the given control URL and
+// answers GetExternalIPAddress there, 404ing at any other control URL
+// as a router does after it reboots and moves its SOAP port.
+func newTestGatewayServer(controlURL *atomic.Value, requests *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			requests.Add(1)
+			w.Header().Set("Content-Type", "text/xml")
+			_, _ = w.Write([]byte(strings.Replace(testRootDesc, "/ctl/IPConn", controlURL.Load().(string), 1)))
+		case controlURL.Load().(string):
+			w.Header().Set("Content-Type", "text/xml")
+			_, _ = w.Write([]byte(testGetExternalIPAddressResponse))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestClientRediscoversGateway(t *testing.T) {
+	var (
+		controlURL atomic.Value
+		requests   atomic.Int32
+	)
+	controlURL.Store("/ctl/IPConn")
+
+	server := newTestGatewayServer(&controlURL, &requests)
+	defer server.Close()
+
+	location, err := url.Parse(server.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatalf("parse location: %v", err)
+	}
+
+	client, err := upnp.NewClient(t.Context(), upnp.WithAnyConnection, upnp.WithLocation(location))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+
+	if _, err := client.GetExternalIPAddress(t.Context()); err != nil {
+		t.Fatalf("get external IP address: %v", err)
+	}
+
+	controlURL.Store("/ctl/IPConn2")
+
+	if _, err := client.GetExternalIPAddress(t.Context()); err == nil {
+		t.Fatal("expected error from the gateway's old control URL")
+	}
+
+	externalIPAddress, err := client.GetExternalIPAddress(t.Context())
+	if err != nil {
+		t.Fatalf("get external IP address after rediscovery: %v", err)
+	}
+
+	if !externalIPAddress.Equal(net.IPv4(203, 0, 113, 1)) {
+		t.Fatalf("expected external IP address 203.0.113.1, got %s", externalIPAddress)
+	}
+
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("expected device description to be requested twice, got %d", n)
+	}
+}
+
+func TestLazyClientRunDiscovery(t *testing.T) {
+	var (
+		controlURL atomic.Value
+		requests   atomic.Int32
+	)
+	controlURL.Store("/ctl/IPConn")
+
+	server := newTestGatewayServer(&controlURL, &requests)
+	defer server.Close()
+
+	location, err := url.Parse(server.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatalf("parse location: %v", err)
+	}
+
+	client := upnp.NewLazyClient(upnp.WithAnyConnection, upnp.WithLocation(location))
+
+	if err := client.Ready(nil); !errors.Is(err, upnp.ErrNoClients) {
+		t.Fatalf("expected not ready with ErrNoClients, got %v", err)
+	}
+
+	if _, err := client.GetExternalIPAddress(t.Context()); !errors.Is(err, upnp.ErrNoClients) {
+		t.Fatalf("expected ErrNoClients before discovery, got %v", err)
+	}
+
+	go func() {
+		_ = client.RunDiscovery(t.Context())
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); client.Ready(nil) != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for gateway to be discovered")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := client.GetExternalIPAddress(t.Context()); err != nil {
+		t.Fatalf("get external IP address: %v", err)
+	}
+}
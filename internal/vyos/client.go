@@ -0,0 +1,110 @@
+package vyos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Operation is a configuration operation, e.g. "set" or "delete", on a path.
+// Values are given as the last element of the path.
+type Operation struct {
+	Op   string   `json:"op"`
+	Path []string `json:"path"`
+}
+
+// Set returns an Operation which sets the given path.
+func Set(path ...string) Operation {
+	return Operation{Op: "set", Path: path}
+}
+
+// Delete returns an Operation which deletes the given path.
+func Delete(path ...string) Operation {
+	return Operation{Op: "delete", Path: path}
+}
+
+// ErrEmptyPath is returned when showing the configuration under a path that has none.
+var ErrEmptyPath = errors.New("configuration under specified path is empty")
+
+// Client is a VyOS HTTPS API client.
+type Client struct {
+	// URL is the base URL of the VyOS HTTPS API, e.g. https://192.168.0.1.
+	URL *url.URL
+	// Key is a key for the VyOS HTTPS API.
+	Key string
+	// HTTPClient is used to make requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// ShowConfig decodes the configuration under the given path into out.
+func (c *Client) ShowConfig(ctx context.Context, path []string, out any) error {
+	return c.do(ctx, "retrieve", map[string]any{"op": "showConfig", "path": path}, out)
+}
+
+// Configure applies the given Operations in a single commit.
+func (c *Client) Configure(ctx context.Context, ops ...Operation) error {
+	return c.do(ctx, "configure", ops, nil)
+}
+
+// Save saves the running configuration so that it persists across reboots.
+func (c *Client) Save(ctx context.Context) error {
+	return c.do(ctx, "config-file", map[string]any{"op": "save"}, nil)
+}
+
+type response struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error"`
+}
+
+func (c *Client) do(ctx context.Context, endpoint string, data, out any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"data": {string(b)},
+		"key":  {c.Key},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL.JoinPath(endpoint).String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	httpRes, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+
+	res := &response{}
+	if err := json.NewDecoder(httpRes.Body).Decode(res); err != nil {
+		return fmt.Errorf("%s: %s", endpoint, httpRes.Status)
+	}
+
+	if !res.Success {
+		if strings.Contains(strings.ToLower(res.Error), ErrEmptyPath.Error()) {
+			return fmt.Errorf("%s: %w", endpoint, ErrEmptyPath)
+		}
+
+		return fmt.Errorf("%s: %s: %s", endpoint, httpRes.Status, res.Error)
+	}
+
+	if out != nil {
+		return json.Unmarshal(res.Data, out)
+	}
+
+	return nil
+}
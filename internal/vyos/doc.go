@@ -0,0 +1,2 @@
+// package vyos provides a client for the VyOS HTTPS API.
+package vyos